@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client authentication methods accepted by OIDC_AUTH_METHOD.
+const (
+	authMethodClientSecretPost = "client_secret_post"
+	authMethodClientSecretJWT  = "client_secret_jwt"
+)
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// assertionSigner signs the header and payload of a client assertion JWT.
+type assertionSigner interface {
+	// Algorithm is the JWS "alg" header value.
+	Algorithm() string
+	Sign(signingInput []byte) ([]byte, error)
+}
+
+// hmacSigner signs assertions with HS256 using the client secret, as
+// client_secret_jwt requires.
+type hmacSigner struct {
+	secret []byte
+}
+
+func (s hmacSigner) Algorithm() string {
+	return "HS256"
+}
+
+func (s hmacSigner) Sign(signingInput []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(signingInput)
+	return mac.Sum(nil), nil
+}
+
+// buildClientAssertion creates a signed JWT authenticating clientID to the
+// token endpoint at audience (RFC 7523 section 3).
+func buildClientAssertion(signer assertionSigner, clientID, audience string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": signer.Algorithm(),
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode assertion header: %w", err)
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": uuid.NewString(),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode assertion claims: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature, err := signer.Sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client assertion: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
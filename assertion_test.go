@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyHS256 checks an HS256 JWT against secret and returns its header and
+// claims.
+func verifyHS256(t *testing.T, token string, secret []byte) (header, claims map[string]interface{}) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion %q is not a JWT", token)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Fatal("signature does not verify with the client secret")
+	}
+	for i, into := range []*map[string]interface{}{&header, &claims} {
+		decoded, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(decoded, into); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return header, claims
+}
+
+func TestBuildClientAssertionHS256(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	assertion, err := buildClientAssertion(hmacSigner{secret: []byte("s3cret")}, "client", "https://idp.example.com/token", now)
+	if err != nil {
+		t.Fatalf("buildClientAssertion() = %v", err)
+	}
+	header, claims := verifyHS256(t, assertion, []byte("s3cret"))
+	if header["alg"] != "HS256" {
+		t.Errorf("alg = %v, want HS256", header["alg"])
+	}
+	for key, want := range map[string]interface{}{
+		"iss": "client",
+		"sub": "client",
+		"aud": "https://idp.example.com/token",
+		"iat": float64(now.Unix()),
+		"exp": float64(now.Add(clientAssertionLifetime).Unix()),
+	} {
+		if claims[key] != want {
+			t.Errorf("claim %s = %v, want %v", key, claims[key], want)
+		}
+	}
+	if jti, _ := claims["jti"].(string); jti == "" {
+		t.Error("assertion has no jti")
+	}
+
+	other, err := buildClientAssertion(hmacSigner{secret: []byte("s3cret")}, "client", "https://idp.example.com/token", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == assertion {
+		t.Error("two assertions are identical, want a unique jti each")
+	}
+}
+
+func TestFetchOIDCTokenClientSecretJWT(t *testing.T) {
+	server := newFakeTokenServer(t, testTokenBody)
+	tokenReq := testTokenRequest(server.URL)
+	tokenReq.AuthMethod = authMethodClientSecretJWT
+	if _, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq); err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+
+	form := server.requests()[0].Form
+	if form.Has("client_secret") {
+		t.Error("client_secret sent with client_secret_jwt")
+	}
+	if got := form.Get("client_assertion_type"); got != clientAssertionType {
+		t.Errorf("client_assertion_type = %q", got)
+	}
+	_, claims := verifyHS256(t, form.Get("client_assertion"), []byte(tokenReq.ClientSecret))
+	if claims["aud"] != server.URL {
+		t.Errorf("aud = %v, want the token endpoint %s", claims["aud"], server.URL)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// secretsManagerAPI is the subset of the Secrets Manager client used by
+// awsSecretsManagerSink.
+type secretsManagerAPI interface {
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+}
+
+// awsSecretsManagerSink stores the token as the SecretString of an AWS
+// Secrets Manager secret.
+type awsSecretsManagerSink struct {
+	client   secretsManagerAPI
+	secretID string
+}
+
+// newAWSSecretsManagerSink resolves AWS credentials and region the standard
+// way (environment, shared config, web identity, instance metadata).
+func newAWSSecretsManagerSink(ctx context.Context, secretID string) (*awsSecretsManagerSink, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return &awsSecretsManagerSink{client: secretsmanager.NewFromConfig(awsCfg), secretID: secretID}, nil
+}
+
+func (s *awsSecretsManagerSink) Name() string {
+	return fmt.Sprintf("AWS Secrets Manager secret '%s'", s.secretID)
+}
+
+// Write adds a new version to the secret, creating the secret if it does not
+// exist yet. A secret referenced by ARN must already exist.
+func (s *awsSecretsManagerSink) Write(ctx context.Context, accessToken string) error {
+	_, err := s.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(s.secretID),
+		SecretString: aws.String(accessToken),
+	})
+	if err == nil {
+		return nil
+	}
+	var notFound *smtypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) || strings.HasPrefix(s.secretID, "arn:") {
+		return fmt.Errorf("failed to put secret value: %w", err)
+	}
+
+	_, err = s.client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(s.secretID),
+		SecretString: aws.String(accessToken),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create secret: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// fakeSecretsManager keeps secret values by name. putErr, when set, is
+// returned by every PutSecretValue call instead.
+type fakeSecretsManager struct {
+	values  map[string]string
+	putErr  error
+	puts    int
+	creates int
+}
+
+func (f *fakeSecretsManager) PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	f.puts++
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	id := aws.ToString(params.SecretId)
+	if _, ok := f.values[id]; !ok {
+		return nil, &smtypes.ResourceNotFoundException{Message: aws.String("secret not found")}
+	}
+	f.values[id] = aws.ToString(params.SecretString)
+	return &secretsmanager.PutSecretValueOutput{}, nil
+}
+
+func (f *fakeSecretsManager) CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	f.creates++
+	f.values[aws.ToString(params.Name)] = aws.ToString(params.SecretString)
+	return &secretsmanager.CreateSecretOutput{}, nil
+}
+
+func TestAWSSecretsManagerSinkCreatesThenUpdates(t *testing.T) {
+	client := &fakeSecretsManager{values: make(map[string]string)}
+	sink := &awsSecretsManagerSink{client: client, secretID: "platform/oidc-token"}
+
+	if err := sink.Write(context.Background(), "first"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if client.creates != 1 || client.values["platform/oidc-token"] != "first" {
+		t.Errorf("after first write: %d creates, value %q, want the secret created", client.creates, client.values["platform/oidc-token"])
+	}
+
+	if err := sink.Write(context.Background(), "second"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if client.creates != 1 || client.puts != 2 || client.values["platform/oidc-token"] != "second" {
+		t.Errorf("after second write: %d creates, %d puts, value %q, want a new version put", client.creates, client.puts, client.values["platform/oidc-token"])
+	}
+}
+
+func TestAWSSecretsManagerSinkARNMustExist(t *testing.T) {
+	client := &fakeSecretsManager{values: make(map[string]string)}
+	sink := &awsSecretsManagerSink{client: client, secretID: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:oidc-token"}
+
+	err := sink.Write(context.Background(), "token")
+	var notFound *smtypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		t.Fatalf("Write() = %v, want the not-found error", err)
+	}
+	if client.creates != 0 {
+		t.Error("a secret referenced by ARN was created")
+	}
+}
+
+func TestAWSSecretsManagerSinkPutError(t *testing.T) {
+	denied := errors.New("AccessDeniedException")
+	client := &fakeSecretsManager{values: make(map[string]string), putErr: denied}
+	sink := &awsSecretsManagerSink{client: client, secretID: "platform/oidc-token"}
+
+	if err := sink.Write(context.Background(), "token"); !errors.Is(err, denied) {
+		t.Errorf("Write() = %v, want the put error", err)
+	}
+	if client.creates != 0 {
+		t.Error("CreateSecret called after a put error other than not found")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultBatchPause = 1 * time.Second
+
+// namespaceBatcher pauses between batches of namespaces to spread secret
+// writes out over time on large clusters. Batches span namespace groups, so
+// the pacing holds for the run as a whole. A size of 0 disables batching.
+type namespaceBatcher struct {
+	size    int
+	pause   time.Duration
+	started int
+}
+
+func newNamespaceBatcher(size int, pause time.Duration) *namespaceBatcher {
+	return &namespaceBatcher{size: size, pause: pause}
+}
+
+// next is called before each namespace is processed. It sleeps for the batch
+// pause when a new batch begins, returning early with ctx's error if ctx is
+// done first.
+func (b *namespaceBatcher) next(ctx context.Context) error {
+	if b.size == 0 {
+		return nil
+	}
+	b.started++
+	if b.started == 1 || (b.started-1)%b.size != 0 || b.pause == 0 {
+		return nil
+	}
+
+	log.Printf("Completed a batch of %d namespaces, pausing for %v...", b.size, b.pause)
+	return sleepContext(ctx, b.pause)
+}
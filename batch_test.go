@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceBatcherPausesBetweenBatches(t *testing.T) {
+	logs := captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	namespaces := testNamespaces(7)
+
+	start := time.Now()
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(3, 50*time.Millisecond), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if summary.Created != 7 {
+		t.Errorf("summary = %s, want every namespace processed", summary)
+	}
+	// Batches of 3, 3 and 1: two pauses, none after the last batch.
+	if pauses := strings.Count(logs.String(), "Completed a batch of 3 namespaces, pausing for 50ms"); pauses != 2 {
+		t.Errorf("paused %d times, want 2", pauses)
+	}
+	if elapsed < 100*time.Millisecond {
+		t.Errorf("run took %v, want at least two 50ms pauses", elapsed)
+	}
+}
+
+func TestNamespaceBatcherDisabled(t *testing.T) {
+	batches := newNamespaceBatcher(0, time.Hour)
+	for range 10 {
+		if err := batches.next(context.Background()); err != nil {
+			t.Fatalf("next() = %v", err)
+		}
+	}
+}
+
+func TestNamespaceBatcherPauseInterrupted(t *testing.T) {
+	captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := newNamespaceBatcher(1, time.Hour)
+	if err := batches.next(ctx); err != nil {
+		t.Fatalf("first next() = %v, want no pause before the first batch", err)
+	}
+	cancel()
+	if err := batches.next(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("next() = %v, want the pause cut short by the cancelled context", err)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// checksumAnnotation holds a hash of the token on each target secret, so
+// workloads can template it into a pod annotation and roll out when the
+// token changes.
+const checksumAnnotation = "oidc.token/checksum"
+
+// tokenChecksum returns the hex-encoded SHA-256 of the token. It only
+// changes when the token does.
+func tokenChecksum(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTokenChecksum(t *testing.T) {
+	if tokenChecksum("token-a") != tokenChecksum("token-a") {
+		t.Error("checksum of the same token differs")
+	}
+	if tokenChecksum("token-a") == tokenChecksum("token-b") {
+		t.Error("checksum of different tokens is the same")
+	}
+	if got := len(tokenChecksum("token-a")); got != 64 {
+		t.Errorf("checksum length = %d, want a hex SHA-256", got)
+	}
+}
+
+func TestChecksumAnnotationFollowsToken(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	checksum := func() string {
+		t.Helper()
+		secret, err := clientset.CoreV1().Secrets("team-a").Get(ctx, "oidc-token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret.Annotations[checksumAnnotation]
+	}
+	write := func(token string) {
+		t.Helper()
+		spec := testSpec()
+		spec.Data = map[string][]byte{"token": []byte(token)}
+		spec.Checksum = tokenChecksum(token)
+		if _, err := createOrUpdateSecret(ctx, clientset, "team-a", spec); err != nil {
+			t.Fatalf("createOrUpdateSecret() = %v", err)
+		}
+	}
+
+	write("token-a")
+	first := checksum()
+	if first != tokenChecksum("token-a") {
+		t.Fatalf("checksum = %q, want the token's checksum", first)
+	}
+	write("token-a")
+	if got := checksum(); got != first {
+		t.Errorf("checksum changed to %q although the token did not", got)
+	}
+	write("token-b")
+	if got := checksum(); got == first || got != tokenChecksum("token-b") {
+		t.Errorf("checksum = %q after the token changed, want the new token's checksum", got)
+	}
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// config is the fully parsed and validated runtime configuration.
+type config struct {
+	Mode        string
+	RunID       string
+	PrintConfig bool
+
+	TokenURLs    []string
+	ClientID     string
+	ClientSecret string `redact:"true"`
+	AuthMethod   string
+	Scopes       string
+	UserAgent    string
+	Accept       string
+	ContentType  string
+
+	SubjectToken     *githubActionsIDToken
+	CredentialHelper *credentialHelper
+
+	GatewayBasicUser     string
+	GatewayBasicPassword string `redact:"true"`
+	TokenPath            *responsePath
+	ExpiresPath          *responsePath
+	// ExpiresPathDefault is set when ExpiresPath is the default expires_at
+	// field rather than one the user asked for.
+	ExpiresPathDefault bool
+
+	WaitForIdP     bool
+	IdPWaitTimeout time.Duration
+
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	LogTokenClaims  bool
+	RequireBearer   bool
+
+	DisableHTTP2        bool
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	MaxResponseBytes    int
+
+	SecretName string
+	// SecretNameTemplate, when set, gives each namespace its own secret name.
+	SecretNameTemplate *secretNameTemplate
+	SecretKey          string
+	ClaimsKey          string
+	MetadataKeys       secretMetadataKeys
+	FieldManager       string
+
+	SecretTemplate     secretTemplate
+	SecretEncoding     string
+	ClaimsAllowlist    []string
+	ClaimsGzip         bool
+	ClaimsPretty       bool
+	CleanupKeys        []string
+	ChecksumAnnotation bool
+	VerifyAfterWrite   bool
+	RotationMetadata   bool
+
+	AllowImmutableRecreate bool
+	SecretImmutable        bool
+	RefreshBeforeExpiry    time.Duration
+	DefaultTokenLifetime   time.Duration
+	ClockSkew              time.Duration
+	ForceRefresh           bool
+	OnQuotaExceeded        string
+
+	Kube                    kubeConnection
+	Namespaces              namespaceSource
+	SortNamespaces          bool
+	RequireNamespacesExist  bool
+	CreateMissingNamespaces bool
+	RequireNamespaceOptIn   bool
+	OnlyUsedNamespaces      bool
+	RestartConsumers        bool
+	NamespaceGroups         []namespaceGroup
+	DefaultNamespaceGroup   string
+	TokenFetchConcurrency   int
+	PreflightRBAC           bool
+	RunDeadline             time.Duration
+	TokenPropagationDelay   time.Duration
+	SecretOpTimeout         time.Duration
+	NamespaceBatchSize      int
+	BatchPause              time.Duration
+	ProgressLogInterval     int
+
+	StatusSecretNamespace string
+	StatusSecretName      string
+
+	RefreshTokenSecretNamespace string
+	RefreshTokenSecretName      string
+
+	OutputModes []string
+	// AllowTokenInConfigMap acknowledges that OUTPUT_MODE=configmap stores
+	// the token unencrypted, readable by anyone who can read ConfigMaps.
+	AllowTokenInConfigMap bool
+	AWSSecretID           string
+
+	DistributionMode       string
+	CentralSecretNamespace string
+	ReferenceConfigMapName string
+	OutputFile             string
+	NoKube                 bool
+	SummaryFile            string
+}
+
+// configError lists every configuration problem found, so they can all be
+// fixed in one go instead of one failed start at a time.
+type configError []string
+
+func (e configError) Error() string {
+	return fmt.Sprintf("%d configuration problem(s):\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// envLoader reads settings from CONFIG_FILE, falling back to environment
+// variables, recording problems instead of failing on the first one.
+type envLoader struct {
+	problems configError
+	// file holds the settings from CONFIG_FILE, keyed by environment
+	// variable name. Settings in the file take precedence.
+	file map[string]string
+	// used records every setting read, to detect unknown keys in the file.
+	used map[string]bool
+}
+
+// get returns the setting for key, or "" if it is not set.
+func (l *envLoader) get(key string) string {
+	return l.getOr(key, "")
+}
+
+// getOr returns the setting for key, or defaultValue if it is not set at all.
+func (l *envLoader) getOr(key, defaultValue string) string {
+	if value, ok := l.lookup(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// lookup returns the setting for key and whether it is set at all.
+func (l *envLoader) lookup(key string) (string, bool) {
+	if l.used == nil {
+		l.used = make(map[string]bool)
+	}
+	l.used[key] = true
+	if value, ok := l.file[key]; ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+func (l *envLoader) addf(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+func (l *envLoader) required(key string) string {
+	value := l.get(key)
+	if value == "" {
+		l.addf("%s must be set", key)
+	}
+	return value
+}
+
+func (l *envLoader) bool(key string, defaultValue bool) bool {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		l.addf("%s must be a boolean, got '%s'", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func (l *envLoader) duration(key string, defaultValue time.Duration) time.Duration {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		l.addf("%s must be a non-negative duration (e.g. 90s, 5m), got '%s'", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func (l *envLoader) nonNegativeInt(key string, defaultValue int) int {
+	value := l.get(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		l.addf("%s must be a non-negative integer, got '%s'", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+// httpURLs reads a required comma-separated list of absolute http(s) URLs.
+func (l *envLoader) httpURLs(key string) []string {
+	value := l.required(key)
+	if value == "" {
+		return nil
+	}
+	var urls []string
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			l.addf("%s must be a comma-separated list of absolute http(s) URLs, got '%s'", key, raw)
+		}
+		urls = append(urls, raw)
+	}
+	if len(urls) == 0 {
+		l.addf("%s must contain at least one URL", key)
+	}
+	return urls
+}
+
+// Headers of the token request, overridable with OIDC_ACCEPT and
+// OIDC_CONTENT_TYPE for gateways that insist on other values.
+const (
+	defaultTokenAccept = "application/json"
+	formContentType    = "application/x-www-form-urlencoded"
+)
+
+// checkMediaTypes validates a Content-Type value or, with list set, an Accept
+// value of comma-separated media ranges.
+func checkMediaTypes(value string, list bool) error {
+	values := []string{value}
+	if list {
+		values = strings.Split(value, ",")
+	}
+	for _, v := range values {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid media type '%s': %w", strings.TrimSpace(v), err)
+		}
+		if !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid media type '%s': expected type/subtype", strings.TrimSpace(v))
+		}
+	}
+	return nil
+}
+
+// parseList splits a comma- or newline-separated list setting, trimming
+// whitespace and dropping empty entries.
+func parseList(value string) []string {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+
+	var items []string
+	for _, item := range fields {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// normalizeScopes accepts scopes separated by spaces, commas or both and
+// returns them space-separated, as OAuth 2.0 requires, without duplicates.
+func normalizeScopes(value string) string {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	scopes := make([]string, 0, len(fields))
+	for _, scope := range fields {
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// loadConfigFile reads CONFIG_FILE, a JSON or YAML object keyed by
+// environment variable name. String values are used as is; other values,
+// such as the NAMESPACE_GROUPS array, are used as their JSON encoding.
+func loadConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	jsonContent, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(jsonContent, &raw); err != nil {
+		return nil, fmt.Errorf("config file '%s' must hold an object of settings: %w", path, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			settings[key] = text
+		} else if string(value) != "null" {
+			settings[key] = string(value)
+		}
+	}
+	return settings, nil
+}
+
+// loadConfig reads the configuration from CONFIG_FILE and the environment.
+// When validate is true the run mode is forced to validate, as with the
+// --validate flag.
+func loadConfig(validate, printConfig bool) (*config, error) {
+	l := &envLoader{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := loadConfigFile(path)
+		if err != nil {
+			return nil, configError{err.Error()}
+		}
+		l.file = file
+	}
+	cfg := &config{
+		Mode:                        l.getOr("MODE", modeRun),
+		RunID:                       strings.TrimSpace(l.get("RUN_ID")),
+		PrintConfig:                 l.bool("PRINT_CONFIG", false),
+		ClientID:                    l.get("OIDC_CLIENT_ID"),
+		ClientSecret:                l.get("OIDC_CLIENT_SECRET"),
+		AuthMethod:                  l.getOr("OIDC_AUTH_METHOD", authMethodClientSecretPost),
+		Scopes:                      normalizeScopes(l.getOr("OIDC_SCOPES", defaultScopes)),
+		UserAgent:                   l.getOr("OIDC_USER_AGENT", defaultUserAgent()),
+		Accept:                      l.getOr("OIDC_ACCEPT", defaultTokenAccept),
+		ContentType:                 l.getOr("OIDC_CONTENT_TYPE", formContentType),
+		GatewayBasicUser:            l.get("OIDC_GATEWAY_BASIC_USER"),
+		GatewayBasicPassword:        l.get("OIDC_GATEWAY_BASIC_PASSWORD"),
+		WaitForIdP:                  l.bool("WAIT_FOR_IDP", false),
+		IdPWaitTimeout:              l.duration("WAIT_FOR_IDP_TIMEOUT", defaultIdPWaitTimeout),
+		LogTokenClaims:              l.bool("LOG_TOKEN_CLAIMS", false),
+		RequireBearer:               l.bool("OIDC_REQUIRE_BEARER", false),
+		DisableHTTP2:                l.bool("OIDC_DISABLE_HTTP2", false),
+		MaxIdleConnsPerHost:         l.nonNegativeInt("OIDC_MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost),
+		IdleConnTimeout:             l.duration("OIDC_IDLE_CONN_TIMEOUT", defaultIdleConnTimeout),
+		MaxResponseBytes:            l.nonNegativeInt("OIDC_MAX_RESPONSE_BYTES", defaultMaxResponseBytes),
+		SecretName:                  l.getOr("K8S_SECRET_NAME", defaultSecretName),
+		SecretKey:                   l.getOr("K8S_SECRET_KEY", defaultSecretKey),
+		SecretEncoding:              l.getOr("SECRET_ENCODING", secretEncodingRaw),
+		ClaimsKey:                   l.get("WRITE_CLAIMS_KEY"),
+		FieldManager:                l.getOr("FIELD_MANAGER", defaultFieldManager),
+		ChecksumAnnotation:          l.bool("CHECKSUM_ANNOTATION", false),
+		ClaimsAllowlist:             parseList(l.get("CLAIMS_ALLOWLIST")),
+		ClaimsGzip:                  l.bool("CLAIMS_GZIP", false),
+		ClaimsPretty:                l.bool("JSON_PRETTY", false),
+		CleanupKeys:                 parseList(l.get("CLEANUP_KEYS")),
+		VerifyAfterWrite:            l.bool("VERIFY_AFTER_WRITE", false),
+		RotationMetadata:            l.bool("ROTATION_METADATA_ANNOTATIONS", false),
+		PreflightRBAC:               l.bool("PREFLIGHT_RBAC_CHECK", false),
+		AllowImmutableRecreate:      l.bool("ALLOW_IMMUTABLE_RECREATE", false),
+		SecretImmutable:             l.bool("SECRET_IMMUTABLE", false),
+		RefreshBeforeExpiry:         l.duration("REFRESH_BEFORE_EXPIRY", 0),
+		DefaultTokenLifetime:        l.duration("DEFAULT_TOKEN_LIFETIME", 0),
+		ClockSkew:                   l.duration("CLOCK_SKEW", 0),
+		ForceRefresh:                l.bool("FORCE_REFRESH", false),
+		OnQuotaExceeded:             l.getOr("ON_QUOTA_EXCEEDED", quotaPolicyFail),
+		RunDeadline:                 l.duration("RUN_DEADLINE", 0),
+		TokenPropagationDelay:       l.duration("TOKEN_PROPAGATION_DELAY", 0),
+		SecretOpTimeout:             l.duration("K8S_SECRET_OP_TIMEOUT", k8sSecretOpTimeout),
+		SortNamespaces:              l.bool("SORT_NAMESPACES", true),
+		RequireNamespacesExist:      l.bool("REQUIRE_NAMESPACES_EXIST", false),
+		CreateMissingNamespaces:     l.bool("CREATE_MISSING_NAMESPACES", false),
+		RequireNamespaceOptIn:       l.bool("REQUIRE_NAMESPACE_OPT_IN", false),
+		OnlyUsedNamespaces:          l.bool("ONLY_USED_NAMESPACES", false),
+		RestartConsumers:            l.bool("RESTART_CONSUMERS", false),
+		NamespaceBatchSize:          l.nonNegativeInt("NAMESPACE_BATCH_SIZE", 0),
+		BatchPause:                  l.duration("BATCH_PAUSE", defaultBatchPause),
+		ProgressLogInterval:         l.nonNegativeInt("PROGRESS_LOG_INTERVAL", defaultProgressLogInterval),
+		TokenFetchConcurrency:       l.nonNegativeInt("TOKEN_FETCH_CONCURRENCY", defaultTokenFetchConcurrency),
+		StatusSecretNamespace:       l.get("STATUS_SECRET_NAMESPACE"),
+		StatusSecretName:            l.getOr("STATUS_SECRET_NAME", defaultStatusSecretName),
+		RefreshTokenSecretNamespace: l.get("REFRESH_TOKEN_SECRET_NAMESPACE"),
+		RefreshTokenSecretName:      l.getOr("REFRESH_TOKEN_SECRET_NAME", defaultRefreshTokenSecretName),
+		AWSSecretID:                 l.get("AWS_SECRET_ID"),
+		DistributionMode:            l.getOr("DISTRIBUTION_MODE", distributionCopy),
+		CentralSecretNamespace:      l.get("CENTRAL_SECRET_NAMESPACE"),
+		ReferenceConfigMapName:      l.get("REFERENCE_CONFIGMAP_NAME"),
+		OutputFile:                  l.get("OUTPUT_FILE"),
+		AllowTokenInConfigMap:       l.bool("ALLOW_TOKEN_IN_CONFIGMAP", false),
+		NoKube:                      l.bool("NO_KUBE", false),
+		SummaryFile:                 l.get("SUMMARY_FILE_PATH"),
+		Kube: kubeConnection{
+			APIServer:         l.get("K8S_API_SERVER"),
+			BearerToken:       l.get("K8S_BEARER_TOKEN"),
+			CAFile:            l.get("K8S_CA_FILE"),
+			ImpersonateUser:   strings.TrimSpace(l.get("K8S_IMPERSONATE_USER")),
+			ImpersonateGroups: parseList(l.get("K8S_IMPERSONATE_GROUPS")),
+		},
+		Namespaces: namespaceSource{
+			Single:       strings.TrimSpace(l.get("SINGLE_NAMESPACE")),
+			Targets:      l.get(TargetNamespacesEnvVar),
+			TargetsFile:  l.get("TARGET_NAMESPACES_FILE"),
+			Discover:     l.get("DISCOVER_NAMESPACES"),
+			File:         l.get("NAMESPACES_FILE"),
+			ConfigMap:    l.get("NAMESPACES_CONFIGMAP"),
+			ConfigMapKey: l.getOr("NAMESPACES_CONFIGMAP_KEY", defaultNamespacesConfigMapKey),
+
+			LabelSelector:       l.get("NAMESPACE_LABEL_SELECTOR"),
+			FieldSelector:       l.get("NAMESPACE_FIELD_SELECTOR"),
+			ToleratePartialList: l.bool("TOLERATE_PARTIAL_LIST", false),
+		},
+	}
+
+	if validate {
+		cfg.Mode = modeValidate
+	}
+	if printConfig {
+		cfg.PrintConfig = true
+	}
+	if cfg.RunID == "" {
+		cfg.RunID = uuid.NewString()
+	}
+	if cfg.Mode != modeRun && cfg.Mode != modeValidate {
+		l.addf("MODE must be %s or %s, got '%s'", modeRun, modeValidate, cfg.Mode)
+	}
+
+	var err error
+	if cfg.TLSMinVersion, err = parseTLSMinVersion(l.getOr("OIDC_TLS_MIN_VERSION", defaultTLSMinVersion)); err != nil {
+		l.addf("OIDC_TLS_MIN_VERSION: %v", err)
+	}
+	if cfg.TLSCipherSuites, err = parseCipherSuites(l.get("OIDC_TLS_CIPHER_SUITES")); err != nil {
+		l.addf("OIDC_TLS_CIPHER_SUITES: %v", err)
+	}
+
+	if tokenPath := l.getOr("OIDC_TOKEN_JSONPATH", defaultTokenJSONPath); tokenPath != defaultTokenJSONPath {
+		if cfg.TokenPath, err = parseResponsePath(tokenPath); err != nil {
+			l.addf("OIDC_TOKEN_JSONPATH: %v", err)
+		}
+	}
+	// OIDC_EXPIRES_AT_FIELD is shorthand for a top-level OIDC_EXPIRES_JSONPATH.
+	expiresPath := l.get("OIDC_EXPIRES_JSONPATH")
+	// The default field is only a guess at the IdP's response, so it must not
+	// fail a run the way one the user set does.
+	expiresAtField, ok := l.lookup("OIDC_EXPIRES_AT_FIELD")
+	if !ok {
+		expiresAtField = defaultExpiresAtField
+	}
+	if expiresPath == "" && expiresAtField != "" {
+		expiresPath = "{." + expiresAtField + "}"
+		cfg.ExpiresPathDefault = !ok
+	}
+	if expiresPath != "" {
+		if cfg.ExpiresPath, err = parseResponsePath(expiresPath); err != nil {
+			l.addf("OIDC_EXPIRES_JSONPATH: %v", err)
+		}
+	}
+
+	if path := l.get("OIDC_CREDENTIAL_HELPER"); path != "" {
+		// The helper replaces the token endpoint and client credentials.
+		cfg.CredentialHelper = &credentialHelper{
+			Path:    path,
+			Timeout: l.duration("OIDC_CREDENTIAL_HELPER_TIMEOUT", defaultCredentialHelperTimeout),
+		}
+		if cfg.CredentialHelper.Timeout == 0 {
+			l.addf("OIDC_CREDENTIAL_HELPER_TIMEOUT must be positive")
+		}
+		for _, key := range []string{"OIDC_TOKEN_URL", "OIDC_SUBJECT_TOKEN_SOURCE", "NAMESPACE_GROUPS"} {
+			if l.get(key) != "" {
+				l.addf("%s cannot be combined with OIDC_CREDENTIAL_HELPER", key)
+			}
+		}
+		if cfg.WaitForIdP {
+			l.addf("WAIT_FOR_IDP cannot be combined with OIDC_CREDENTIAL_HELPER")
+		}
+	} else {
+		cfg.TokenURLs = l.httpURLs("OIDC_TOKEN_URL")
+		if cfg.ClientID == "" {
+			l.addf("OIDC_CLIENT_ID must be set")
+		}
+	}
+
+	switch source := l.get("OIDC_SUBJECT_TOKEN_SOURCE"); source {
+	case "":
+		if cfg.ClientSecret == "" && cfg.CredentialHelper == nil {
+			l.addf("OIDC_CLIENT_SECRET must be set")
+		}
+	case subjectTokenSourceGitHubActions:
+		cfg.SubjectToken = &githubActionsIDToken{
+			RequestURL:   l.required("ACTIONS_ID_TOKEN_REQUEST_URL"),
+			RequestToken: l.required("ACTIONS_ID_TOKEN_REQUEST_TOKEN"),
+			Audience:     l.get("OIDC_SUBJECT_TOKEN_AUDIENCE"),
+		}
+		if cfg.ClientSecret == "" && cfg.AuthMethod == authMethodClientSecretJWT {
+			l.addf("OIDC_AUTH_METHOD=%s requires OIDC_CLIENT_SECRET", authMethodClientSecretJWT)
+		}
+	default:
+		l.addf("OIDC_SUBJECT_TOKEN_SOURCE must be empty or %s, got '%s'", subjectTokenSourceGitHubActions, source)
+	}
+
+	if cfg.AuthMethod != authMethodClientSecretPost && cfg.AuthMethod != authMethodClientSecretJWT {
+		l.addf("OIDC_AUTH_METHOD must be %s or %s, got '%s'", authMethodClientSecretPost, authMethodClientSecretJWT, cfg.AuthMethod)
+	}
+
+	if err := checkMediaTypes(cfg.Accept, true); err != nil {
+		l.addf("OIDC_ACCEPT: %v", err)
+	}
+	if err := checkMediaTypes(cfg.ContentType, false); err != nil {
+		l.addf("OIDC_CONTENT_TYPE: %v", err)
+	} else if mediaType, _, _ := mime.ParseMediaType(cfg.ContentType); mediaType != formContentType {
+		// Only parameters such as charset may change: the body is always a form.
+		l.addf("OIDC_CONTENT_TYPE must be %s, optionally with parameters, as the token request body is always form-encoded; got '%s'", formContentType, cfg.ContentType)
+	}
+
+	if (cfg.GatewayBasicUser == "") != (cfg.GatewayBasicPassword == "") {
+		l.addf("OIDC_GATEWAY_BASIC_USER and OIDC_GATEWAY_BASIC_PASSWORD must be set together")
+	}
+
+	if pattern := l.get("NAMESPACE_NAME_REGEX"); pattern != "" {
+		if cfg.Namespaces.NameRegex, err = regexp.Compile(pattern); err != nil {
+			l.addf("NAMESPACE_NAME_REGEX is invalid: %v", err)
+		}
+	}
+	if cfg.SecretName == "" {
+		l.addf("K8S_SECRET_NAME must not be empty")
+	}
+	if cfg.SecretKey == "" {
+		l.addf("K8S_SECRET_KEY must not be empty")
+	}
+	if template := l.get("K8S_SECRET_NAME_TEMPLATE"); template != "" {
+		if cfg.SecretNameTemplate, err = parseSecretNameTemplate(template, cfg.SecretName); err != nil {
+			l.addf("K8S_SECRET_NAME_TEMPLATE: %v", err)
+		}
+	}
+	if cfg.MetadataKeys, err = parseSecretMetadataKeys(l.get("SECRET_METADATA_KEYS")); err != nil {
+		l.addf("SECRET_METADATA_KEYS: %v", err)
+	}
+	if cfg.SecretEncoding != secretEncodingRaw && cfg.SecretEncoding != secretEncodingBase64 {
+		l.addf("SECRET_ENCODING must be %s or %s, got '%s'", secretEncodingRaw, secretEncodingBase64, cfg.SecretEncoding)
+	}
+	if cfg.SecretTemplate, err = parseSecretTemplate(l.getOr("SECRET_TEMPLATE", secretTemplateOpaque), cfg.SecretKey, l.get("K8S_SECRET_KEY") != "", l.getOr("SECRET_TEMPLATE_USERNAME", cfg.ClientID)); err != nil {
+		l.addf("SECRET_TEMPLATE: %v", err)
+	} else {
+		for _, key := range cfg.SecretTemplate.keys() {
+			if cfg.ClaimsKey == key {
+				l.addf("WRITE_CLAIMS_KEY must differ from the token secret keys (%s)", key)
+			}
+			if slices.Contains(cfg.MetadataKeys.keys(), key) {
+				l.addf("SECRET_METADATA_KEYS must not use the token secret key '%s'", key)
+			}
+		}
+		if cfg.ClaimsKey != "" && slices.Contains(cfg.MetadataKeys.keys(), cfg.ClaimsKey) {
+			l.addf("SECRET_METADATA_KEYS must not use the WRITE_CLAIMS_KEY '%s'", cfg.ClaimsKey)
+		}
+		written := append(append(cfg.SecretTemplate.keys(), cfg.ClaimsKey), cfg.MetadataKeys.keys()...)
+		for _, key := range cfg.CleanupKeys {
+			if slices.Contains(written, key) {
+				l.addf("CLEANUP_KEYS must not list '%s', which this tool writes", key)
+			}
+		}
+	}
+	if cfg.Kube.TLSMinVersion, err = parseTLSMinVersion(l.getOr("K8S_TLS_MIN_VERSION", defaultTLSMinVersion)); err != nil {
+		l.addf("K8S_TLS_MIN_VERSION: %v", err)
+	}
+	if cfg.Kube.APIServer != "" {
+		parsed, err := url.Parse(cfg.Kube.APIServer)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			l.addf("K8S_API_SERVER must be an absolute https URL, got '%s'", cfg.Kube.APIServer)
+		}
+		if cfg.Kube.BearerToken == "" {
+			l.addf("K8S_BEARER_TOKEN must be set when K8S_API_SERVER is set")
+		}
+	} else if cfg.Kube.BearerToken != "" || cfg.Kube.CAFile != "" {
+		l.addf("K8S_BEARER_TOKEN and K8S_CA_FILE require K8S_API_SERVER")
+	}
+	if err := validateImpersonation(cfg.Kube.ImpersonateUser, cfg.Kube.ImpersonateGroups); err != nil {
+		l.addf("%v", err)
+	}
+	defaultOutput := outputKubernetes
+	if cfg.NoKube {
+		// Without a cluster the token goes to OUTPUT_FILE, or else stdout.
+		defaultOutput = outputStdout
+		if cfg.OutputFile != "" {
+			defaultOutput = outputFile
+		}
+	}
+	if cfg.OutputModes, err = parseOutputModes(l.getOr("OUTPUT_MODE", defaultOutput)); err != nil {
+		l.addf("OUTPUT_MODE: %v", err)
+	} else if cfg.NoKube && clusterResource(cfg.OutputModes) != "" {
+		l.addf("NO_KUBE cannot be combined with OUTPUT_MODE=%s or %s", outputKubernetes, outputConfigMap)
+	}
+	if clusterResource(cfg.OutputModes) != "" {
+		if err := cfg.Namespaces.validate(); err != nil {
+			l.addf("%v", err)
+		}
+	}
+	if cfg.RefreshTokenSecretNamespace != "" {
+		if clusterResource(cfg.OutputModes) == "" {
+			l.addf("REFRESH_TOKEN_SECRET_NAMESPACE requires OUTPUT_MODE to include %s or %s", outputKubernetes, outputConfigMap)
+		}
+		if !requestsOfflineAccess(cfg.Scopes) {
+			l.addf("REFRESH_TOKEN_SECRET_NAMESPACE requires the %s scope in OIDC_SCOPES", offlineAccessScope)
+		}
+	}
+	if cfg.CreateMissingNamespaces {
+		// Only namespaces named explicitly may be created, never discovered ones.
+		if cfg.Namespaces.Single == "" && !cfg.Namespaces.hasTargets() {
+			l.addf("CREATE_MISSING_NAMESPACES requires SINGLE_NAMESPACE, %s or TARGET_NAMESPACES_FILE", TargetNamespacesEnvVar)
+		}
+		if cfg.RequireNamespacesExist {
+			l.addf("CREATE_MISSING_NAMESPACES cannot be combined with REQUIRE_NAMESPACES_EXIST")
+		}
+	}
+	if cfg.RequireNamespaceOptIn && cfg.SecretTemplate.Type != "" && cfg.SecretTemplate.Type != corev1.SecretTypeOpaque {
+		l.addf("REQUIRE_NAMESPACE_OPT_IN requires SECRET_TEMPLATE=%s, since the %s annotation picks the token key", secretTemplateOpaque, namespaceSecretKeyAnnotation)
+	}
+	if value := l.get("NAMESPACE_GROUPS"); value != "" {
+		if cfg.NamespaceGroups, err = parseNamespaceGroups(value); err != nil {
+			l.addf("NAMESPACE_GROUPS: %v", err)
+		}
+	}
+	if cfg.DefaultNamespaceGroup = l.get("DEFAULT_NAMESPACE_GROUP"); cfg.DefaultNamespaceGroup != "" {
+		if l.get("NAMESPACE_GROUPS") == "" {
+			l.addf("DEFAULT_NAMESPACE_GROUP requires NAMESPACE_GROUPS")
+		} else if cfg.NamespaceGroups != nil && !slices.ContainsFunc(cfg.NamespaceGroups, func(g namespaceGroup) bool { return g.Name == cfg.DefaultNamespaceGroup }) {
+			l.addf("DEFAULT_NAMESPACE_GROUP '%s' names no group in NAMESPACE_GROUPS", cfg.DefaultNamespaceGroup)
+		}
+	}
+
+	if cfg.SecretOpTimeout == 0 || cfg.SecretOpTimeout > maxSecretOpTimeout {
+		l.addf("K8S_SECRET_OP_TIMEOUT must be positive and at most %v, got %v", maxSecretOpTimeout, cfg.SecretOpTimeout)
+	}
+	if cfg.OnQuotaExceeded != quotaPolicyFail && cfg.OnQuotaExceeded != quotaPolicySkip {
+		l.addf("ON_QUOTA_EXCEEDED must be %s or %s, got '%s'", quotaPolicyFail, quotaPolicySkip, cfg.OnQuotaExceeded)
+	}
+	if cfg.NamespaceBatchSize == 0 && l.get("BATCH_PAUSE") != "" {
+		l.addf("BATCH_PAUSE requires NAMESPACE_BATCH_SIZE")
+	}
+	if cfg.MaxResponseBytes == 0 {
+		l.addf("OIDC_MAX_RESPONSE_BYTES must be at least 1")
+	}
+	if cfg.TokenFetchConcurrency == 0 {
+		l.addf("TOKEN_FETCH_CONCURRENCY must be at least 1")
+	}
+
+	if slices.Contains(cfg.OutputModes, outputAWSSecretsManager) {
+		if cfg.AWSSecretID == "" {
+			l.addf("AWS_SECRET_ID must be set with OUTPUT_MODE=%s", outputAWSSecretsManager)
+		}
+		if len(cfg.NamespaceGroups) > 0 {
+			l.addf("OUTPUT_MODE=%s cannot be combined with NAMESPACE_GROUPS", outputAWSSecretsManager)
+		}
+	}
+
+	switch cfg.DistributionMode {
+	case distributionCopy:
+		if cfg.CentralSecretNamespace != "" || cfg.ReferenceConfigMapName != "" {
+			l.addf("CENTRAL_SECRET_NAMESPACE and REFERENCE_CONFIGMAP_NAME require DISTRIBUTION_MODE=%s", distributionReference)
+		}
+	case distributionReference:
+		if cfg.CentralSecretNamespace == "" {
+			l.addf("CENTRAL_SECRET_NAMESPACE must be set with DISTRIBUTION_MODE=%s", distributionReference)
+		}
+		if cfg.ReferenceConfigMapName == "" {
+			cfg.ReferenceConfigMapName = cfg.SecretName + "-ref"
+		}
+		if len(cfg.NamespaceGroups) > 0 {
+			l.addf("DISTRIBUTION_MODE=%s cannot be combined with NAMESPACE_GROUPS", distributionReference)
+		}
+		if cfg.SecretNameTemplate != nil {
+			l.addf("DISTRIBUTION_MODE=%s cannot be combined with K8S_SECRET_NAME_TEMPLATE", distributionReference)
+		}
+		if cfg.OnlyUsedNamespaces {
+			l.addf("DISTRIBUTION_MODE=%s cannot be combined with ONLY_USED_NAMESPACES", distributionReference)
+		}
+		if cfg.RestartConsumers {
+			l.addf("DISTRIBUTION_MODE=%s cannot be combined with RESTART_CONSUMERS", distributionReference)
+		}
+	default:
+		l.addf("DISTRIBUTION_MODE must be %s or %s, got '%s'", distributionCopy, distributionReference, cfg.DistributionMode)
+	}
+
+	if slices.Contains(cfg.OutputModes, outputConfigMap) {
+		if !cfg.AllowTokenInConfigMap {
+			l.addf("OUTPUT_MODE=%s stores the token unencrypted, readable by anyone who can read ConfigMaps; set ALLOW_TOKEN_IN_CONFIGMAP=true to acknowledge this", outputConfigMap)
+		}
+		if slices.Contains(cfg.OutputModes, outputKubernetes) {
+			l.addf("OUTPUT_MODE=%s cannot be combined with OUTPUT_MODE=%s", outputConfigMap, outputKubernetes)
+		}
+		if cfg.DistributionMode == distributionReference {
+			l.addf("OUTPUT_MODE=%s cannot be combined with DISTRIBUTION_MODE=%s", outputConfigMap, distributionReference)
+		}
+		if cfg.SecretTemplate.Type != "" && cfg.SecretTemplate.Type != corev1.SecretTypeOpaque {
+			l.addf("OUTPUT_MODE=%s requires SECRET_TEMPLATE=%s", outputConfigMap, secretTemplateOpaque)
+		}
+		// These act on secrets only.
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"SECRET_IMMUTABLE", cfg.SecretImmutable},
+			{"VERIFY_AFTER_WRITE", cfg.VerifyAfterWrite},
+			{"REFRESH_BEFORE_EXPIRY", cfg.RefreshBeforeExpiry > 0},
+			{"ONLY_USED_NAMESPACES", cfg.OnlyUsedNamespaces},
+			{"RESTART_CONSUMERS", cfg.RestartConsumers},
+		} {
+			if option.set {
+				l.addf("OUTPUT_MODE=%s cannot be combined with %s", outputConfigMap, option.name)
+			}
+		}
+	}
+	if cfg.RefreshTokenSecretNamespace != "" && len(cfg.NamespaceGroups) > 0 {
+		l.addf("REFRESH_TOKEN_SECRET_NAMESPACE cannot be combined with NAMESPACE_GROUPS")
+	}
+	if slices.Contains(cfg.OutputModes, outputStdout) && len(cfg.NamespaceGroups) > 0 {
+		l.addf("OUTPUT_MODE=%s cannot be combined with NAMESPACE_GROUPS", outputStdout)
+	}
+	if slices.Contains(cfg.OutputModes, outputFile) {
+		if cfg.OutputFile == "" {
+			l.addf("OUTPUT_FILE must be set with OUTPUT_MODE=%s", outputFile)
+		}
+		if len(cfg.NamespaceGroups) > 0 {
+			l.addf("OUTPUT_MODE=%s cannot be combined with NAMESPACE_GROUPS", outputFile)
+		}
+	}
+
+	for key := range l.file {
+		if !l.used[key] {
+			l.addf("CONFIG_FILE: unknown setting '%s'", key)
+		}
+	}
+
+	if len(l.problems) > 0 {
+		return nil, l.problems
+	}
+	return cfg, nil
+}
+
+// recreatesSecrets reports whether immutable target secrets may be deleted and
+// recreated, which needs the delete verb on them.
+func (c *config) recreatesSecrets() bool {
+	return clusterResource(c.OutputModes) == "secrets" && (c.SecretImmutable || c.AllowImmutableRecreate)
+}
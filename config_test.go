@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setBaseEnv sets the minimal environment for loadConfig to succeed.
+func setBaseEnv(t *testing.T) {
+	t.Setenv("OIDC_CLIENT_ID", "client")
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_TOKEN_URL", "https://idp.example.com/token")
+	t.Setenv("SINGLE_NAMESPACE", "team-a")
+}
+
+func TestLoadConfigUserAgent(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if want := "oidc-jwt-fetcher/" + version; cfg.UserAgent != want {
+		t.Errorf("default UserAgent = %q, want %q", cfg.UserAgent, want)
+	}
+
+	t.Setenv("OIDC_USER_AGENT", "platform-team/2.0")
+	cfg, err = loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.UserAgent != "platform-team/2.0" {
+		t.Errorf("UserAgent = %q, want the OIDC_USER_AGENT override", cfg.UserAgent)
+	}
+}
+
+func TestLoadConfigTokenRequestHeaders(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Accept != defaultTokenAccept || cfg.ContentType != formContentType {
+		t.Errorf("default Accept, ContentType = %q, %q, want %q, %q", cfg.Accept, cfg.ContentType, defaultTokenAccept, formContentType)
+	}
+
+	t.Setenv("OIDC_ACCEPT", "application/json, text/plain;q=0.5")
+	t.Setenv("OIDC_CONTENT_TYPE", "application/x-www-form-urlencoded; charset=utf-8")
+	if cfg, err = loadConfig(false, false); err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Accept != "application/json, text/plain;q=0.5" || cfg.ContentType != "application/x-www-form-urlencoded; charset=utf-8" {
+		t.Errorf("Accept, ContentType = %q, %q, want the overrides", cfg.Accept, cfg.ContentType)
+	}
+
+	t.Setenv("OIDC_ACCEPT", "json")
+	t.Setenv("OIDC_CONTENT_TYPE", "form;;")
+	_, err = loadConfig(false, false)
+	for _, want := range []string{"OIDC_ACCEPT: invalid media type 'json'", "OIDC_CONTENT_TYPE: invalid media type"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig() = %v, want it to contain %q", err, want)
+		}
+	}
+
+	t.Setenv("OIDC_ACCEPT", defaultTokenAccept)
+	t.Setenv("OIDC_CONTENT_TYPE", "application/json")
+	if _, err = loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "OIDC_CONTENT_TYPE must be application/x-www-form-urlencoded") {
+		t.Errorf("loadConfig() = %v, want a non-form Content-Type rejected", err)
+	}
+}
+
+func TestLoadConfigFieldManager(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.FieldManager != "oidc-jwt-fetcher" {
+		t.Errorf("default FieldManager = %q", cfg.FieldManager)
+	}
+	t.Setenv("FIELD_MANAGER", "oidc-jwt-fetcher-staging")
+	cfg, err = loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.FieldManager != "oidc-jwt-fetcher-staging" {
+		t.Errorf("FieldManager = %q, want the FIELD_MANAGER override", cfg.FieldManager)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	setBaseEnv(t)
+	bad := map[string]string{
+		"OIDC_TOKEN_URL":          "ftp://idp.example.com/token",
+		"RUN_DEADLINE":            "soon",
+		"PREFLIGHT_RBAC_CHECK":    "maybe",
+		"TOKEN_FETCH_CONCURRENCY": "-1",
+		"MODE":                    "dry-run",
+	}
+	for key, value := range bad {
+		t.Setenv(key, value)
+	}
+
+	_, err := loadConfig(false, false)
+	var problems configError
+	if !errors.As(err, &problems) {
+		t.Fatalf("loadConfig() = %v, want a configError", err)
+	}
+	for key := range bad {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem, key) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no problem reported for %s in %q", key, err)
+		}
+	}
+}
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"space", "openid profile email", "openid profile email"},
+		{"comma", "openid,profile,email", "openid profile email"},
+		{"mixed", " openid, profile  email,", "openid profile email"},
+		{"duplicates", "openid,openid profile", "openid profile"},
+		{"empty", " , ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeScopes(tt.input); got != tt.want {
+				t.Errorf("normalizeScopes(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigScopes(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OIDC_SCOPES", "openid, offline_access,openid")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Scopes != "openid offline_access" {
+		t.Errorf("Scopes = %q, want %q", cfg.Scopes, "openid offline_access")
+	}
+}
+
+// writeConfigFile writes content to a CONFIG_FILE and points the environment
+// at it.
+func writeConfigFile(t *testing.T, name, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OIDC_CLIENT_ID", "from-env")
+	t.Setenv("OIDC_SCOPES", "openid profile")
+	t.Setenv("TARGET_NAMESPACES", "")
+	writeConfigFile(t, "config.yaml", `
+OIDC_CLIENT_ID: from-file
+OIDC_TOKEN_URL: https://idp.example.com/realms/ops/token
+SINGLE_NAMESPACE: ""
+DISCOVER_NAMESPACES: list
+K8S_SECRET_OP_TIMEOUT: 45s
+NAMESPACE_GROUPS:
+  - name: prod
+    labelSelector: env=prod
+    audience: prod-api
+  - name: dev
+    labelSelector: env=dev
+`)
+
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	// Settings in the file take precedence over the environment.
+	if cfg.ClientID != "from-file" {
+		t.Errorf("ClientID = %q, want the file's value", cfg.ClientID)
+	}
+	if !slices.Equal(cfg.TokenURLs, []string{"https://idp.example.com/realms/ops/token"}) {
+		t.Errorf("TokenURLs = %v", cfg.TokenURLs)
+	}
+	if cfg.SecretOpTimeout != 45*time.Second {
+		t.Errorf("SecretOpTimeout = %v, want 45s", cfg.SecretOpTimeout)
+	}
+	// Settings missing from the file fall back to the environment.
+	if cfg.Scopes != "openid profile" {
+		t.Errorf("Scopes = %q, want the environment's value", cfg.Scopes)
+	}
+	if len(cfg.NamespaceGroups) != 2 || cfg.NamespaceGroups[0].Name != "prod" || cfg.NamespaceGroups[0].Audience != "prod-api" {
+		t.Errorf("NamespaceGroups = %+v, want the file's groups", cfg.NamespaceGroups)
+	}
+}
+
+func TestLoadConfigFileProblems(t *testing.T) {
+	setBaseEnv(t)
+	writeConfigFile(t, "config.json", `{"OIDC_CLIENT_ID": "client", "OIDC_CLIENT_IDD": "typo"}`)
+	_, err := loadConfig(false, false)
+	if err == nil || !strings.Contains(err.Error(), "unknown setting 'OIDC_CLIENT_IDD'") {
+		t.Errorf("loadConfig() = %v, want the unknown setting reported", err)
+	}
+
+	writeConfigFile(t, "config.yaml", "- not\n- an object\n")
+	if _, err := loadConfig(false, false); err == nil {
+		t.Error("loadConfig() = nil, want a file that is not an object rejected")
+	}
+}
+
+func TestParseList(t *testing.T) {
+	got := parseList(" access-token,\nlegacy-token , ,id-token\n")
+	if want := []string{"access-token", "legacy-token", "id-token"}; !slices.Equal(got, want) {
+		t.Errorf("parseList() = %q, want %q", got, want)
+	}
+	if got := parseList(""); got != nil {
+		t.Errorf("parseList(\"\") = %q, want nil", got)
+	}
+}
+
+func TestLoadConfigCleanupKeys(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("CLEANUP_KEYS", "access-token, legacy-token")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !slices.Equal(cfg.CleanupKeys, []string{"access-token", "legacy-token"}) {
+		t.Errorf("CleanupKeys = %q", cfg.CleanupKeys)
+	}
+
+	t.Setenv("CLEANUP_KEYS", "access-token,token")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "CLEANUP_KEYS must not list 'token'") {
+		t.Errorf("loadConfig() = %v, want the written key refused", err)
+	}
+}
+
+func TestLoadConfigReferenceMode(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("K8S_SECRET_NAME", "oidc-token")
+	t.Setenv("DISTRIBUTION_MODE", "reference")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "CENTRAL_SECRET_NAMESPACE must be set") {
+		t.Fatalf("loadConfig() without CENTRAL_SECRET_NAMESPACE = %v", err)
+	}
+
+	t.Setenv("CENTRAL_SECRET_NAMESPACE", "oidc-central")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.ReferenceConfigMapName != "oidc-token-ref" {
+		t.Errorf("ReferenceConfigMapName = %q, want the secret name with a -ref suffix", cfg.ReferenceConfigMapName)
+	}
+
+	t.Setenv("RESTART_CONSUMERS", "true")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "RESTART_CONSUMERS") {
+		t.Errorf("loadConfig() with RESTART_CONSUMERS = %v, want it rejected", err)
+	}
+}
+
+func TestLoadConfigNoKube(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("SINGLE_NAMESPACE", "")
+	t.Setenv("NO_KUBE", "true")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !slices.Equal(cfg.OutputModes, []string{outputStdout}) {
+		t.Errorf("OutputModes = %v, want stdout without OUTPUT_FILE", cfg.OutputModes)
+	}
+
+	t.Setenv("OUTPUT_FILE", filepath.Join(t.TempDir(), "token"))
+	if cfg, err = loadConfig(false, false); err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !slices.Equal(cfg.OutputModes, []string{outputFile}) {
+		t.Errorf("OutputModes = %v, want file with OUTPUT_FILE", cfg.OutputModes)
+	}
+
+	t.Setenv("OUTPUT_MODE", outputKubernetes)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "NO_KUBE cannot be combined") {
+		t.Errorf("loadConfig() with OUTPUT_MODE=kubernetes = %v, want it rejected", err)
+	}
+}
+
+func TestLoadConfigSecretImmutable(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("SECRET_IMMUTABLE", "true")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !cfg.SecretImmutable || !cfg.recreatesSecrets() {
+		t.Errorf("SecretImmutable = %v, recreatesSecrets() = %v, want both set so RBAC checks cover delete", cfg.SecretImmutable, cfg.recreatesSecrets())
+	}
+}
+
+func TestLoadConfigExpiresAtFieldDefault(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.ExpiresPath == nil || !cfg.ExpiresPathDefault {
+		t.Errorf("ExpiresPath = %v, ExpiresPathDefault = %v, want the default expires_at field", cfg.ExpiresPath, cfg.ExpiresPathDefault)
+	}
+
+	t.Setenv("OIDC_EXPIRES_AT_FIELD", "expires_at")
+	if cfg, err = loadConfig(false, false); err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.ExpiresPath == nil || cfg.ExpiresPathDefault {
+		t.Errorf("ExpiresPath = %v, ExpiresPathDefault = %v, want an explicit OIDC_EXPIRES_AT_FIELD required", cfg.ExpiresPath, cfg.ExpiresPathDefault)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// createOrUpdateTokenConfigMap writes the token ConfigMap for
+// OUTPUT_MODE=configmap, re-reading and retrying it when it was modified
+// concurrently, like createOrUpdateSecret.
+func createOrUpdateTokenConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, spec secretSpec) (secretOperation, error) {
+	var operation secretOperation
+	policy := secretConflictPolicy
+	policy.Name = fmt.Sprintf("write of configmap '%s' in namespace '%s'", spec.Name, namespace)
+	err := retryWithBackoff(ctx, policy, func() (err error) {
+		operation, err = writeTokenConfigMap(ctx, clientset, namespace, spec)
+		return err
+	})
+	return operation, err
+}
+
+// writeTokenConfigMap mirrors writeSecret for a ConfigMap: it creates the
+// ConfigMap with spec.Data and the managed annotations, or merge-patches
+// them into an existing one, guarded by its resourceVersion. Keys this tool
+// does not write are kept. Values that are not valid UTF-8, such as
+// compressed claims, go to binaryData.
+func writeTokenConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, spec secretSpec) (secretOperation, error) {
+	configMapClient := clientset.CoreV1().ConfigMaps(namespace)
+	data, binaryData := splitConfigMapData(spec.Data)
+
+	var existing *corev1.ConfigMap
+	err := retryKubeCall(ctx, "configmap get", func() (err error) {
+		existing, err = configMapClient.Get(ctx, spec.Name, metav1.GetOptions{})
+		return err
+	})
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        spec.Name,
+				Namespace:   namespace,
+				Annotations: applyAnnotations(nil, spec.annotations()),
+			},
+			Data:       data,
+			BinaryData: binaryData,
+		}
+		err := retryKubeCall(ctx, "configmap create", func() error {
+			_, err := configMapClient.Create(ctx, configMap, metav1.CreateOptions{FieldManager: spec.FieldManager})
+			return err
+		})
+		if err != nil {
+			return "", referenceWriteError("create", namespace, spec.Name, err)
+		}
+		return secretCreated, nil
+	case err != nil:
+		return "", referenceWriteError("get", namespace, spec.Name, err)
+	}
+
+	if existing.Immutable != nil && *existing.Immutable {
+		return "", fmt.Errorf("%w: configmap '%s' in namespace '%s' is immutable and cannot be updated", errImmutableSecret, spec.Name, namespace)
+	}
+
+	// A null value removes the key in a JSON merge patch. A key that moves
+	// between data and binaryData is removed from the one it leaves.
+	patchData := make(map[string]interface{}, len(data))
+	patchBinaryData := make(map[string]interface{}, len(binaryData))
+	for _, key := range spec.CleanupKeys {
+		if _, ok := existing.Data[key]; ok {
+			patchData[key] = nil
+		}
+		if _, ok := existing.BinaryData[key]; ok {
+			patchBinaryData[key] = nil
+		}
+	}
+	for key, value := range data {
+		patchData[key] = value
+		if _, ok := existing.BinaryData[key]; ok {
+			patchBinaryData[key] = nil
+		}
+	}
+	for key, value := range binaryData {
+		patchBinaryData[key] = base64.StdEncoding.EncodeToString(value)
+		if _, ok := existing.Data[key]; ok {
+			patchData[key] = nil
+		}
+	}
+	patchBytes, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": existing.ResourceVersion,
+			"annotations":     spec.annotations(),
+		},
+		"data":       patchData,
+		"binaryData": patchBinaryData,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal patch payload for configmap '%s' in namespace '%s': %w", spec.Name, namespace, err)
+	}
+	err = retryKubeCall(ctx, "configmap patch", func() error {
+		_, err := configMapClient.Patch(ctx, spec.Name, types.MergePatchType, patchBytes, metav1.PatchOptions{FieldManager: spec.FieldManager})
+		return err
+	})
+	if err != nil {
+		return "", referenceWriteError("patch", namespace, spec.Name, err)
+	}
+
+	if configMapDataContains(existing, spec.Data) {
+		return secretRewritten, nil
+	}
+	return secretUpdated, nil
+}
+
+// splitConfigMapData sorts secret data into ConfigMap data and binaryData.
+func splitConfigMapData(values map[string][]byte) (map[string]string, map[string][]byte) {
+	data := make(map[string]string, len(values))
+	var binaryData map[string][]byte
+	for key, value := range values {
+		if utf8.Valid(value) {
+			data[key] = string(value)
+			continue
+		}
+		if binaryData == nil {
+			binaryData = make(map[string][]byte)
+		}
+		binaryData[key] = value
+	}
+	return data, binaryData
+}
+
+func configMapDataContains(configMap *corev1.ConfigMap, want map[string][]byte) bool {
+	for key, value := range want {
+		if existing, ok := configMap.Data[key]; ok && existing == string(value) {
+			continue
+		}
+		if existing, ok := configMap.BinaryData[key]; ok && bytes.Equal(existing, value) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateTokenConfigMap(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.Data["claims.gz"] = []byte{0x1f, 0x8b, 0xff}
+
+	operation, err := createOrUpdateTokenConfigMap(context.Background(), clientset, "team-a", spec)
+	if err != nil || operation != secretCreated {
+		t.Fatalf("createOrUpdateTokenConfigMap() = %q, %v, want %q", operation, err, secretCreated)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("configmap not created: %v", err)
+	}
+	if configMap.Data["token"] != "header.payload.signature" {
+		t.Errorf("token = %q", configMap.Data["token"])
+	}
+	if _, ok := configMap.Data["claims.gz"]; ok || len(configMap.BinaryData["claims.gz"]) != 3 {
+		t.Errorf("binary value not stored under binaryData: data %v, binaryData %v", configMap.Data, configMap.BinaryData)
+	}
+	secrets, _ := clientset.CoreV1().Secrets("team-a").List(context.Background(), metav1.ListOptions{})
+	if len(secrets.Items) != 0 {
+		t.Errorf("OUTPUT_MODE=configmap also wrote %d secrets", len(secrets.Items))
+	}
+}
+
+func TestUpdateTokenConfigMap(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a", ResourceVersion: "1"},
+		Data:       map[string]string{"token": "old-token", "owner": "platform", "stale": "x"},
+	})
+	spec := testSpec()
+	spec.CleanupKeys = []string{"stale"}
+
+	operation, err := createOrUpdateTokenConfigMap(ctx, clientset, "team-a", spec)
+	if err != nil || operation != secretUpdated {
+		t.Fatalf("createOrUpdateTokenConfigMap() = %q, %v, want %q", operation, err, secretUpdated)
+	}
+	configMap, _ := clientset.CoreV1().ConfigMaps("team-a").Get(ctx, "oidc-token", metav1.GetOptions{})
+	if configMap.Data["token"] != "header.payload.signature" {
+		t.Errorf("token = %q, want the new token", configMap.Data["token"])
+	}
+	if configMap.Data["owner"] != "platform" {
+		t.Errorf("unrelated key was dropped: %v", configMap.Data)
+	}
+	if _, ok := configMap.Data["stale"]; ok {
+		t.Errorf("CLEANUP_KEYS key was kept: %v", configMap.Data)
+	}
+
+	operation, err = createOrUpdateTokenConfigMap(ctx, clientset, "team-a", spec)
+	if err != nil || operation != secretRewritten {
+		t.Errorf("second createOrUpdateTokenConfigMap() = %q, %v, want %q", operation, err, secretRewritten)
+	}
+}
+
+func TestProcessNamespacesIntoConfigMaps(t *testing.T) {
+	captureLog(t)
+	namespaces := testNamespaces(2)
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.ConfigMap = true
+
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	if summary.Created != len(namespaces) {
+		t.Errorf("Created = %d, want %d", summary.Created, len(namespaces))
+	}
+	for _, ns := range namespaces {
+		if _, err := clientset.CoreV1().ConfigMaps(ns).Get(context.Background(), "oidc-token", metav1.GetOptions{}); err != nil {
+			t.Errorf("%s: token configmap missing: %v", ns, err)
+		}
+	}
+}
+
+func TestLoadConfigConfigMapRequiresAcknowledgment(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OUTPUT_MODE", outputConfigMap)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "ALLOW_TOKEN_IN_CONFIGMAP=true") {
+		t.Errorf("loadConfig() = %v, want the acknowledgment required", err)
+	}
+
+	t.Setenv("ALLOW_TOKEN_IN_CONFIGMAP", "true")
+	if _, err := loadConfig(false, false); err != nil {
+		t.Errorf("loadConfig() with ALLOW_TOKEN_IN_CONFIGMAP = %v", err)
+	}
+
+	t.Setenv("OUTPUT_MODE", outputConfigMap+","+outputKubernetes)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "cannot be combined with OUTPUT_MODE=kubernetes") {
+		t.Errorf("loadConfig() = %v, want configmap and kubernetes outputs rejected together", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCredentialHelperTimeout = 30 * time.Second
+	// maxHelperStderr bounds how much of a failed helper's stderr is quoted
+	// in the error.
+	maxHelperStderr = 1024
+)
+
+// credentialHelper obtains the token by running an external command, in the
+// manner of git and docker credential helpers. The command must print a
+// token response as JSON on stdout, in the same shape as a token endpoint's
+// (access_token, and optionally token_type, expires_in or an absolute
+// expiry); OIDC_TOKEN_JSONPATH and OIDC_EXPIRES_JSONPATH apply to it.
+type credentialHelper struct {
+	Path    string
+	Timeout time.Duration
+}
+
+// fetch runs the helper with a clean environment, so it never inherits the
+// client secret or other credentials passed to this tool. Only PATH, HOME
+// and RUN_ID are passed through.
+func (h *credentialHelper) fetch(ctx context.Context, tokenReq tokenRequest) (*OIDCTokenResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Path)
+	cmd.Env = []string{"RUN_ID=" + tokenReq.RunID}
+	for _, key := range []string{"PATH", "HOME"} {
+		if value, ok := os.LookupEnv(key); ok {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait indefinitely on children that keep the output pipes open.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("credential helper %s timed out after %v", h.Path, h.Timeout)
+		}
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > maxHelperStderr {
+			message = message[:maxHelperStderr] + "..."
+		}
+		if message != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %w: %s", h.Path, err, message)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w", h.Path, err)
+	}
+	if stdout.Len() > tokenReq.MaxResponseBytes {
+		return nil, fmt.Errorf("credential helper %s output exceeds %d bytes (OIDC_MAX_RESPONSE_BYTES)", h.Path, tokenReq.MaxResponseBytes)
+	}
+
+	tokenResponse, err := decodeTokenResponse(stdout.Bytes(), tokenReq, tokenReq.now())
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s: %w", h.Path, err)
+	}
+	return tokenResponse, nil
+}
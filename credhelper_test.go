@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHelper writes an executable shell script and returns its path.
+func writeHelper(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "helper")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialHelperToken(t *testing.T) {
+	t.Setenv("OIDC_CLIENT_SECRET", "must-not-leak")
+	// The helper reports its environment in the token, so the test can see
+	// what it was given.
+	helper := writeHelper(t, `printf '{"access_token":"%s|%s","expires_in":300}' "$RUN_ID" "$OIDC_CLIENT_SECRET"`)
+	tokenReq := testTokenRequest("")
+	tokenReq.RunID = "run-42"
+	tokenReq.CredentialHelper = &credentialHelper{Path: helper, Timeout: 10 * time.Second}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tokenReq.Clock = &fakeClock{now: now}
+
+	response, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq)
+	if err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	if response.AccessToken != "run-42|" {
+		t.Errorf("helper saw RUN_ID and OIDC_CLIENT_SECRET as %q, want only the run ID", response.AccessToken)
+	}
+	if want := now.Add(300 * time.Second); !response.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v from the clock and the helper's expires_in", response.ExpiresAt, want)
+	}
+}
+
+func TestCredentialHelperFailures(t *testing.T) {
+	tests := []struct {
+		name, script string
+		timeout      time.Duration
+		want         string
+	}{
+		{"exit status", "echo 'no session, run login first' >&2; exit 3", 10 * time.Second, "exit status 3: no session, run login first"},
+		{"no token", `echo '{"token_type":"Bearer"}'`, 10 * time.Second, "access token not found"},
+		{"not json", "echo hello", 10 * time.Second, "failed to decode token response"},
+		{"timeout", "sleep 10", 100 * time.Millisecond, "timed out after 100ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := &credentialHelper{Path: writeHelper(t, tt.script), Timeout: tt.timeout}
+			_, err := helper.fetch(context.Background(), testTokenRequest(""))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("fetch() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialHelperOutputLimit(t *testing.T) {
+	helper := &credentialHelper{Path: writeHelper(t, `printf '{"access_token":"%0200d"}' 0`), Timeout: 10 * time.Second}
+	tokenReq := testTokenRequest("")
+	tokenReq.MaxResponseBytes = 100
+	_, err := helper.fetch(context.Background(), tokenReq)
+	if err == nil || !strings.Contains(err.Error(), "exceeds 100 bytes") {
+		t.Errorf("fetch() = %v, want the output limit enforced", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenFetchError reports a failed token request against one endpoint.
+type TokenFetchError struct {
+	URL string
+	// StatusCode is the HTTP status returned, or 0 if no response was received.
+	StatusCode int
+	// RetryAfter is the delay the server asked for in a Retry-After header,
+	// or 0 if it gave none.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *TokenFetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TokenFetchError) Unwrap() error {
+	return e.Err
+}
+
+// errInvalidClient reports that the token endpoint rejected the client
+// credentials. Retrying or failing over cannot help, so it is never retried.
+var errInvalidClient = errors.New("the token endpoint rejected the client credentials")
+
+// oauthErrorResponse is the error body of a token endpoint (RFC 6749
+// section 5.2).
+type oauthErrorResponse struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// parseOAuthError decodes an error body. Bodies that are not OAuth errors,
+// such as HTML from a proxy, yield an empty response.
+func parseOAuthError(body []byte) oauthErrorResponse {
+	var response oauthErrorResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return oauthErrorResponse{}
+	}
+	return response
+}
+
+// detail renders the error code and description for an error message.
+func (r oauthErrorResponse) detail() string {
+	switch {
+	case r.Code == "":
+		return ""
+	case r.Description == "":
+		return fmt.Sprintf(", error: %s", r.Code)
+	default:
+		return fmt.Sprintf(", error: %s: %s", r.Code, r.Description)
+	}
+}
+
+// DistributionError reports a failure to write the token secret into one
+// namespace.
+type DistributionError struct {
+	Namespace string
+	Err       error
+}
+
+func (e *DistributionError) Error() string {
+	return fmt.Sprintf("namespace '%s': %v", e.Namespace, e.Err)
+}
+
+func (e *DistributionError) Unwrap() error {
+	return e.Err
+}
+
+// SecretTooLargeError reports secret data over the API server's size limit,
+// caught before writing, as the API server's own rejection does not say which
+// keys are to blame.
+type SecretTooLargeError struct {
+	Namespace string
+	Name      string
+	// Size is the total size of the data values in bytes, as the API server
+	// counts it, and Limit the most it accepts.
+	Size  int
+	Limit int
+	// Keys lists every data key with its size, largest first.
+	Keys []secretKeySize
+}
+
+type secretKeySize struct {
+	Key  string
+	Size int
+}
+
+func (e *SecretTooLargeError) Error() string {
+	sizes := make([]string, 0, len(e.Keys))
+	for _, key := range e.Keys {
+		sizes = append(sizes, fmt.Sprintf("%s=%d", key.Key, key.Size))
+	}
+	return fmt.Sprintf("secret '%s' in namespace '%s' would hold %d bytes of data, over the limit of %d bytes (key sizes in bytes: %s); consider CLAIMS_ALLOWLIST or CLAIMS_GZIP to shrink the claims", e.Name, e.Namespace, e.Size, e.Limit, strings.Join(sizes, ", "))
+}
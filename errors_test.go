@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestFetchOIDCTokenReturnsTokenFetchError(t *testing.T) {
+	saved := tokenRetryPolicy
+	tokenRetryPolicy.BaseDelay, tokenRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { tokenRetryPolicy = saved })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer other.Close()
+
+	for name, urls := range map[string][]string{
+		"single endpoint": {server.URL},
+		"failover":        {server.URL, other.URL},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tokenReq := testTokenRequest(urls[0])
+			tokenReq.URLs = urls
+			_, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq)
+			var fetchErr *TokenFetchError
+			if !errors.As(err, &fetchErr) {
+				t.Fatalf("error = %v, want a TokenFetchError", err)
+			}
+			if fetchErr.URL != server.URL || fetchErr.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("TokenFetchError = {URL: %s, StatusCode: %d}, want the first endpoint's 503", fetchErr.URL, fetchErr.StatusCode)
+			}
+			var distErr *DistributionError
+			if errors.As(err, &distErr) {
+				t.Errorf("error = %v, want no DistributionError", err)
+			}
+		})
+	}
+}
+
+func TestDistributionErrorIsNotTokenFetchError(t *testing.T) {
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "oidc-token", errors.New("denied"))
+	err := fmt.Errorf("distribution failed: %w", errors.Join(
+		&DistributionError{Namespace: "team-a", Err: forbidden},
+		errors.New("unrelated"),
+	))
+
+	var distErr *DistributionError
+	if !errors.As(err, &distErr) || distErr.Namespace != "team-a" {
+		t.Fatalf("error = %v, want a DistributionError for team-a", err)
+	}
+	if !apierrors.IsForbidden(distErr.Err) || !errors.Is(err, forbidden) {
+		t.Errorf("DistributionError does not unwrap to the API error")
+	}
+	var fetchErr *TokenFetchError
+	if errors.As(err, &fetchErr) {
+		t.Errorf("error = %v, want no TokenFetchError", err)
+	}
+}
+
+func TestParseOAuthError(t *testing.T) {
+	tests := map[string]string{
+		`{"error":"invalid_client","error_description":"Client authentication failed"}`: ", error: invalid_client: Client authentication failed",
+		`{"error":"invalid_client"}`:       ", error: invalid_client",
+		`<html>Bad Gateway</html>`:         "",
+		`{"message":"not an oauth error"}`: "",
+	}
+	for body, want := range tests {
+		if got := parseOAuthError([]byte(body)).detail(); got != want {
+			t.Errorf("parseOAuthError(%s).detail() = %q, want %q", body, got, want)
+		}
+	}
+}
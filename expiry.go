@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const defaultExpiresAtField = "expires_at"
+
+// clock tells the current time. It is passed from main to everything that
+// compares times, so tests can pin the time with a fake.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of this host.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// tokenExpiry determines when a token expires. An absolute expiry found at
+// expiresPath in the response document (RFC3339 string or Unix seconds)
+// takes precedence over the relative expires_in. The zero time means the
+// expiry is unknown.
+func tokenExpiry(document interface{}, expiresPath *responsePath, expiresIn int, now time.Time) (time.Time, error) {
+	if expiresPath != nil {
+		value, ok, err := expiresPath.find(document)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ok {
+			expiresAt, err := parseExpiresAt(value)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid '%s' in token response: %w", expiresPath, err)
+			}
+			return expiresAt, nil
+		}
+	}
+
+	if expiresIn > 0 {
+		return now.Add(time.Duration(expiresIn) * time.Second), nil
+	}
+	return time.Time{}, nil
+}
+
+func parseExpiresAt(value json.RawMessage) (time.Time, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		if seconds, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+		return time.Parse(time.RFC3339, text)
+	}
+
+	var seconds int64
+	if err := json.Unmarshal(value, &seconds); err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC3339 timestamp or Unix seconds, got %s", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// expiresAtAnnotation records on each target secret when the token it holds
+// expires, so later runs can leave secrets alone that are not yet due.
+const expiresAtAnnotation = "oidc.token/expires-at"
+
+// resolveTokenExpiry returns expiresAt, the expiry stated in the token
+// response, if known. Otherwise it falls back to the token's exp claim and
+// then, for opaque tokens, to defaultLifetime from now, logging that
+// assumption. Zero means the expiry stays unknown.
+func resolveTokenExpiry(expiresAt time.Time, token *parsedToken, defaultLifetime time.Duration, now time.Time) time.Time {
+	if !expiresAt.IsZero() {
+		return expiresAt
+	}
+	if exp, ok := token.Expiry(); ok {
+		return exp
+	}
+	if defaultLifetime > 0 {
+		log.Printf("Token response does not state an expiry and the token has no exp claim. Assuming DEFAULT_TOKEN_LIFETIME of %v.", defaultLifetime)
+		return now.Add(defaultLifetime)
+	}
+	return time.Time{}
+}
+
+// refreshWindow returns how close to its expiry a secret's token must be for
+// the secret to be rewritten: refreshBefore, or 0, rewriting every secret,
+// when force is set.
+func refreshWindow(refreshBefore time.Duration, force bool) time.Duration {
+	if force && refreshBefore > 0 {
+		log.Printf("FORCE_REFRESH is set: ignoring REFRESH_BEFORE_EXPIRY and refreshing every secret.")
+		return 0
+	}
+	if refreshBefore > 0 {
+		log.Printf("REFRESH_BEFORE_EXPIRY is set: only secrets whose token expires within %v are refreshed.", refreshBefore)
+	}
+	return refreshBefore
+}
+
+// secretIsFresh reports whether secret already holds every key in data and
+// the expiry recorded on it is more than refreshBefore away from now. Up to
+// clockSkew of disagreement between clocks is assumed, so secrets are
+// refreshed that much earlier.
+func secretIsFresh(secret *corev1.Secret, data map[string][]byte, refreshBefore, clockSkew time.Duration, now time.Time) bool {
+	for key := range data {
+		if _, ok := secret.Data[key]; !ok {
+			return false
+		}
+	}
+	value, ok := secret.Annotations[expiresAtAnnotation]
+	if !ok {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return false
+	}
+	return expiresAt.Sub(now) > refreshBefore+clockSkew
+}
+
+// checkTokenExpiry rejects a token that is already expired at now, allowing
+// for clockSkew between this host and the IdP. An unknown expiry passes.
+func checkTokenExpiry(expiresAt, now time.Time, clockSkew time.Duration) error {
+	if expiresAt.IsZero() || now.Before(expiresAt.Add(clockSkew)) {
+		return nil
+	}
+	return fmt.Errorf("token expired at %s, %v ago; check the clocks of this host and the IdP, or raise CLOCK_SKEW", expiresAt.UTC().Format(time.RFC3339), now.Sub(expiresAt).Round(time.Second))
+}
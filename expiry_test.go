@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDecodeTokenResponseExpiry(t *testing.T) {
+	now := time.Date(2026, 5, 1, 8, 0, 0, 0, time.UTC)
+	expiresAtPath, err := parseResponsePath("$.expires_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		path *responsePath
+		want time.Time
+	}{
+		{"expires_in", `{"access_token":"t","expires_in":3600}`, nil, now.Add(time.Hour)},
+		{"expires_at RFC3339", `{"access_token":"t","expires_at":"2026-05-01T10:30:00Z","expires_in":60}`, expiresAtPath, time.Date(2026, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"expires_at Unix seconds", `{"access_token":"t","expires_at":1777629600}`, expiresAtPath, time.Unix(1777629600, 0)},
+		{"expires_at missing falls back to expires_in", `{"access_token":"t","expires_in":60}`, expiresAtPath, now.Add(time.Minute)},
+		{"no expiry", `{"access_token":"t"}`, expiresAtPath, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := decodeTokenResponse([]byte(tt.body), tokenRequest{ExpiresPath: tt.path}, now)
+			if err != nil {
+				t.Fatalf("decodeTokenResponse() = %v", err)
+			}
+			if !response.ExpiresAt.Equal(tt.want) {
+				t.Errorf("ExpiresAt = %v, want %v", response.ExpiresAt, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTokenResponseInvalidExpiresAt(t *testing.T) {
+	path, err := parseResponsePath("$.expires_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeTokenResponse([]byte(`{"access_token":"t","expires_at":"tomorrow"}`), tokenRequest{ExpiresPath: path}, time.Now()); err == nil {
+		t.Error("decodeTokenResponse() = nil, want an invalid expires_at rejected")
+	}
+
+	// Only the default field, not one the user set, falls back to expires_in.
+	captureLog(t)
+	now := time.Now()
+	response, err := decodeTokenResponse([]byte(`{"access_token":"t","expires_at":"tomorrow","expires_in":60}`), tokenRequest{ExpiresPath: path, ExpiresPathDefault: true}, now)
+	if err != nil {
+		t.Fatalf("decodeTokenResponse() = %v, want the default expires_at ignored", err)
+	}
+	if want := now.Add(time.Minute); !response.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v from expires_in", response.ExpiresAt, want)
+	}
+}
+
+func TestForceRefreshIgnoresFreshSecret(t *testing.T) {
+	captureLog(t)
+	expiresAt := time.Now().Add(2 * time.Hour)
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "oidc-token",
+			Namespace:   "team-a",
+			Annotations: map[string]string{expiresAtAnnotation: expiresAt.UTC().Format(time.RFC3339)},
+		},
+		Data: map[string][]byte{"token": []byte("possibly-leaked")},
+	})
+
+	for _, force := range []bool{false, true} {
+		spec := testSpec()
+		spec.ExpiresAt = time.Now().Add(3 * time.Hour)
+		spec.RefreshBefore = refreshWindow(30*time.Minute, force)
+		operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+		if err != nil {
+			t.Fatalf("createOrUpdateSecret() = %v", err)
+		}
+		want := secretFresh
+		if force {
+			want = secretUpdated
+		}
+		if operation != want {
+			t.Errorf("FORCE_REFRESH=%v: operation = %s, want %s", force, operation, want)
+		}
+	}
+	if got := secretToken(t, clientset); got != "header.payload.signature" {
+		t.Errorf("token = %q, want it replaced under FORCE_REFRESH", got)
+	}
+}
+
+func TestRefreshWindow(t *testing.T) {
+	captureLog(t)
+	for _, tt := range []struct {
+		refreshBefore time.Duration
+		force         bool
+		want          time.Duration
+	}{
+		{30 * time.Minute, false, 30 * time.Minute},
+		{30 * time.Minute, true, 0},
+		{0, true, 0},
+		{0, false, 0},
+	} {
+		if got := refreshWindow(tt.refreshBefore, tt.force); got != tt.want {
+			t.Errorf("refreshWindow(%v, %v) = %v, want %v", tt.refreshBefore, tt.force, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTokenExpiry(t *testing.T) {
+	now := time.Date(2026, 5, 1, 8, 0, 0, 0, time.UTC)
+	stated := now.Add(10 * time.Minute)
+	jwt := parseToken(testJWT(t, map[string]interface{}{"exp": now.Add(time.Hour).Unix()}))
+	opaque := parseToken("2YotnFZFEjr1zCsicMWpAA")
+
+	tests := []struct {
+		name            string
+		expiresAt       time.Time
+		token           *parsedToken
+		defaultLifetime time.Duration
+		want            time.Time
+	}{
+		{"stated in the response", stated, opaque, 30 * time.Minute, stated},
+		{"exp claim", time.Time{}, jwt, 30 * time.Minute, now.Add(time.Hour)},
+		{"default lifetime for an opaque token", time.Time{}, opaque, 30 * time.Minute, now.Add(30 * time.Minute)},
+		{"unknown", time.Time{}, opaque, 0, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			got := resolveTokenExpiry(tt.expiresAt, tt.token, tt.defaultLifetime, now)
+			if !got.Equal(tt.want) {
+				t.Errorf("resolveTokenExpiry() = %v, want %v", got, tt.want)
+			}
+			assumed := strings.Contains(logs.String(), "Assuming DEFAULT_TOKEN_LIFETIME")
+			if wantAssumed := tt.name == "default lifetime for an opaque token"; assumed != wantAssumed {
+				t.Errorf("logged the assumption: %v, want %v (%q)", assumed, wantAssumed, logs)
+			}
+		})
+	}
+}
+
+// fakeClock is a clock stopped at now.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestSecretRefreshBoundary(t *testing.T) {
+	captureLog(t)
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	// A secret is fresh while its token expires more than RefreshBefore
+	// plus ClockSkew from now.
+	boundary := expiresAt.Add(-10*time.Minute - time.Minute)
+	tests := map[string]struct {
+		now  time.Time
+		want secretOperation
+	}{
+		"before the window": {boundary.Add(-time.Second), secretFresh},
+		"at the window":     {boundary, secretUpdated},
+		"inside the window": {boundary.Add(time.Second), secretUpdated},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "oidc-token",
+					Namespace:   "team-a",
+					Annotations: map[string]string{expiresAtAnnotation: expiresAt.Format(time.RFC3339)},
+				},
+				Data: map[string][]byte{"token": []byte("old")},
+			})
+			spec := testSpec()
+			spec.ExpiresAt = expiresAt.Add(time.Hour)
+			spec.RefreshBefore = 10 * time.Minute
+			spec.ClockSkew = time.Minute
+			spec.Clock = &fakeClock{now: tt.now}
+
+			operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+			if err != nil {
+				t.Fatalf("createOrUpdateSecret() = %v", err)
+			}
+			if operation != tt.want {
+				t.Errorf("operation = %s, want %s", operation, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTokenExpiryBoundary(t *testing.T) {
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{}
+	tests := []struct {
+		now     time.Time
+		skew    time.Duration
+		wantErr bool
+	}{
+		{expiresAt.Add(-time.Nanosecond), 0, false},
+		{expiresAt, 0, true},
+		{expiresAt.Add(30 * time.Second), time.Minute, false},
+		{expiresAt.Add(time.Minute - time.Nanosecond), time.Minute, false},
+		{expiresAt.Add(time.Minute), time.Minute, true},
+	}
+	for _, tt := range tests {
+		clock.now = tt.now
+		err := checkTokenExpiry(expiresAt, clock.Now(), tt.skew)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkTokenExpiry(now=%v, skew=%v) = %v, want error %v", tt.now.Sub(expiresAt), tt.skew, err, tt.wantErr)
+		}
+	}
+	if err := checkTokenExpiry(time.Time{}, clock.Now(), 0); err != nil {
+		t.Errorf("checkTokenExpiry() with an unknown expiry = %v", err)
+	}
+}
+
+func TestFetchOIDCTokenExpiryFromClock(t *testing.T) {
+	server := newFakeTokenServer(t, testTokenBody)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tokenReq := testTokenRequest(server.URL)
+	tokenReq.Clock = &fakeClock{now: now}
+
+	response, err := fetchOIDCToken(context.Background(), server.Client(), tokenReq)
+	if err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	if want := now.Add(time.Hour); !response.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v from the clock plus expires_in", response.ExpiresAt, want)
+	}
+	if err := checkTokenExpiry(response.ExpiresAt, now.Add(time.Hour), 0); err == nil {
+		t.Error("token still valid once the clock reaches expires_in")
+	}
+}
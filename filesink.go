@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fileSink writes the token to a local file, e.g. on a volume shared with
+// pods that read a file rather than a mounted secret.
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Name() string {
+	return fmt.Sprintf("file '%s'", s.path)
+}
+
+// Write replaces the file atomically: the token is written to a temporary
+// file in the same directory, readable only by the owner, and renamed over
+// the target, so readers never see a partial token.
+func (s *fileSink) Write(ctx context.Context, accessToken string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.WriteString(accessToken); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace '%s': %w", s.path, err)
+	}
+	return nil
+}
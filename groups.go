@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// defaultGroupName names the implicit single group used when
+// NAMESPACE_GROUPS is not set.
+const defaultGroupName = "default"
+
+// namespaceProviderAnnotation lets a namespace pick its namespace group by
+// name, taking precedence over label selectors.
+const namespaceProviderAnnotation = "oidc.token/provider"
+
+// defaultTokenFetchConcurrency bounds how many group tokens are fetched at once.
+const defaultTokenFetchConcurrency = 4
+
+// namespaceGroup maps namespaces selected by labels to their own token
+// request. Empty request fields fall back to the top-level OIDC settings.
+type namespaceGroup struct {
+	Name          string `json:"name"`
+	LabelSelector string `json:"labelSelector"`
+	TokenURL      string `json:"tokenURL,omitempty"`
+	Scopes        string `json:"scopes,omitempty"`
+	Audience      string `json:"audience,omitempty"`
+
+	selector labels.Selector
+}
+
+// parseNamespaceGroups decodes the NAMESPACE_GROUPS JSON array.
+func parseNamespaceGroups(value string) ([]namespaceGroup, error) {
+	var groups []namespaceGroup
+	if err := json.Unmarshal([]byte(value), &groups); err != nil {
+		return nil, fmt.Errorf("must be a JSON array of groups: %w", err)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("must define at least one group")
+	}
+
+	seen := make(map[string]bool, len(groups))
+	for i := range groups {
+		group := &groups[i]
+		if group.Name == "" {
+			return nil, fmt.Errorf("group %d has no name", i)
+		}
+		if seen[group.Name] {
+			return nil, fmt.Errorf("duplicate group name '%s'", group.Name)
+		}
+		seen[group.Name] = true
+
+		selector, err := labels.Parse(group.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("group '%s' has an invalid labelSelector: %w", group.Name, err)
+		}
+		group.selector = selector
+		group.Scopes = normalizeScopes(group.Scopes)
+
+		if group.TokenURL != "" {
+			parsed, err := url.Parse(group.TokenURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("group '%s' tokenURL must be an absolute http(s) URL, got '%s'", group.Name, group.TokenURL)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (g namespaceGroup) logSuffix() string {
+	if g.Name == defaultGroupName && g.LabelSelector == "" {
+		return ""
+	}
+	return fmt.Sprintf(" for namespace group '%s'", g.Name)
+}
+
+// tokenRequest derives the group's token request from the base request.
+func (g namespaceGroup) tokenRequest(base tokenRequest) tokenRequest {
+	req := base
+	if g.TokenURL != "" {
+		req.URLs = []string{g.TokenURL}
+	}
+	if g.Scopes != "" {
+		req.Scopes = g.Scopes
+	}
+	if g.Audience != "" {
+		req.Audience = g.Audience
+	}
+	return req
+}
+
+// groupToken is the outcome of fetching one group's token.
+type groupToken struct {
+	response *OIDCTokenResponse
+	err      error
+}
+
+// fetchGroupTokens fetches every group's token with at most concurrency
+// requests in flight. Groups whose token requests are identical share one
+// request. A failing group does not stop the others; its error is returned in
+// its entry, keyed by group name.
+func fetchGroupTokens(ctx context.Context, client *http.Client, base tokenRequest, groups []namespaceGroup, concurrency int) map[string]groupToken {
+	results := make(map[string]groupToken, len(groups))
+	cache := newTokenCache()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for _, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			log.Printf("Fetching OIDC token%s...", group.logSuffix())
+			response, reused, err := cache.fetch(ctx, client, group.tokenRequest(base))
+			switch {
+			case reused && err == nil:
+				log.Printf("Reusing the token of an identical request%s.", group.logSuffix())
+			case reused:
+				log.Printf("Reusing the failure of an identical request%s.", group.logSuffix())
+			}
+			mu.Lock()
+			results[group.Name] = groupToken{response: response, err: err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// assignNamespacesToGroups assigns each namespace to the group named by its
+// namespaceProviderAnnotation, or else to the first group whose selector
+// matches its labels, or else to defaultGroup if set. Namespaces naming an
+// unknown group, and namespaces left unassigned, are skipped.
+func assignNamespacesToGroups(namespaces []corev1.Namespace, groups []namespaceGroup, defaultGroup string) map[string][]string {
+	assignments := make(map[string][]string, len(groups))
+	for _, ns := range namespaces {
+		if name, ok := ns.Annotations[namespaceProviderAnnotation]; ok {
+			if !slices.ContainsFunc(groups, func(g namespaceGroup) bool { return g.Name == name }) {
+				log.Printf("Warning: namespace '%s' has annotation %s=%s, which names no namespace group. Skipping.", ns.Name, namespaceProviderAnnotation, name)
+				continue
+			}
+			assignments[name] = append(assignments[name], ns.Name)
+			continue
+		}
+		matched := false
+		for _, group := range groups {
+			if group.selector.Matches(labels.Set(ns.Labels)) {
+				assignments[group.Name] = append(assignments[group.Name], ns.Name)
+				matched = true
+				break
+			}
+		}
+		if !matched && defaultGroup != "" {
+			assignments[defaultGroup] = append(assignments[defaultGroup], ns.Name)
+		} else if !matched {
+			log.Printf("Namespace '%s' matches no namespace group. Skipping.", ns.Name)
+		}
+	}
+	return assignments
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNamespace(name string, labels map[string]string) corev1.Namespace {
+	return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestNamespaceGroupsGetTheirOwnToken(t *testing.T) {
+	prod := newFakeTokenServer(t, `{"access_token":"prod-token"}`)
+	staging := newFakeTokenServer(t, `{"access_token":"staging-token"}`)
+	groups, err := parseNamespaceGroups(fmt.Sprintf(`[
+		{"name": "prod", "labelSelector": "env=prod", "tokenURL": %q, "audience": "prod-api"},
+		{"name": "staging", "labelSelector": "env=staging", "tokenURL": %q, "audience": "staging-api"}
+	]`, prod.URL, staging.URL))
+	if err != nil {
+		t.Fatalf("parseNamespaceGroups() = %v", err)
+	}
+
+	tokens := fetchGroupTokens(context.Background(), http.DefaultClient, testTokenRequest("http://unused.invalid/token"), groups, 2)
+	for group, want := range map[string]string{"prod": "prod-token", "staging": "staging-token"} {
+		if err := tokens[group].err; err != nil {
+			t.Fatalf("group %s: %v", group, err)
+		}
+		if got := tokens[group].response.AccessToken; got != want {
+			t.Errorf("group %s token = %q, want %q", group, got, want)
+		}
+	}
+	for server, audience := range map[*fakeTokenServer]string{prod: "prod-api", staging: "staging-api"} {
+		requests := server.requests()
+		if len(requests) != 1 || requests[0].Form.Get("audience") != audience {
+			t.Errorf("token server for %s got %d requests, want one with its audience", audience, len(requests))
+		}
+	}
+
+	namespaces := []corev1.Namespace{
+		testNamespace("payments", map[string]string{"env": "prod"}),
+		testNamespace("payments-staging", map[string]string{"env": "staging"}),
+		testNamespace("search", map[string]string{"env": "prod"}),
+		testNamespace("sandbox", nil),
+	}
+	assignments := assignNamespacesToGroups(namespaces, groups, "")
+	if got := assignments["prod"]; !slices.Equal(got, []string{"payments", "search"}) {
+		t.Errorf("prod namespaces = %v", got)
+	}
+	if got := assignments["staging"]; !slices.Equal(got, []string{"payments-staging"}) {
+		t.Errorf("staging namespaces = %v", got)
+	}
+}
+
+func TestNamespaceGroupFailureIsIsolated(t *testing.T) {
+	ok := newFakeTokenServer(t, testTokenBody)
+	groups, err := parseNamespaceGroups(fmt.Sprintf(`[
+		{"name": "prod", "labelSelector": "env=prod", "tokenURL": %q},
+		{"name": "broken", "labelSelector": "env=staging", "tokenURL": "http://127.0.0.1:1/token"}
+	]`, ok.URL))
+	if err != nil {
+		t.Fatalf("parseNamespaceGroups() = %v", err)
+	}
+	tokens := fetchGroupTokens(context.Background(), http.DefaultClient, testTokenRequest(ok.URL), groups, 2)
+	if tokens["prod"].err != nil {
+		t.Errorf("prod: %v", tokens["prod"].err)
+	}
+	if tokens["broken"].err == nil {
+		t.Error("broken group got a token")
+	}
+}
+
+// TestFetchGroupTokensConcurrent is meant to run under -race.
+func TestFetchGroupTokensConcurrent(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	servers := map[string]string{
+		"broken": failing.URL,
+		"prod":   newFakeTokenServer(t, `{"access_token":"prod-token"}`).URL,
+		"dev":    newFakeTokenServer(t, `{"access_token":"dev-token"}`).URL,
+	}
+	var groups []namespaceGroup
+	for name, tokenURL := range servers {
+		groups = append(groups, namespaceGroup{Name: name, TokenURL: tokenURL})
+	}
+
+	tokens := fetchGroupTokens(context.Background(), http.DefaultClient, testTokenRequest(failing.URL), groups, 2)
+	if len(tokens) != 3 {
+		t.Fatalf("got %d results, want one per group", len(tokens))
+	}
+	if tokens["broken"].err == nil {
+		t.Error("broken group got a token")
+	}
+	for group, want := range map[string]string{"prod": "prod-token", "dev": "dev-token"} {
+		if tokens[group].err != nil || tokens[group].response.AccessToken != want {
+			t.Errorf("group %s = %+v, want %s", group, tokens[group], want)
+		}
+	}
+}
+
+func TestIdenticalGroupsShareOneTokenRequest(t *testing.T) {
+	logs := captureLog(t)
+	server := newFakeTokenServer(t, testTokenBody)
+	groups, err := parseNamespaceGroups(`[
+		{"name": "payments", "labelSelector": "team=payments", "scopes": "openid api"},
+		{"name": "search", "labelSelector": "team=search", "scopes": "openid api"}
+	]`)
+	if err != nil {
+		t.Fatalf("parseNamespaceGroups() = %v", err)
+	}
+
+	tokens := fetchGroupTokens(context.Background(), http.DefaultClient, testTokenRequest(server.URL), groups, 2)
+	for _, group := range []string{"payments", "search"} {
+		if tokens[group].err != nil {
+			t.Errorf("group %s: %v", group, tokens[group].err)
+		}
+	}
+	if got := len(server.requests()); got != 1 {
+		t.Errorf("IdP got %d requests, want 1 for two groups with the same scope", got)
+	}
+	if !strings.Contains(logs.String(), "Reusing the token of an identical request") {
+		t.Errorf("log does not mention the reused token:\n%s", logs)
+	}
+}
+
+func TestIdenticalGroupsShareOneFailure(t *testing.T) {
+	logs := captureLog(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	groups := []namespaceGroup{{Name: "payments"}, {Name: "search"}}
+
+	tokens := fetchGroupTokens(context.Background(), http.DefaultClient, testTokenRequest(failing.URL), groups, 1)
+	if tokens["payments"].err == nil || tokens["search"].err == nil {
+		t.Fatalf("tokens = %+v, want both groups to fail", tokens)
+	}
+	if strings.Contains(logs.String(), "Reusing the token") {
+		t.Errorf("a reused failure was logged as a reused token:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), "Reusing the failure of an identical request") {
+		t.Errorf("log does not mention the reused failure:\n%s", logs)
+	}
+}
+
+func TestAssignNamespacesByProviderAnnotation(t *testing.T) {
+	logs := captureLog(t)
+	groups, err := parseNamespaceGroups(`[
+		{"name": "prod", "labelSelector": "env=prod"},
+		{"name": "dev", "labelSelector": "env=dev"}
+	]`)
+	if err != nil {
+		t.Fatalf("parseNamespaceGroups() = %v", err)
+	}
+	withProvider := func(name, provider string, labels map[string]string) corev1.Namespace {
+		ns := testNamespace(name, labels)
+		ns.Annotations = map[string]string{namespaceProviderAnnotation: provider}
+		return ns
+	}
+	namespaces := []corev1.Namespace{
+		// The annotation wins over the labels.
+		withProvider("payments", "prod", map[string]string{"env": "dev"}),
+		withProvider("search", "dev", nil),
+		withProvider("typo", "prdo", map[string]string{"env": "prod"}),
+		testNamespace("billing", map[string]string{"env": "prod"}),
+		testNamespace("sandbox", nil),
+	}
+
+	assignments := assignNamespacesToGroups(namespaces, groups, "dev")
+	for group, want := range map[string][]string{
+		"prod": {"payments", "billing"},
+		"dev":  {"search", "sandbox"},
+	} {
+		if got := assignments[group]; !slices.Equal(got, want) {
+			t.Errorf("%s namespaces = %v, want %v", group, got, want)
+		}
+	}
+	if !strings.Contains(logs.String(), "namespace 'typo' has annotation "+namespaceProviderAnnotation+"=prdo, which names no namespace group") {
+		t.Errorf("log %q does not warn about the unknown provider", logs)
+	}
+}
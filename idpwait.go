@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultIdPWaitTimeout = 5 * time.Minute
+
+// idpWaitPolicy spaces out reachability probes while waiting for the IdP.
+// Probing continues until the wait deadline.
+var idpWaitPolicy = retryPolicy{
+	Name:      "token endpoint probe",
+	BaseDelay: 1 * time.Second,
+	MaxDelay:  30 * time.Second,
+	Retryable: func(error) bool { return true },
+}
+
+// waitForIdP polls tokenURLs until one of them answers with any HTTP
+// response, or until ctx is done. Only reachability is checked; the status
+// code is ignored since token endpoints commonly reject anything but a POST.
+func waitForIdP(ctx context.Context, client *http.Client, tokenURLs []string) error {
+	attempts := 0
+	err := retryWithBackoff(ctx, idpWaitPolicy, func() (err error) {
+		attempts++
+		for _, tokenURL := range tokenURLs {
+			if err = probeIdP(ctx, client, tokenURL); err == nil {
+				if attempts > 1 {
+					log.Printf("Token endpoint %s is reachable after %d attempts.", tokenURL, attempts)
+				}
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("token endpoint still unreachable: %w", err)
+	}
+	return nil
+}
+
+func probeIdP(ctx context.Context, client *http.Client, tokenURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, tokenURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails the first failures round trips, as if the IdP were
+// not up yet, and sends the rest on.
+type flakyTransport struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func fastIdPWait(t *testing.T) {
+	saved := idpWaitPolicy
+	idpWaitPolicy.BaseDelay = time.Millisecond
+	idpWaitPolicy.MaxDelay = 5 * time.Millisecond
+	t.Cleanup(func() { idpWaitPolicy = saved })
+}
+
+func TestWaitForIdPBecomesReachable(t *testing.T) {
+	fastIdPWait(t)
+	// Token endpoints commonly reject HEAD; any response counts.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	transport := &flakyTransport{failures: 2}
+	if err := waitForIdP(context.Background(), &http.Client{Transport: transport}, []string{server.URL}); err != nil {
+		t.Fatalf("waitForIdP() = %v", err)
+	}
+	if transport.calls != 3 {
+		t.Errorf("probed %d times, want 3", transport.calls)
+	}
+}
+
+func TestWaitForIdPGivesUpAtDeadline(t *testing.T) {
+	fastIdPWait(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	transport := &flakyTransport{failures: 1 << 30}
+	if err := waitForIdP(ctx, &http.Client{Transport: transport}, []string{"http://idp.invalid/token"}); err == nil {
+		t.Fatal("waitForIdP() = nil, want an error once the deadline passes")
+	}
+	if transport.calls < 2 {
+		t.Errorf("probed %d times, want polling until the deadline", transport.calls)
+	}
+}
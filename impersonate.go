@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// serviceAccountUserPrefix starts the user name Kubernetes gives a service
+// account: system:serviceaccount:<namespace>:<name>.
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// validateImpersonation checks K8S_IMPERSONATE_USER and
+// K8S_IMPERSONATE_GROUPS. Groups can only be impersonated along with a user,
+// and a service account user must name a valid namespace and service account,
+// since a typo there would otherwise surface as an opaque authorization error.
+func validateImpersonation(user string, groups []string) error {
+	if user == "" {
+		if len(groups) > 0 {
+			return fmt.Errorf("K8S_IMPERSONATE_GROUPS requires K8S_IMPERSONATE_USER")
+		}
+		return nil
+	}
+	if strings.ContainsAny(user, " \t\r\n") {
+		return fmt.Errorf("K8S_IMPERSONATE_USER must not contain whitespace, got '%s'", user)
+	}
+	if rest, ok := strings.CutPrefix(user, serviceAccountUserPrefix); ok {
+		namespace, name, ok := strings.Cut(rest, ":")
+		if !ok || strings.Contains(name, ":") {
+			return fmt.Errorf("K8S_IMPERSONATE_USER must be %s<namespace>:<name> for a service account, got '%s'", serviceAccountUserPrefix, user)
+		}
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("K8S_IMPERSONATE_USER names an invalid namespace '%s': %s", namespace, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf("K8S_IMPERSONATE_USER names an invalid service account '%s': %s", name, strings.Join(errs, "; "))
+		}
+	}
+	for _, group := range groups {
+		if strings.ContainsAny(group, " \t\r\n") {
+			return fmt.Errorf("K8S_IMPERSONATE_GROUPS must not contain whitespace, got '%s'", group)
+		}
+	}
+	return nil
+}
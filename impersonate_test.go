@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateImpersonation(t *testing.T) {
+	valid := []struct {
+		user   string
+		groups []string
+	}{
+		{"", nil},
+		{"system:serviceaccount:oidc:token-writer", nil},
+		{"system:serviceaccount:oidc:token-writer", []string{"system:serviceaccounts", "system:serviceaccounts:oidc"}},
+		{"deployer@example.com", []string{"platform"}},
+	}
+	for _, tt := range valid {
+		if err := validateImpersonation(tt.user, tt.groups); err != nil {
+			t.Errorf("validateImpersonation(%q, %v) = %v", tt.user, tt.groups, err)
+		}
+	}
+
+	invalid := []struct {
+		user   string
+		groups []string
+		want   string
+	}{
+		{"", []string{"platform"}, "requires K8S_IMPERSONATE_USER"},
+		{"token writer", nil, "must not contain whitespace"},
+		{"system:serviceaccount:oidc", nil, "<namespace>:<name>"},
+		{"system:serviceaccount:oidc:a:b", nil, "<namespace>:<name>"},
+		{"system:serviceaccount:OIDC:token-writer", nil, "invalid namespace"},
+		{"system:serviceaccount:oidc:Token_Writer", nil, "invalid service account"},
+		{"deployer", []string{"platform team"}, "K8S_IMPERSONATE_GROUPS must not contain whitespace"},
+	}
+	for _, tt := range invalid {
+		err := validateImpersonation(tt.user, tt.groups)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("validateImpersonation(%q, %v) = %v, want an error containing %q", tt.user, tt.groups, err, tt.want)
+		}
+	}
+}
+
+func TestGetKubeClientImpersonation(t *testing.T) {
+	captureLog(t)
+	server := newFakeAPIServer(t, nil)
+	clientset, err := getKubeClient(kubeConnection{
+		APIServer:         server.URL,
+		BearerToken:       "sa-token",
+		CAFile:            server.caFile,
+		ImpersonateUser:   "system:serviceaccount:oidc:token-writer",
+		ImpersonateGroups: []string{"system:serviceaccounts", "platform"},
+	})
+	if err != nil {
+		t.Fatalf("getKubeClient() = %v", err)
+	}
+	if _, err := clientset.Discovery().ServerVersion(); err != nil {
+		t.Fatalf("ServerVersion() = %v", err)
+	}
+	if got := server.headers().Get("Impersonate-User"); got != "system:serviceaccount:oidc:token-writer" {
+		t.Errorf("Impersonate-User = %q", got)
+	}
+	if got := server.headers().Values("Impersonate-Group"); strings.Join(got, ",") != "system:serviceaccounts,platform" {
+		t.Errorf("Impersonate-Group = %v", got)
+	}
+}
+
+func TestLoadConfigImpersonation(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("K8S_IMPERSONATE_USER", " system:serviceaccount:oidc:token-writer ")
+	t.Setenv("K8S_IMPERSONATE_GROUPS", "system:serviceaccounts,\nplatform")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Kube.ImpersonateUser != "system:serviceaccount:oidc:token-writer" || strings.Join(cfg.Kube.ImpersonateGroups, ",") != "system:serviceaccounts,platform" {
+		t.Errorf("impersonation = %q, %v", cfg.Kube.ImpersonateUser, cfg.Kube.ImpersonateGroups)
+	}
+
+	t.Setenv("K8S_IMPERSONATE_USER", "")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "requires K8S_IMPERSONATE_USER") {
+		t.Errorf("loadConfig() with groups only = %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+const defaultTokenJSONPath = "$.access_token"
+
+// responsePath is a compiled JSONPath expression locating a value in the
+// token response. Both the "$.a.b" form and the kubectl "{.a.b}" form are
+// accepted.
+type responsePath struct {
+	expr string
+	path *jsonpath.JSONPath
+}
+
+func parseResponsePath(expr string) (*responsePath, error) {
+	template := strings.TrimSpace(expr)
+	if strings.HasPrefix(template, "$") {
+		template = "{" + strings.TrimPrefix(template, "$") + "}"
+	}
+	if !strings.HasPrefix(template, "{") {
+		return nil, fmt.Errorf("JSONPath '%s' must start with '$' or '{'", expr)
+	}
+
+	path := jsonpath.New(expr).AllowMissingKeys(true)
+	if err := path.Parse(template); err != nil {
+		return nil, fmt.Errorf("invalid JSONPath '%s': %w", expr, err)
+	}
+	return &responsePath{expr: expr, path: path}, nil
+}
+
+func (p *responsePath) String() string {
+	return p.expr
+}
+
+// find returns the first value the path selects in document, re-encoded as
+// JSON, or false if it selects nothing.
+func (p *responsePath) find(document interface{}) (json.RawMessage, bool, error) {
+	results, err := p.path.FindResults(document)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to evaluate JSONPath '%s': %w", p.expr, err)
+	}
+	if len(results) == 0 || len(results[0]) == 0 || !results[0][0].IsValid() {
+		return nil, false, nil
+	}
+	value := results[0][0].Interface()
+	if value == nil {
+		return nil, false, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode value at JSONPath '%s': %w", p.expr, err)
+	}
+	return encoded, true, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeTokenResponseJSONPath(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, body, tokenPath, expiresPath string
+		wantToken                          string
+		wantExpiry                         time.Time
+	}{
+		{
+			name:      "default access_token",
+			body:      `{"access_token":"plain","expires_in":60}`,
+			wantToken: "plain", wantExpiry: now.Add(time.Minute),
+		},
+		{
+			name:      "nested under data",
+			body:      `{"data":{"token":"nested","expiry":"2026-03-01T13:00:00Z"}}`,
+			tokenPath: "$.data.token", expiresPath: "$.data.expiry",
+			wantToken: "nested", wantExpiry: now.Add(time.Hour),
+		},
+		{
+			name:      "first element of an array, kubectl form",
+			body:      `{"credentials":[{"jwt":"first","exp":1772370000},{"jwt":"second"}]}`,
+			tokenPath: "{.credentials[0].jwt}", expiresPath: "{.credentials[0].exp}",
+			wantToken: "first", wantExpiry: time.Unix(1772370000, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenReq tokenRequest
+			var err error
+			if tt.tokenPath != "" {
+				if tokenReq.TokenPath, err = parseResponsePath(tt.tokenPath); err != nil {
+					t.Fatalf("parseResponsePath(%q) = %v", tt.tokenPath, err)
+				}
+			}
+			if tt.expiresPath != "" {
+				if tokenReq.ExpiresPath, err = parseResponsePath(tt.expiresPath); err != nil {
+					t.Fatalf("parseResponsePath(%q) = %v", tt.expiresPath, err)
+				}
+			}
+			response, err := decodeTokenResponse([]byte(tt.body), tokenReq, now)
+			if err != nil {
+				t.Fatalf("decodeTokenResponse() = %v", err)
+			}
+			if response.AccessToken != tt.wantToken || !response.ExpiresAt.Equal(tt.wantExpiry) {
+				t.Errorf("token %q expiring %v, want %q expiring %v", response.AccessToken, response.ExpiresAt, tt.wantToken, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestDecodeTokenResponseJSONPathMismatch(t *testing.T) {
+	path, err := parseResponsePath("$.data.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, want := range map[string]string{
+		`{"access_token":"ignored"}`: "access token not found",
+		`{"data":{"token":42}}`:      "is not a string",
+	} {
+		_, err := decodeTokenResponse([]byte(body), tokenRequest{TokenPath: path}, time.Now())
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("decodeTokenResponse(%s) = %v, want an error containing %q", body, err, want)
+		}
+	}
+}
+
+func TestLoadConfigValidatesJSONPath(t *testing.T) {
+	setBaseEnv(t)
+	for _, bad := range []string{"data.token", "$.data[", "{.data"} {
+		t.Setenv("OIDC_TOKEN_JSONPATH", bad)
+		if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "OIDC_TOKEN_JSONPATH") {
+			t.Errorf("loadConfig() with OIDC_TOKEN_JSONPATH=%q = %v, want it rejected", bad, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNotJWT = errors.New("token is not a JWT")
+
+// loggableClaims are the claims considered safe to print. Values of every
+// other claim are redacted.
+var loggableClaims = map[string]bool{
+	"iss":       true,
+	"sub":       true,
+	"aud":       true,
+	"exp":       true,
+	"iat":       true,
+	"nbf":       true,
+	"azp":       true,
+	"client_id": true,
+	"scope":     true,
+}
+
+const redactedClaimValue = "<redacted>"
+
+// parsedToken is an access token decoded once and shared by every consumer
+// (claims logging, the claims key, rotation metadata, expiry). It is not
+// modified after parseToken returns, so it is safe for concurrent use.
+// Signatures are never verified.
+type parsedToken struct {
+	Raw string
+
+	// payload and claims are set for JWTs; err explains why a token is not
+	// one, wrapping errNotJWT.
+	payload []byte
+	claims  map[string]json.RawMessage
+	err     error
+}
+
+// parseToken splits raw into its segments and decodes the payload. JWT
+// segments use the URL-safe base64 alphabet ('-' and '_') without padding;
+// padding some issuers add anyway is trimmed before decoding.
+func parseToken(raw string) *parsedToken {
+	token := &parsedToken{Raw: raw}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		token.err = errNotJWT
+		return token
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		token.err = fmt.Errorf("%w: failed to decode payload: %v", errNotJWT, err)
+		return token
+	}
+	if err := json.Unmarshal(payload, &token.claims); err != nil || token.claims == nil {
+		token.err = fmt.Errorf("%w: payload is not a JSON object", errNotJWT)
+		return token
+	}
+	token.payload = payload
+	return token
+}
+
+// Payload returns the JSON payload of a JWT. Opaque tokens yield an error
+// wrapping errNotJWT.
+func (t *parsedToken) Payload() ([]byte, error) {
+	return t.payload, t.err
+}
+
+// Issuer returns the iss claim, or "" for opaque tokens and tokens without one.
+func (t *parsedToken) Issuer() string {
+	var issuer string
+	if err := json.Unmarshal(t.claims["iss"], &issuer); err != nil {
+		return ""
+	}
+	return issuer
+}
+
+// Expiry returns the exp claim, or false for opaque tokens and tokens
+// without a numeric one.
+func (t *parsedToken) Expiry() (time.Time, bool) {
+	var exp float64
+	if err := json.Unmarshal(t.claims["exp"], &exp); err != nil || exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// formatLoggableClaims renders a JWT payload as sorted name=value pairs,
+// keeping only the values of allowlisted claims.
+func formatLoggableClaims(payload []byte) (string, error) {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse claims: %w", err)
+	}
+
+	names := make([]string, 0, len(claims))
+	for name := range claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := redactedClaimValue
+		if loggableClaims[name] {
+			value = string(claims[name])
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+// encodeStoredClaims prepares a JWT payload for WRITE_CLAIMS_KEY: it keeps
+// only the allowlisted claims when an allowlist is given, writes the JSON
+// compact or indented, and gzips it when compress is set.
+func encodeStoredClaims(payload []byte, allowlist []string, pretty, compress bool) ([]byte, error) {
+	if len(allowlist) > 0 {
+		var claims map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return nil, fmt.Errorf("failed to parse claims: %w", err)
+		}
+		kept := make(map[string]json.RawMessage, len(allowlist))
+		for _, name := range allowlist {
+			if value, ok := claims[name]; ok {
+				kept[name] = value
+			}
+		}
+		var err error
+		if payload, err = json.Marshal(kept); err != nil {
+			return nil, fmt.Errorf("failed to encode claims: %w", err)
+		}
+	}
+
+	var formatted bytes.Buffer
+	var err error
+	if pretty {
+		err = json.Indent(&formatted, payload, "", "  ")
+	} else {
+		err = json.Compact(&formatted, payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to format claims: %w", err)
+	}
+	payload = formatted.Bytes()
+
+	if !compress {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to compress claims: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress claims: %w", err)
+	}
+	return buf.Bytes(), nil
+}
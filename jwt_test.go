@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWT builds an unsigned JWT carrying claims.
+func testJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+func TestEncodeStoredClaimsAllowlist(t *testing.T) {
+	payload := []byte(`{"sub":"svc-deployer","aud":"api","groups":["a","b"],"email":"x@example.com"}`)
+	got, err := encodeStoredClaims(payload, []string{"sub", "groups", "missing"}, false, false)
+	if err != nil {
+		t.Fatalf("encodeStoredClaims() = %v", err)
+	}
+	if want := `{"groups":["a","b"],"sub":"svc-deployer"}`; string(got) != want {
+		t.Errorf("claims = %s, want %s", got, want)
+	}
+
+	got, err = encodeStoredClaims(payload, nil, false, false)
+	if err != nil {
+		t.Fatalf("encodeStoredClaims() = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("claims without an allowlist = %s, want all of them", got)
+	}
+}
+
+func TestEncodeStoredClaimsGzip(t *testing.T) {
+	payload := []byte(`{"sub":"svc-deployer","aud":"api"}`)
+	got, err := encodeStoredClaims(payload, []string{"sub"}, false, true)
+	if err != nil {
+		t.Fatalf("encodeStoredClaims() = %v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("claims are not gzip: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"sub":"svc-deployer"}`; string(decompressed) != want {
+		t.Errorf("decompressed claims = %s, want %s", decompressed, want)
+	}
+}
+
+func TestParseTokenJWT(t *testing.T) {
+	token := parseToken(testJWT(t, map[string]interface{}{"iss": "https://idp.example.com", "exp": 1772370000}))
+	payload, err := token.Payload()
+	if err != nil {
+		t.Fatalf("Payload() = %v", err)
+	}
+	if !bytes.Contains(payload, []byte(`"iss":"https://idp.example.com"`)) {
+		t.Errorf("Payload() = %s", payload)
+	}
+	if got := token.Issuer(); got != "https://idp.example.com" {
+		t.Errorf("Issuer() = %q", got)
+	}
+	if exp, ok := token.Expiry(); !ok || !exp.Equal(time.Unix(1772370000, 0)) {
+		t.Errorf("Expiry() = %v, %v", exp, ok)
+	}
+}
+
+func TestParseTokenPaddedPayload(t *testing.T) {
+	// {"sub":"x"} encodes to 15 characters, which some issuers pad.
+	token := parseToken("e30." + base64.URLEncoding.EncodeToString([]byte(`{"sub":"x"}`)) + ".c2ln")
+	if _, err := token.Payload(); err != nil {
+		t.Errorf("Payload() for a padded payload = %v", err)
+	}
+}
+
+func TestParseTokenNotJWT(t *testing.T) {
+	for name, raw := range map[string]string{
+		"opaque":             "2YotnFZFEjr1zCsicMWpAA",
+		"two segments":       "header.payload",
+		"invalid base64":     "e30.!!!.c2ln",
+		"payload not object": "e30." + base64.RawURLEncoding.EncodeToString([]byte(`["sub"]`)) + ".c2ln",
+		"payload null":       "e30." + base64.RawURLEncoding.EncodeToString([]byte(`null`)) + ".c2ln",
+	} {
+		t.Run(name, func(t *testing.T) {
+			token := parseToken(raw)
+			if token.Raw != raw {
+				t.Errorf("Raw = %q, want the token unchanged", token.Raw)
+			}
+			if _, err := token.Payload(); !errors.Is(err, errNotJWT) {
+				t.Errorf("Payload() = %v, want errNotJWT", err)
+			}
+			if token.Issuer() != "" {
+				t.Errorf("Issuer() = %q, want none", token.Issuer())
+			}
+			if _, ok := token.Expiry(); ok {
+				t.Error("Expiry() reported an expiry")
+			}
+		})
+	}
+}
+
+func TestParsedTokenConcurrentUse(t *testing.T) {
+	token := parseToken(testJWT(t, map[string]interface{}{"iss": "https://idp.example.com", "exp": 1772370000}))
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token.Issuer()
+			token.Expiry()
+			token.Payload()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestParseTokenURLSafeSegments(t *testing.T) {
+	// Encodes to a segment containing '-' and '_', which the standard
+	// alphabet rejects.
+	payload := `{"sub":"~~~?","exp":1772370000}`
+	segment := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	if !strings.ContainsAny(segment, "-_") {
+		t.Fatalf("segment %q does not exercise the URL-safe alphabet", segment)
+	}
+	if _, err := base64.StdEncoding.DecodeString(segment); err == nil {
+		t.Fatalf("segment %q decodes with the standard alphabet too", segment)
+	}
+
+	for name, raw := range map[string]string{
+		"unpadded": "eyJhbGciOiJub25lIn0." + segment + ".c2lnbmF0dXJl",
+		"padded":   "eyJhbGciOiJub25lIn0." + base64.URLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl",
+	} {
+		token := parseToken(raw)
+		got, err := token.Payload()
+		if err != nil {
+			t.Errorf("%s: Payload() = %v", name, err)
+			continue
+		}
+		if string(got) != payload {
+			t.Errorf("%s: Payload() = %s, want %s", name, got, payload)
+		}
+		if exp, ok := token.Expiry(); !ok || exp.Unix() != 1772370000 {
+			t.Errorf("%s: Expiry() = %v, %v", name, exp, ok)
+		}
+	}
+}
+
+func TestEncodeStoredClaimsFormat(t *testing.T) {
+	payload := []byte("{\"sub\": \"svc-deployer\",\n \"groups\": [\"a\", \"b\"]}")
+	compact, err := encodeStoredClaims(payload, nil, false, false)
+	if err != nil {
+		t.Fatalf("encodeStoredClaims() = %v", err)
+	}
+	if want := `{"sub":"svc-deployer","groups":["a","b"]}`; string(compact) != want {
+		t.Errorf("compact claims = %s, want %s", compact, want)
+	}
+
+	pretty, err := encodeStoredClaims(payload, nil, true, false)
+	if err != nil {
+		t.Fatalf("encodeStoredClaims(pretty) = %v", err)
+	}
+	want := "{\n  \"sub\": \"svc-deployer\",\n  \"groups\": [\n    \"a\",\n    \"b\"\n  ]\n}"
+	if string(pretty) != want {
+		t.Errorf("pretty claims = %q, want %q", pretty, want)
+	}
+}
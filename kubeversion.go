@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// minKubeVersion is the oldest API server the secret writes are known to work
+// against: it needs field managers on create/patch and the immutable field
+// on secrets.
+var minKubeVersion = utilversion.MajorMinor(1, 19)
+
+// secretWriteMode is how secrets are written on every supported API server.
+// Merge patches work unchanged from minKubeVersion on, so there is no
+// server-side apply mode to gate on the version and nothing to fall back to.
+const secretWriteMode = "merge-patch (server-side apply is not used)"
+
+// checkServerVersion asks the API server for its version and rejects servers
+// older than minKubeVersion with a clear message, instead of letting the
+// first secret write fail in a less obvious way.
+func checkServerVersion(ctx context.Context, clientset kubernetes.Interface) (*utilversion.Version, error) {
+	var gitVersion string
+	err := retryKubeCall(ctx, "server version discovery", func() error {
+		info, err := clientset.Discovery().ServerVersion()
+		if err != nil {
+			return err
+		}
+		gitVersion = info.GitVersion
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover API server version: %w", err)
+	}
+
+	serverVersion, err := utilversion.ParseGeneric(gitVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse API server version '%s': %w", gitVersion, err)
+	}
+	if !serverVersion.AtLeast(minKubeVersion) {
+		return serverVersion, fmt.Errorf("API server version %s is not supported, at least %s is required", serverVersion, minKubeVersion)
+	}
+	return serverVersion, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	kubeversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func fakeServerVersion(gitVersion string) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &kubeversion.Info{GitVersion: gitVersion}
+	return clientset
+}
+
+func TestCheckServerVersion(t *testing.T) {
+	serverVersion, err := checkServerVersion(context.Background(), fakeServerVersion("v1.30.2-eks-1234"))
+	if err != nil {
+		t.Fatalf("checkServerVersion() = %v", err)
+	}
+	if serverVersion.String() != "1.30.2" {
+		t.Errorf("version = %s", serverVersion)
+	}
+}
+
+func TestCheckServerVersionTooOld(t *testing.T) {
+	serverVersion, err := checkServerVersion(context.Background(), fakeServerVersion("v1.18.20"))
+	if err == nil {
+		t.Fatal("checkServerVersion() = nil, want an old server rejected")
+	}
+	for _, want := range []string{"1.18.20 is not supported", "at least 1.19"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if serverVersion == nil || serverVersion.Minor() != 18 {
+		t.Errorf("version = %v, want the detected version returned for the log", serverVersion)
+	}
+}
+
+func TestCheckServerVersionUnparsable(t *testing.T) {
+	if _, err := checkServerVersion(context.Background(), fakeServerVersion("")); err == nil {
+		t.Error("checkServerVersion() = nil, want an empty version rejected")
+	}
+}
@@ -1,155 +1,796 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	// Autoload GKE auth plugin
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
 const (
-	defaultScopes           = "openid"
-	defaultSecretName       = "oidc-token-secret"
-	defaultSecretKey        = "token"
-	defaultTokenTimeout     = 30 * time.Second
-	k8sListNamespaceTimeout = 1 * time.Minute
-	k8sSecretOpTimeout      = 30 * time.Second
-	TargetNamespacesEnvVar  = "TARGET_NAMESPACES"
+	defaultScopes              = "openid"
+	defaultSecretName          = "oidc-token-secret"
+	defaultSecretKey           = "token"
+	defaultTokenTimeout        = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 4
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxResponseBytes    = 1 << 20
+	k8sListNamespaceTimeout    = 1 * time.Minute
+	k8sSecretOpTimeout         = 30 * time.Second
+	k8sPreflightTimeout        = 1 * time.Minute
+	defaultFieldManager        = "oidc-jwt-fetcher"
+	runIDHeader                = "X-Request-ID"
+	TargetNamespacesEnvVar     = "TARGET_NAMESPACES"
 )
 
+// exitInterrupted is the exit code of a run stopped by a shutdown signal
+// before anything was written, following the shell's 128+SIGINT convention.
+const exitInterrupted = 130
+
+// version is overridden at build time via -ldflags "-X main.version=<version>".
+var version = "dev"
+
 type OIDCTokenResponse struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
 	TokenType   string `json:"token_type"`
+	// RefreshToken is only issued for the offline_access scope. It is
+	// stored with REFRESH_TOKEN_SECRET_NAMESPACE and must never be logged.
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// ExpiresAt is derived from the response after decoding; zero if unknown.
+	ExpiresAt time.Time `json:"-"`
+	// TokenURL is the endpoint that issued the token.
+	TokenURL string `json:"-"`
 }
 
 func main() {
 	log.Println("Starting OIDC JWT Fetcher CronJob...")
 
+	printConfigFlag := flag.Bool("print-config", false, "log the effective configuration at startup, with secrets redacted")
+	validateFlag := flag.Bool("validate", false, "check configuration, token fetch, Kubernetes access and RBAC without writing any secrets")
+	flag.Parse()
+
+	cfg, err := loadConfig(*validateFlag, *printConfigFlag)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	setLogRunID(cfg.RunID)
+	log.Printf("Run ID: %s", cfg.RunID)
+	// report is nil unless SUMMARY_FILE_PATH is set. fatalf records the
+	// failure in it before exiting.
+	report := newRunReport(cfg.SummaryFile, cfg.RunID)
+	fatalf := func(format string, v ...interface{}) {
+		report.finish(runFailed, fmt.Sprintf(format, v...))
+		log.Fatalf(format, v...)
+	}
+	if cfg.PrintConfig {
+		log.Println("Effective configuration (secrets redacted):")
+		for _, line := range configLines(cfg) {
+			log.Printf("  %s", line)
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	tokenURL := getEnvOrDie("OIDC_TOKEN_URL")
-	clientID := getEnvOrDie("OIDC_CLIENT_ID")
-	clientSecret := getEnvOrDie("OIDC_CLIENT_SECRET")
-	scopes := getEnv("OIDC_SCOPES", defaultScopes)
-	k8sSecretName := getEnv("K8S_SECRET_NAME", defaultSecretName)
-	k8sSecretKey := getEnv("K8S_SECRET_KEY", defaultSecretKey)
+	if cfg.RunDeadline > 0 {
+		log.Printf("RUN_DEADLINE is set: the run will stop after %v.", cfg.RunDeadline)
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeout(ctx, cfg.RunDeadline)
+		defer cancelDeadline()
+	}
+
+	// Every time comparison of the run reads this clock.
+	var runClock clock = systemClock{}
 
-	log.Println("Fetching OIDC token...")
-	accessToken, err := fetchOIDCToken(tokenURL, clientID, clientSecret, scopes)
-	if err != nil {
-		log.Fatalf("Error fetching OIDC token: %v", err)
+	tokenReq := tokenRequest{
+		URLs:         cfg.TokenURLs,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		AuthMethod:   cfg.AuthMethod,
+		Scopes:       cfg.Scopes,
+		UserAgent:    cfg.UserAgent,
+		Accept:       cfg.Accept,
+		ContentType:  cfg.ContentType,
+		RunID:        cfg.RunID,
+
+		TokenPath:          cfg.TokenPath,
+		ExpiresPath:        cfg.ExpiresPath,
+		ExpiresPathDefault: cfg.ExpiresPathDefault,
+
+		GatewayBasicUser:     cfg.GatewayBasicUser,
+		GatewayBasicPassword: cfg.GatewayBasicPassword,
+
+		SubjectToken:     cfg.SubjectToken,
+		CredentialHelper: cfg.CredentialHelper,
+		MaxResponseBytes: cfg.MaxResponseBytes,
+		Clock:            runClock,
+	}
+	tokenClient := newTokenHTTPClient(&tls.Config{
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCipherSuites,
+	}, tokenTransportOptions{
+		DisableHTTP2:        cfg.DisableHTTP2,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	})
+
+	if cfg.Mode == modeValidate {
+		if !runValidation(ctx, tokenClient, tokenReq, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	groups := cfg.NamespaceGroups
+	if len(groups) == 0 {
+		groups = []namespaceGroup{{Name: defaultGroupName, selector: labels.Everything()}}
+	}
+
+	if cfg.WaitForIdP {
+		log.Printf("WAIT_FOR_IDP is set: waiting up to %v for the token endpoint to become reachable...", cfg.IdPWaitTimeout)
+		waitCtx, waitCancel := context.WithTimeout(ctx, cfg.IdPWaitTimeout)
+		for _, group := range groups {
+			if err := waitForIdP(waitCtx, tokenClient, group.tokenRequest(tokenReq).URLs); err != nil {
+				waitCancel()
+				if ctx.Err() == context.Canceled {
+					log.Printf("Shutdown signal received while waiting for the token endpoint. Nothing was written.")
+					report.finish(runInterrupted, "shutdown signal received before distribution")
+					os.Exit(exitInterrupted)
+				}
+				fatalf("Gave up waiting for the token endpoint: %v", err)
+			}
+		}
+		waitCancel()
+	}
+
+	secretDataByGroup := make(map[string]map[string][]byte, len(groups))
+	expiresAtByGroup := make(map[string]time.Time, len(groups))
+	checksumByGroup := make(map[string]string, len(groups))
+	rotationByGroup := make(map[string]*rotationMetadata, len(groups))
+	accessTokenByGroup := make(map[string]string, len(groups))
+	// With NAMESPACE_GROUPS, a group whose token cannot be obtained only fails
+	// its own namespaces; the other groups are still distributed.
+	tokenErrByGroup := make(map[string]error)
+	tokens := fetchGroupTokens(ctx, tokenClient, tokenReq, groups, cfg.TokenFetchConcurrency)
+	if ctx.Err() == context.Canceled {
+		log.Printf("Shutdown signal received while fetching the token. Nothing was written.")
+		report.finish(runInterrupted, "shutdown signal received before distribution")
+		os.Exit(exitInterrupted)
+	}
+	for _, group := range groups {
+		tokenResponse, err := tokens[group.Name].response, tokens[group.Name].err
+		if err != nil {
+			if len(cfg.NamespaceGroups) == 0 {
+				report.recordToken("", time.Time{}, err)
+				fatalf("Error fetching OIDC token: %v", err)
+			}
+			log.Printf("Error fetching OIDC token%s: %v. Its namespaces will be skipped.", group.logSuffix(), err)
+			tokenErrByGroup[group.Name] = fmt.Errorf("failed to fetch token: %w", err)
+			continue
+		}
+		log.Printf("Successfully fetched OIDC token%s (token_type: '%s').", group.logSuffix(), tokenResponse.TokenType)
+		if err := checkTokenType(tokenResponse.TokenType, cfg.RequireBearer); err != nil {
+			if len(cfg.NamespaceGroups) == 0 {
+				report.recordToken("", time.Time{}, err)
+				fatalf("Rejected OIDC token: %v", err)
+			}
+			log.Printf("Rejected OIDC token%s: %v. Its namespaces will be skipped.", group.logSuffix(), err)
+			tokenErrByGroup[group.Name] = fmt.Errorf("rejected token: %w", err)
+			continue
+		}
+		token := parseToken(tokenResponse.AccessToken)
+		tokenResponse.ExpiresAt = resolveTokenExpiry(tokenResponse.ExpiresAt, token, cfg.DefaultTokenLifetime, runClock.Now())
+		if err := checkTokenExpiry(tokenResponse.ExpiresAt, runClock.Now(), cfg.ClockSkew); err != nil {
+			if len(cfg.NamespaceGroups) == 0 {
+				report.recordToken("", time.Time{}, err)
+				fatalf("Rejected OIDC token: %v", err)
+			}
+			log.Printf("Rejected OIDC token%s: %v. Its namespaces will be skipped.", group.logSuffix(), err)
+			tokenErrByGroup[group.Name] = fmt.Errorf("rejected token: %w", err)
+			continue
+		}
+		if tokenResponse.ExpiresAt.IsZero() {
+			log.Println("Token response does not state an expiry.")
+		} else {
+			log.Printf("Token expires at %s (in %v).", tokenResponse.ExpiresAt.UTC().Format(time.RFC3339), tokenResponse.ExpiresAt.Sub(runClock.Now()).Round(time.Second))
+		}
+		if cfg.LogTokenClaims {
+			logClaims(token)
+		}
+		secretData, err := buildSecretData(cfg, token, tokenResponse.ExpiresAt)
+		if err != nil {
+			if len(cfg.NamespaceGroups) == 0 {
+				report.recordToken("", time.Time{}, err)
+				fatalf("Error preparing secret data: %v", err)
+			}
+			log.Printf("Error preparing secret data%s: %v. Its namespaces will be skipped.", group.logSuffix(), err)
+			tokenErrByGroup[group.Name] = err
+			continue
+		}
+		secretDataByGroup[group.Name] = secretData
+		accessTokenByGroup[group.Name] = tokenResponse.AccessToken
+		expiresAtByGroup[group.Name] = tokenResponse.ExpiresAt
+		if cfg.ChecksumAnnotation {
+			checksumByGroup[group.Name] = tokenChecksum(tokenResponse.AccessToken)
+		}
+		if cfg.RotationMetadata {
+			rotationByGroup[group.Name] = newRotationMetadata(cfg.RunID, token, tokenResponse.TokenURL, runClock.Now())
+		}
+	}
+	for _, group := range groups {
+		name := group.Name
+		if len(cfg.NamespaceGroups) == 0 {
+			name = ""
+		}
+		report.recordToken(name, expiresAtByGroup[group.Name], tokenErrByGroup[group.Name])
+	}
+	if len(tokenErrByGroup) == len(groups) {
+		fatalf("No namespace group obtained a token.")
+	}
+	if err := waitForTokenPropagation(ctx, cfg.TokenPropagationDelay); err != nil {
+		if err == context.Canceled {
+			log.Printf("Shutdown signal received while waiting for the token to propagate. Nothing was written.")
+			report.finish(runInterrupted, "shutdown signal received before distribution")
+			os.Exit(exitInterrupted)
+		}
+		fatalf("Run deadline exceeded while waiting for the token to propagate.")
+	}
+
+	// Sinks outside the cluster are only allowed without NAMESPACE_GROUPS,
+	// so they receive the default group's token.
+	var sinks []tokenSink
+	if slices.Contains(cfg.OutputModes, outputAWSSecretsManager) {
+		sink, err := newAWSSecretsManagerSink(ctx, cfg.AWSSecretID)
+		if err != nil {
+			fatalf("Error initializing AWS Secrets Manager output: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if slices.Contains(cfg.OutputModes, outputFile) {
+		sinks = append(sinks, &fileSink{path: cfg.OutputFile})
+	}
+	if slices.Contains(cfg.OutputModes, outputStdout) {
+		sinks = append(sinks, &stdoutSink{w: os.Stdout})
+	}
+	// A failing sink does not stop the others or the Kubernetes secrets; the
+	// run fails at the end instead.
+	sinkErr := writeToSinks(ctx, sinks, accessTokenByGroup[defaultGroupName])
+	if clusterResource(cfg.OutputModes) == "" {
+		if sinkErr != nil {
+			fatalf("Writing the token to outputs failed: %v", sinkErr)
+		}
+		report.finish(runSucceeded, "")
+		log.Println("OIDC JWT Fetcher CronJob finished successfully.")
+		return
 	}
-	log.Println("Successfully fetched OIDC token.")
 
 	log.Println("Initializing Kubernetes client...")
-	kubeClient, err := getKubeClient()
+	kubeClient, err := getKubeClient(cfg.Kube)
 	if err != nil {
-		log.Fatalf("Error initializing Kubernetes client: %v", err)
+		fatalf("Error initializing Kubernetes client: %v", err)
 	}
 	log.Println("Successfully initialized Kubernetes client.")
 
-	var namespacesToProcess []string
-	targetNamespacesStr := os.Getenv(TargetNamespacesEnvVar)
+	if cfg.RefreshTokenSecretNamespace != "" {
+		refreshCtx, refreshCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+		err := storeRefreshToken(refreshCtx, kubeClient, cfg.RefreshTokenSecretNamespace, cfg.RefreshTokenSecretName, cfg.FieldManager, tokens[defaultGroupName].response.RefreshToken)
+		refreshCancel()
+		if err != nil {
+			// Like a failing output, this fails the run once the token
+			// has been distributed.
+			log.Printf("Error: %v. Continuing with distribution.", err)
+			sinkErr = errors.Join(sinkErr, err)
+		}
+	}
+
+	serverVersion, err := checkServerVersion(ctx, kubeClient)
+	if err != nil {
+		fatalf("Error checking Kubernetes API server: %v", err)
+	}
+	log.Printf("Kubernetes API server version %s. Write mode: %s.", serverVersion, secretWriteMode)
 
-	if targetNamespacesStr != "" {
-		log.Printf("TARGET_NAMESPACES is set: '%s'. Processing only these namespaces.", targetNamespacesStr)
-		namespacesToProcess = strings.Split(targetNamespacesStr, ",")
-		for i, ns := range namespacesToProcess {
-			namespacesToProcess[i] = strings.TrimSpace(ns)
+	if cfg.PreflightRBAC && cfg.Namespaces.listsCluster() {
+		if err := runPreflightRBACCheck(ctx, kubeClient, namespaceListChecks()); err != nil {
+			fatalf("Preflight RBAC check failed: %v", err)
 		}
-		var nonEmptyNamespaces []string
-		for _, ns := range namespacesToProcess {
-			if ns != "" {
-				nonEmptyNamespaces = append(nonEmptyNamespaces, ns)
-			}
+	}
+	namespaces, err := resolveNamespaces(ctx, kubeClient, cfg.Namespaces)
+	if err == nil {
+		namespaces, err = loadNamespaceMetadata(ctx, kubeClient, namespaces, namespaceLoadOptions{
+			RequireExist:  cfg.RequireNamespacesExist,
+			CreateMissing: cfg.CreateMissingNamespaces,
+			FieldManager:  cfg.FieldManager,
+		})
+	}
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			log.Printf("Shutdown signal received, namespace discovery interrupted.")
+			report.finish(runInterrupted, "shutdown signal received during namespace discovery")
+			os.Exit(exitInterrupted)
+		} else if ctx.Err() == context.DeadlineExceeded {
+			fatalf("Run deadline exceeded while discovering namespaces: %v", err)
 		}
-		namespacesToProcess = nonEmptyNamespaces
-		if len(namespacesToProcess) == 0 {
-			log.Println("TARGET_NAMESPACES was set but resulted in an empty list after parsing. No namespaces to process.")
-		}
-	} else {
-		log.Println("TARGET_NAMESPACES is not set or is empty. Attempting to list all namespaces in the cluster.")
-		listCtx, listCancel := context.WithTimeout(ctx, k8sListNamespaceTimeout)
-		defer listCancel()
-		namespacesFromCluster, listErr := listNamespaces(listCtx, kubeClient)
-		if listErr != nil {
-			if listCtx.Err() == context.DeadlineExceeded {
-				log.Fatalf("Error listing all namespaces: timeout after %v: %v", k8sListNamespaceTimeout, listErr)
-			} else if ctx.Err() == context.Canceled {
-				log.Printf("Shutdown signal received, namespace listing interrupted.")
-				return
-			}
-			log.Fatalf("Error listing all namespaces: %v", listErr)
+		fatalf("Error discovering namespaces: %v", err)
+	}
+	namespaces = filterDisabledNamespaces(namespaces)
+	if cfg.RequireNamespaceOptIn {
+		namespaces = filterOptedInNamespaces(namespaces)
+	}
+	if cfg.SortNamespaces {
+		sortNamespaces(namespaces)
+	}
+	prioritizeNamespaces(namespaces)
+	// Namespaces whose secret name cannot be rendered fail on their own; the
+	// rest are still processed.
+	var secretNames map[string]string
+	var nameFailures []error
+	if cfg.SecretNameTemplate != nil {
+		secretNames, namespaces, nameFailures = namespaceSecretNames(namespaces, cfg.SecretNameTemplate)
+		for _, failure := range nameFailures {
+			log.Printf("Error computing the secret name from K8S_SECRET_NAME_TEMPLATE: %v. Continuing with remaining namespaces.", failure)
 		}
-		listCancel()
-		namespacesToProcess = namespacesFromCluster
 	}
+	if cfg.OnlyUsedNamespaces {
+		namespaces = filterUsedNamespaces(ctx, kubeClient, namespaces, cfg.SecretName, secretNames)
+	}
+	namespacesToProcess := namespaceNames(namespaces)
 
 	if len(namespacesToProcess) == 0 {
+		if len(nameFailures) > 0 {
+			fatalf("No namespace has a valid secret name: %v", errors.Join(nameFailures...))
+		}
 		log.Println("No namespaces identified for processing. Exiting.")
+		report.finish(runSucceeded, "")
 		return
 	}
 	log.Printf("Found %d namespaces to process: %v", len(namespacesToProcess), namespacesToProcess)
 
-	if err := processSecretsInNamespaces(ctx, kubeClient, namespacesToProcess, k8sSecretName, k8sSecretKey, accessToken); err != nil {
-		log.Printf("Processing namespaces finished with error/signal: %v", err)
-		return
+	if cfg.PreflightRBAC && cfg.DistributionMode == distributionReference {
+		checks := secretAccessChecks([]string{cfg.CentralSecretNamespace}, cfg.SecretName, nil, cfg.recreatesSecrets())
+		checks = append(checks, referenceAccessChecks(namespacesToProcess, cfg.ReferenceConfigMapName)...)
+		if err := runPreflightRBACCheck(ctx, kubeClient, checks); err != nil {
+			fatalf("Preflight RBAC check failed: %v", err)
+		}
+	} else if cfg.PreflightRBAC {
+		checks := targetAccessChecks(clusterResource(cfg.OutputModes), namespacesToProcess, cfg.SecretName, secretNames, cfg.recreatesSecrets())
+		if err := runPreflightRBACCheck(ctx, kubeClient, checks); err != nil {
+			fatalf("Preflight RBAC check failed: %v", err)
+		}
+	}
+
+	assignments := map[string][]string{defaultGroupName: namespacesToProcess}
+	if len(cfg.NamespaceGroups) > 0 {
+		assignments = assignNamespacesToGroups(namespaces, cfg.NamespaceGroups, cfg.DefaultNamespaceGroup)
+	}
+
+	assignedCount := 0
+	for _, namespaces := range assignments {
+		assignedCount += len(namespaces)
+	}
+	progress := newProgressLogger(cfg.ProgressLogInterval, assignedCount)
+	timeouts := namespaceSecretOpTimeouts(namespaces, cfg.SecretOpTimeout)
+	var tokenKeys map[string]string
+	if cfg.SecretTemplate.Type == corev1.SecretTypeOpaque {
+		reserved := append(append([]string{cfg.ClaimsKey}, cfg.CleanupKeys...), cfg.MetadataKeys.keys()...)
+		tokenKeys = namespaceSecretKeys(namespaces, reserved)
+	}
+	batches := newNamespaceBatcher(cfg.NamespaceBatchSize, cfg.BatchPause)
+	if cfg.NamespaceBatchSize > 0 {
+		log.Printf("NAMESPACE_BATCH_SIZE is set: pausing %v after every %d namespaces.", cfg.BatchPause, cfg.NamespaceBatchSize)
+	}
+	refreshBefore := refreshWindow(cfg.RefreshBeforeExpiry, cfg.ForceRefresh)
+
+	var summary processSummary
+	var processErr error
+	for _, failure := range nameFailures {
+		var distErr *DistributionError
+		if errors.As(failure, &distErr) {
+			summary.merge(processSummary{Total: 1, Failed: []string{distErr.Namespace}})
+		}
+		processErr = errors.Join(processErr, failure)
+	}
+	for _, group := range groups {
+		namespaces := assignments[group.Name]
+		if len(namespaces) == 0 {
+			continue
+		}
+		if tokenErr := tokenErrByGroup[group.Name]; tokenErr != nil {
+			log.Printf("Skipping %d namespace(s) of namespace group '%s': no token.", len(namespaces), group.Name)
+			summary.merge(processSummary{Total: len(namespaces), Failed: namespaces})
+			for range namespaces {
+				progress.record(true)
+			}
+			processErr = errors.Join(processErr, fmt.Errorf("namespace group '%s': %w", group.Name, tokenErr))
+			continue
+		}
+		if len(cfg.NamespaceGroups) > 0 {
+			log.Printf("Distributing token for namespace group '%s' to %d namespace(s).", group.Name, len(namespaces))
+		}
+		spec := secretSpec{
+			Name:                   cfg.SecretName,
+			Type:                   cfg.SecretTemplate.Type,
+			Data:                   secretDataByGroup[group.Name],
+			FieldManager:           cfg.FieldManager,
+			AllowImmutableRecreate: cfg.AllowImmutableRecreate,
+			Immutable:              cfg.SecretImmutable,
+			ExpiresAt:              expiresAtByGroup[group.Name],
+			RefreshBefore:          refreshBefore,
+			ClockSkew:              cfg.ClockSkew,
+			Clock:                  runClock,
+			Checksum:               checksumByGroup[group.Name],
+			VerifyAfterWrite:       cfg.VerifyAfterWrite,
+			Rotation:               rotationByGroup[group.Name],
+			CleanupKeys:            cfg.CleanupKeys,
+			SkipOverQuota:          cfg.OnQuotaExceeded == quotaPolicySkip,
+			RestartConsumers:       cfg.RestartConsumers,
+			TokenKey:               cfg.SecretTemplate.TokenKey,
+			TokenKeys:              tokenKeys,
+			Names:                  secretNames,
+			ConfigMap:              slices.Contains(cfg.OutputModes, outputConfigMap),
+		}
+		if cfg.DistributionMode == distributionReference {
+			reference, err := writeCentralSecret(ctx, kubeClient, cfg, spec)
+			if err != nil {
+				fatalf("Error writing central secret: %v", err)
+			}
+			spec.Reference = reference
+		}
+		groupSummary, err := processSecretsInNamespaces(ctx, kubeClient, namespaces, spec, timeouts, batches, progress)
+		summary.merge(groupSummary)
+		if err != nil {
+			processErr = errors.Join(processErr, err)
+			if groupSummary.Interrupted != nil || groupSummary.Aborted != nil {
+				break
+			}
+		}
+	}
+	report.recordNamespaces(groups, assignments, len(cfg.NamespaceGroups) > 0, summary, processErr, tokenErrByGroup)
+	log.Println(summary)
+	if processErr != nil {
+		if errors.Is(summary.Interrupted, context.DeadlineExceeded) {
+			fatalf("Run deadline exceeded before all namespaces were processed: %v", processErr)
+		} else if summary.Interrupted != nil {
+			log.Printf("Processing namespaces interrupted by signal: %v", processErr)
+			report.finish(runInterrupted, processErr.Error())
+			return
+		} else if summary.Aborted != nil {
+			fatalf("Processing namespaces stopped after an unexpected error: %v", processErr)
+		}
+		fatalf("Processing namespaces finished with errors: %v", processErr)
+	}
+	if sinkErr != nil {
+		fatalf("Writing the token to outputs failed: %v", sinkErr)
 	}
 
+	if cfg.StatusSecretNamespace != "" {
+		statusCtx, statusCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+		if err := recordLastSuccess(statusCtx, kubeClient, cfg.StatusSecretNamespace, cfg.StatusSecretName, cfg.FieldManager, runClock.Now()); err != nil {
+			log.Printf("Warning: failed to record last successful run: %v", err)
+		} else {
+			log.Printf("Recorded last successful run on secret '%s' in namespace '%s'.", cfg.StatusSecretName, cfg.StatusSecretNamespace)
+		}
+		statusCancel()
+	}
+
+	report.finish(runSucceeded, "")
 	log.Println("OIDC JWT Fetcher CronJob finished successfully.")
 }
 
-func getEnvOrDie(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Environment variable %s not set", key)
+// waitForTokenPropagation waits delay between fetching the token and
+// distributing it, for IdPs whose tokens take a moment to be accepted
+// everywhere. It returns ctx's error if ctx is done first.
+func waitForTokenPropagation(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
 	}
-	return value
+	log.Printf("TOKEN_PROPAGATION_DELAY is set: waiting %v before distributing the token.", delay)
+	return sleepContext(ctx, delay)
 }
 
-func getEnv(key, defaultValue string) string {
-	value, ok := os.LookupEnv(key)
-	if !ok {
-		return defaultValue
+// checkTokenType enforces, when requireBearer is set, that the IdP issued a
+// Bearer token. The comparison is case-insensitive as per RFC 6749.
+func checkTokenType(tokenType string, requireBearer bool) error {
+	if requireBearer && !strings.EqualFold(tokenType, "Bearer") {
+		return fmt.Errorf("OIDC_REQUIRE_BEARER is set but the token endpoint returned token_type '%s'", tokenType)
 	}
-	return value
+	return nil
 }
 
-func fetchOIDCToken(tokenURL, clientID, clientSecret, scopes string) (accessToken string, err error) {
+// buildSecretData assembles the data written into each target secret for a
+// token: the token itself plus, if configured, its metadata and decoded
+// claims, so one write updates them together. The size limit is checked per
+// secret by checkSecretSize, once the keys already in it are known.
+func buildSecretData(cfg *config, token *parsedToken, expiresAt time.Time) (map[string][]byte, error) {
+	value := token.Raw
+	if cfg.SecretEncoding == secretEncodingBase64 {
+		// The API base64-encodes data values on the wire as always, so
+		// consumers reading the key see this base64 string, not the token.
+		value = base64.StdEncoding.EncodeToString([]byte(token.Raw))
+	}
+	secretData := cfg.SecretTemplate.data(value)
+	for key, value := range cfg.MetadataKeys.data(token, expiresAt) {
+		secretData[key] = value
+	}
+	if cfg.ClaimsKey != "" {
+		claims, err := token.Payload()
+		if err != nil {
+			log.Printf("WRITE_CLAIMS_KEY is set but token claims could not be decoded (%v). Skipping claims key.", err)
+		} else if claims, err = encodeStoredClaims(claims, cfg.ClaimsAllowlist, cfg.ClaimsPretty, cfg.ClaimsGzip); err != nil {
+			return nil, err
+		} else {
+			secretData[cfg.ClaimsKey] = claims
+			log.Printf("Token claims will be written under secret key '%s'.", cfg.ClaimsKey)
+		}
+	}
+
+	return secretData, nil
+}
+
+func logClaims(token *parsedToken) {
+	claims, err := token.Payload()
+	if err != nil {
+		log.Printf("LOG_TOKEN_CLAIMS is set but token claims could not be decoded: %v", err)
+		return
+	}
+	formatted, err := formatLoggableClaims(claims)
+	if err != nil {
+		log.Printf("LOG_TOKEN_CLAIMS is set but token claims could not be formatted: %v", err)
+		return
+	}
+	log.Printf("Token claims: %s", formatted)
+}
+
+// writeCentralSecret writes the token secret into CENTRAL_SECRET_NAMESPACE
+// for DISTRIBUTION_MODE=reference and returns the reference target
+// namespaces receive. Without the central secret there is nothing to
+// reference, so the caller ends the run on any error.
+func writeCentralSecret(ctx context.Context, kubeClient kubernetes.Interface, cfg *config, spec secretSpec) (*secretReference, error) {
+	centralCtx, centralCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+	defer centralCancel()
+	operation, err := createOrUpdateSecret(centralCtx, kubeClient, cfg.CentralSecretNamespace, spec)
+	if err != nil {
+		return nil, fmt.Errorf("secret '%s' in namespace '%s': %w", spec.Name, cfg.CentralSecretNamespace, err)
+	}
+	log.Printf("Central secret '%s' in namespace '%s' %s.", spec.Name, cfg.CentralSecretNamespace, operation)
+	return &secretReference{
+		ConfigMapName: cfg.ReferenceConfigMapName,
+		Namespace:     cfg.CentralSecretNamespace,
+		SecretName:    spec.Name,
+		SecretKey:     spec.TokenKey,
+	}, nil
+}
+
+func runPreflightRBACCheck(ctx context.Context, kubeClient kubernetes.Interface, checks []accessCheck) error {
+	log.Printf("Running preflight RBAC check (%d access reviews)...", len(checks))
+	preflightCtx, preflightCancel := context.WithTimeout(ctx, k8sPreflightTimeout)
+	defer preflightCancel()
+	if err := preflightRBACCheck(preflightCtx, kubeClient, checks); err != nil {
+		return err
+	}
+	log.Println("Preflight RBAC check passed.")
+	return nil
+}
+
+// setLogRunID tags every following log line with the run ID, as a run_id
+// field after the timestamp.
+func setLogRunID(runID string) {
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	log.SetPrefix("run_id=" + runID + " ")
+}
+
+func defaultUserAgent() string {
+	return "oidc-jwt-fetcher/" + version
+}
+
+// tokenTransportOptions tunes connection reuse for the token endpoint.
+type tokenTransportOptions struct {
+	DisableHTTP2        bool
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// newTokenHTTPClient builds the token endpoint client. Connections are kept
+// alive and reused, over HTTP/2 where the server offers it unless
+// opts.DisableHTTP2 is set.
+func newTokenHTTPClient(tlsConfig *tls.Config, opts tokenTransportOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	if opts.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto keeps the transport from negotiating h2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Timeout:   defaultTokenTimeout,
+		Transport: transport,
+	}
+}
+
+// tokenRequest holds the parameters of a client credentials token request.
+// The OAuth client credentials always travel in the form body; the gateway
+// Basic credentials are only for an HTTP gateway in front of the endpoint.
+type tokenRequest struct {
+	// URLs are tried in order until one returns a token.
+	URLs         []string
+	ClientID     string
+	ClientSecret string
+	AuthMethod   string
+	Scopes       string
+	Audience     string
+	UserAgent    string
+	Accept       string
+	ContentType  string
+	RunID        string
+
+	// TokenPath locates the access token in the response; nil means
+	// access_token. ExpiresPath locates an optional absolute expiry; when
+	// ExpiresPathDefault is set it is only the default expires_at field, and
+	// a value there that cannot be parsed falls back to expires_in.
+	TokenPath          *responsePath
+	ExpiresPath        *responsePath
+	ExpiresPathDefault bool
+
+	GatewayBasicUser     string
+	GatewayBasicPassword string
+
+	// SubjectToken, when set, turns the request into a token exchange of a
+	// GitHub Actions id-token.
+	SubjectToken *githubActionsIDToken
+
+	// CredentialHelper, when set, is run instead of contacting a token
+	// endpoint.
+	CredentialHelper *credentialHelper
+
+	// MaxResponseBytes bounds the decoded size of a token response.
+	MaxResponseBytes int
+
+	// Clock dates client assertions and token expiries; nil means the
+	// system clock.
+	Clock clock
+}
+
+func (r tokenRequest) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// fetchOIDCToken requests a token from each of tokenReq.URLs in turn, failing
+// over to the next one when an endpoint still fails after tokenRetryPolicy,
+// and returns the first token obtained. If every endpoint fails, their errors are returned together.
+// A configured credential helper is run once instead.
+func fetchOIDCToken(ctx context.Context, client *http.Client, tokenReq tokenRequest) (*OIDCTokenResponse, error) {
+	if tokenReq.CredentialHelper != nil {
+		return tokenReq.CredentialHelper.fetch(ctx, tokenReq)
+	}
+	var errs []error
+	for i, tokenURL := range tokenReq.URLs {
+		var tokenResponse *OIDCTokenResponse
+		policy := tokenRetryPolicy
+		policy.Name = "token request to " + tokenURL
+		err := retryWithBackoff(ctx, policy, func() (err error) {
+			tokenResponse, err = fetchOIDCTokenFrom(ctx, client, tokenURL, tokenReq)
+			return err
+		})
+		if err == nil {
+			tokenResponse.TokenURL = tokenURL
+			return tokenResponse, nil
+		}
+		if ctx.Err() != nil {
+			// Shutting down: failing over would only start another request.
+			return nil, fmt.Errorf("token request interrupted: %w", ctx.Err())
+		}
+		if len(tokenReq.URLs) == 1 {
+			return nil, err
+		}
+		if errors.Is(err, errInvalidClient) {
+			// Every endpoint is given the same credentials.
+			return nil, fmt.Errorf("%s: %w", tokenURL, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", tokenURL, err))
+		if i+1 < len(tokenReq.URLs) {
+			log.Printf("Token endpoint %s failed: %v. Failing over to %s...", tokenURL, err, tokenReq.URLs[i+1])
+		}
+	}
+	return nil, fmt.Errorf("all %d token endpoints failed: %w", len(tokenReq.URLs), errors.Join(errs...))
+}
+
+// fetchOIDCTokenFrom requests a token from a single endpoint. Every error is
+// returned as a *TokenFetchError.
+func fetchOIDCTokenFrom(ctx context.Context, client *http.Client, tokenURL string, tokenReq tokenRequest) (tokenResponse *OIDCTokenResponse, err error) {
+	statusCode := 0
+	var retryAfter time.Duration
+	defer func() {
+		if err != nil {
+			err = &TokenFetchError{URL: tokenURL, StatusCode: statusCode, RetryAfter: retryAfter, Err: err}
+		}
+	}()
+
 	data := url.Values{}
-	data.Set("grant_type", "client_credentials")
-	data.Set("client_id", clientID)
-	data.Set("client_secret", clientSecret)
-	data.Set("scope", scopes)
+	data.Set("grant_type", grantTypeClientCredentials)
+	if tokenReq.SubjectToken != nil {
+		subjectToken, err := tokenReq.SubjectToken.fetch(ctx, client, tokenReq.MaxResponseBytes)
+		if err != nil {
+			return nil, err
+		}
+		data.Set("grant_type", grantTypeTokenExchange)
+		data.Set("subject_token", subjectToken)
+		data.Set("subject_token_type", tokenTypeJWT)
+	}
+	data.Set("client_id", tokenReq.ClientID)
+	switch {
+	case tokenReq.ClientSecret == "":
+		// Public client: the subject token is the only credential.
+	case tokenReq.AuthMethod == authMethodClientSecretJWT:
+		// A fresh assertion per request, since each one carries a unique jti.
+		assertion, err := buildClientAssertion(hmacSigner{secret: []byte(tokenReq.ClientSecret)}, tokenReq.ClientID, tokenURL, tokenReq.now())
+		if err != nil {
+			return nil, err
+		}
+		data.Set("client_assertion_type", clientAssertionType)
+		data.Set("client_assertion", assertion)
+	default:
+		data.Set("client_secret", tokenReq.ClientSecret)
+	}
+	data.Set("scope", tokenReq.Scopes)
+	if tokenReq.Audience != "" {
+		data.Set("audience", tokenReq.Audience)
+	}
 
-	client := &http.Client{Timeout: defaultTokenTimeout}
-	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", tokenReq.ContentType)
+	req.Header.Set("Accept", tokenReq.Accept)
+	req.Header.Set("User-Agent", tokenReq.UserAgent)
+	if tokenReq.RunID != "" {
+		req.Header.Set(runIDHeader, tokenReq.RunID)
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if tokenReq.GatewayBasicUser != "" {
+		req.SetBasicAuth(tokenReq.GatewayBasicUser, tokenReq.GatewayBasicPassword)
+	}
+	// Setting Accept-Encoding disables the transport's transparent gzip
+	// handling, so decodeResponseBody handles both encodings we advertise.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer func() {
 		if closeErr := resp.Body.Close(); closeErr != nil {
@@ -161,27 +802,156 @@ func fetchOIDCToken(tokenURL, clientID, clientSecret, scopes string) (accessToke
 		}
 	}()
 
+	statusCode = resp.StatusCode
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch token, status code: %d", resp.StatusCode)
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), tokenReq.now()); ok && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			retryAfter = delay
+		}
+		var oauthErr oauthErrorResponse
+		if body, err := decodeResponseBody(resp); err == nil {
+			if rawError, err := readLimited(body, tokenReq.MaxResponseBytes); err == nil {
+				oauthErr = parseOAuthError(rawError)
+			}
+		}
+		if resp.StatusCode == http.StatusUnauthorized || oauthErr.Code == "invalid_client" {
+			return nil, fmt.Errorf("%w (status code: %d%s); check OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_AUTH_METHOD", errInvalidClient, resp.StatusCode, oauthErr.detail())
+		}
+		return nil, fmt.Errorf("failed to fetch token, status code: %d%s", resp.StatusCode, oauthErr.detail())
+	}
+
+	body, err := decodeResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
 	}
 
-	var tokenResponse OIDCTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		return "", fmt.Errorf("failed to decode token response: %w", err)
+	rawResponse, err := readLimited(body, tokenReq.MaxResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+	return decodeTokenResponse(rawResponse, tokenReq, tokenReq.now())
+}
+
+// decodeTokenResponse extracts the access token and its expiry from a token
+// response body, honouring the request's TokenPath and ExpiresPath.
+func decodeTokenResponse(rawResponse []byte, tokenReq tokenRequest, now time.Time) (*OIDCTokenResponse, error) {
+	tokenResponse := &OIDCTokenResponse{}
+	if err := json.Unmarshal(rawResponse, tokenResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	var document interface{}
+	if err := json.Unmarshal(rawResponse, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
 	}
 
+	if tokenReq.TokenPath != nil {
+		value, ok, err := tokenReq.TokenPath.find(document)
+		if err != nil {
+			return nil, err
+		}
+		tokenResponse.AccessToken = ""
+		if ok {
+			if err := json.Unmarshal(value, &tokenResponse.AccessToken); err != nil {
+				return nil, fmt.Errorf("value at '%s' in token response is not a string", tokenReq.TokenPath)
+			}
+		}
+	}
 	if tokenResponse.AccessToken == "" {
-		return "", fmt.Errorf("access token not found in response")
+		return nil, fmt.Errorf("access token not found in response")
 	}
 
-	return tokenResponse.AccessToken, nil
+	var err error
+	tokenResponse.ExpiresAt, err = tokenExpiry(document, tokenReq.ExpiresPath, tokenResponse.ExpiresIn, now)
+	if err != nil && tokenReq.ExpiresPathDefault {
+		log.Printf("Warning: ignoring %v, using expires_in instead. Set OIDC_EXPIRES_AT_FIELD to make this an error.", err)
+		tokenResponse.ExpiresAt, err = tokenExpiry(document, nil, tokenResponse.ExpiresIn, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse, nil
 }
 
-func getKubeClient() (kubernetes.Interface, error) {
-	config, err := rest.InClusterConfig()
+// readLimited reads r to the end, failing instead of buffering more than limit
+// bytes, so a huge or endless response cannot exhaust memory.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	content, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
 	if err != nil {
+		return nil, err
+	}
+	if len(content) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes (OIDC_MAX_RESPONSE_BYTES)", limit)
+	}
+	return content, nil
+}
+
+// decodeResponseBody unwraps a gzip or deflate Content-Encoding. Some servers
+// send raw DEFLATE data instead of the zlib stream the spec requires, so both
+// are accepted for deflate.
+func decodeResponseBody(resp *http.Response) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		buffered := bufio.NewReader(resp.Body)
+		header, err := buffered.Peek(2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deflate header: %w", err)
+		}
+		if isZlibHeader(header) {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%s'", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// kubeConnection holds an explicitly configured API server for running
+// outside a cluster without a kubeconfig file.
+type kubeConnection struct {
+	APIServer     string
+	BearerToken   string `redact:"true"`
+	CAFile        string
+	TLSMinVersion uint16
+	// ImpersonateUser and ImpersonateGroups, when set, make every API call
+	// act as that user, on whichever connection is used.
+	ImpersonateUser   string
+	ImpersonateGroups []string
+}
+
+// getKubeClient prefers the in-cluster service account, then an explicit API
+// server and bearer token, and finally the local kubeconfig.
+func getKubeClient(conn kubeConnection) (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	switch {
+	case err == nil:
+	case conn.APIServer != "":
+		log.Printf("Not in cluster, using API server %s from K8S_API_SERVER", conn.APIServer)
+		config, err = explicitKubeConfig(conn)
+		if err != nil {
+			return nil, err
+		}
+	default:
 		log.Println("Not in cluster, attempting to use local kubeconfig")
-		return nil, fmt.Errorf("failed to get in-cluster config: %w. For local dev, ensure KUBECONFIG is set or run within a cluster", err)
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %w. Run within a cluster, set K8S_API_SERVER and K8S_BEARER_TOKEN, or set KUBECONFIG", err)
+		}
+	}
+	if conn.ImpersonateUser != "" {
+		log.Printf("Impersonating user '%s' for Kubernetes API calls", conn.ImpersonateUser)
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: conn.ImpersonateUser,
+			Groups:   conn.ImpersonateGroups,
+		}
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
@@ -191,93 +961,617 @@ func getKubeClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
-func listNamespaces(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
-	namespaceList, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+// explicitKubeConfig builds a rest config for K8S_API_SERVER. rest.Config has
+// no TLS version setting, so the TLS config it would build is created here
+// with the minimum version applied and handed over as a custom transport.
+func explicitKubeConfig(conn kubeConnection) (*rest.Config, error) {
+	config := &rest.Config{
+		Host:            conn.APIServer,
+		BearerToken:     conn.BearerToken,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: conn.CAFile},
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		return nil, fmt.Errorf("failed to build TLS config for K8S_API_SERVER: %w", err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.MinVersion = conn.TLSMinVersion
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	config.Transport = transport
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	return config, nil
+}
+
+// namespaceListPageSize bounds each page of the namespace list, so a large
+// cluster is listed in several smaller requests.
+const namespaceListPageSize = 500
+
+// listNamespaces lists namespaces page by page, following the continue token.
+// If a page after the first fails, the error says how far the list got; with
+// toleratePartial, the namespaces retrieved so far are returned instead, with
+// a warning.
+func listNamespaces(ctx context.Context, clientset kubernetes.Interface, opts metav1.ListOptions, toleratePartial bool) ([]corev1.Namespace, error) {
+	opts.Limit = namespaceListPageSize
+	var namespaces []corev1.Namespace
+	for page := 1; ; page++ {
+		var namespaceList *corev1.NamespaceList
+		err := retryKubeCall(ctx, "namespace list", func() (err error) {
+			namespaceList, err = clientset.CoreV1().Namespaces().List(ctx, opts)
+			return err
+		})
+		if err != nil && page == 1 {
+			return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		}
+		if err != nil {
+			if apierrors.IsResourceExpired(err) {
+				err = fmt.Errorf("the list changed too much while it was being paginated: %w", err)
+			}
+			if toleratePartial && ctx.Err() == nil {
+				log.Printf("Warning: namespace list failed on page %d after %d namespaces: %v. TOLERATE_PARTIAL_LIST is set: continuing with the namespaces retrieved.", page, len(namespaces), err)
+				return namespaces, nil
+			}
+			return nil, fmt.Errorf("namespace list failed on page %d after %d namespaces (set TOLERATE_PARTIAL_LIST=true to continue with them): %w", page, len(namespaces), err)
+		}
+		namespaces = append(namespaces, namespaceList.Items...)
+		if namespaceList.Continue == "" {
+			return namespaces, nil
+		}
+		opts.Continue = namespaceList.Continue
+	}
+}
+
+// secretOperation records what a successful write did to the secret.
+type secretOperation string
+
+const (
+	secretCreated   secretOperation = "created"
+	secretUpdated   secretOperation = "updated"
+	secretRecreated secretOperation = "recreated"
+	secretUnchanged secretOperation = "unchanged"
+	// secretRewritten is an update that left the data as it was, e.g. one
+	// that only refreshed the annotations.
+	secretRewritten secretOperation = "updated (data unchanged)"
+	secretFresh     secretOperation = "left as is (token not near expiry)"
+)
+
+// errImmutableSecret reports that the target secret is immutable and may not
+// be replaced.
+var errImmutableSecret = errors.New("secret is immutable")
+
+// errVerificationFailed reports that a secret read back after a write does
+// not hold the data that was written.
+var errVerificationFailed = errors.New("secret verification failed")
+
+// errSecretTypeMismatch reports that the target secret exists with a type
+// other than the one SECRET_TEMPLATE asks for. A secret's type cannot be changed.
+var errSecretTypeMismatch = errors.New("secret has a different type")
+
+// Policies accepted by ON_QUOTA_EXCEEDED.
+const (
+	quotaPolicyFail = "fail"
+	quotaPolicySkip = "skip"
+)
+
+// isQuotaExceeded reports whether err is the API server rejecting a write
+// because the namespace has used up a ResourceQuota.
+func isQuotaExceeded(err error) bool {
+	return apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
+
+// secretSpec describes the secret written into every target namespace.
+type secretSpec struct {
+	Name                   string
+	Type                   corev1.SecretType
+	Data                   map[string][]byte
+	FieldManager           string
+	AllowImmutableRecreate bool
+	// Immutable marks written secrets immutable; they are then recreated
+	// whenever the token rotates.
+	Immutable bool
+
+	// ExpiresAt is recorded in expiresAtAnnotation; zero removes the annotation.
+	ExpiresAt time.Time
+	// RefreshBefore, when positive, skips secrets whose recorded expiry is
+	// further away than this, plus ClockSkew.
+	RefreshBefore time.Duration
+	ClockSkew     time.Duration
+	// Clock is compared against ExpiresAt recorded on existing secrets; nil
+	// means the system clock.
+	Clock clock
+	// Checksum is recorded in checksumAnnotation; empty removes the annotation.
+	Checksum string
+	// VerifyAfterWrite re-reads the secret after each write and checks its data.
+	VerifyAfterWrite bool
+	// Rotation is recorded in the rotation annotations; nil removes them.
+	Rotation *rotationMetadata
+	// CleanupKeys are stale data keys removed from the secret on write.
+	CleanupKeys []string
+	// RestartConsumers rolls the Deployments that reference the secret when
+	// its data changed.
+	RestartConsumers bool
+	// SkipOverQuota skips namespaces whose secret quota is exhausted instead
+	// of failing them.
+	SkipOverQuota bool
+	// TokenKey is the key of Data holding the token. TokenKeys maps
+	// namespaces to the key they asked for instead.
+	TokenKey  string
+	TokenKeys map[string]string
+	// Names maps namespaces to the secret name rendered from
+	// K8S_SECRET_NAME_TEMPLATE, overriding Name.
+	Names map[string]string
+	// Reference, when set, makes target namespaces receive a ConfigMap
+	// pointing at the central secret instead of a copy of the secret.
+	Reference *secretReference
+	// ConfigMap writes the data to a ConfigMap named like the secret
+	// instead, for OUTPUT_MODE=configmap.
+	ConfigMap bool
+}
+
+func (s secretSpec) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// forNamespace returns the spec for one namespace, with its own secret name
+// and the token moved to the key that namespace asked for, if any.
+func (s secretSpec) forNamespace(namespace string) secretSpec {
+	if name, ok := s.Names[namespace]; ok {
+		s.Name = name
+	}
+	key, ok := s.TokenKeys[namespace]
+	if !ok || key == s.TokenKey {
+		return s
+	}
+	data := make(map[string][]byte, len(s.Data))
+	for k, v := range s.Data {
+		data[k] = v
+	}
+	data[key] = data[s.TokenKey]
+	delete(data, s.TokenKey)
+	s.Data = data
+	return s
+}
+
+// hasStaleKeys reports whether data still holds any of spec.CleanupKeys.
+func (s secretSpec) hasStaleKeys(data map[string][]byte) bool {
+	for _, key := range s.CleanupKeys {
+		if _, ok := data[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// annotations returns the annotations the tool manages on target secrets. A
+// nil value means the annotation should be removed.
+func (s secretSpec) annotations() map[string]*string {
+	annotations := map[string]*string{
+		expiresAtAnnotation: nil,
+		checksumAnnotation:  nil,
+	}
+	if !s.ExpiresAt.IsZero() {
+		expiresAt := s.ExpiresAt.UTC().Format(time.RFC3339)
+		annotations[expiresAtAnnotation] = &expiresAt
+	}
+	if s.Checksum != "" {
+		checksum := s.Checksum
+		annotations[checksumAnnotation] = &checksum
+	}
+	for key, value := range s.Rotation.annotations() {
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// applyAnnotations returns a copy of existing with the managed annotations
+// set or removed.
+func applyAnnotations(existing map[string]string, managed map[string]*string) map[string]string {
+	annotations := make(map[string]string, len(existing)+len(managed))
+	for key, value := range existing {
+		annotations[key] = value
 	}
+	for key, value := range managed {
+		if value == nil {
+			delete(annotations, key)
+		} else {
+			annotations[key] = *value
+		}
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
 
-	names := make([]string, 0, len(namespaceList.Items))
-	for _, ns := range namespaceList.Items {
-		names = append(names, ns.Name)
+// createOrUpdateSecret writes spec.Data into the secret named spec.Name. The patch is
+// guarded by the resourceVersion observed on Get, so a concurrent edit causes a
+// conflict; in that case (or if the secret appears between Get and Create) the
+// secret is re-read and the write retried.
+func createOrUpdateSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, spec secretSpec) (secretOperation, error) {
+	var operation secretOperation
+	policy := secretConflictPolicy
+	policy.Name = fmt.Sprintf("write of secret '%s' in namespace '%s'", spec.Name, namespace)
+	err := retryWithBackoff(ctx, policy, func() (err error) {
+		operation, err = writeSecret(ctx, clientset, namespace, spec)
+		return err
+	})
+	if err != nil || !spec.VerifyAfterWrite || operation == secretUnchanged || operation == secretFresh {
+		return operation, err
 	}
-	return names, nil
+	return operation, verifySecret(ctx, clientset, namespace, spec)
+}
+
+// verifySecret re-reads the secret and checks that it holds spec.Data,
+// guarding against writes the API server acknowledged but did not persist.
+func verifySecret(ctx context.Context, clientset kubernetes.Interface, namespace string, spec secretSpec) error {
+	var written *corev1.Secret
+	err := retryKubeCall(ctx, "secret verify", func() (err error) {
+		written, err = clientset.CoreV1().Secrets(namespace).Get(ctx, spec.Name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read back secret '%s' in namespace '%s' for verification: %w", spec.Name, namespace, err)
+	}
+	if !secretDataContains(written.Data, spec.Data) {
+		return fmt.Errorf("%w: secret '%s' in namespace '%s' does not hold the value just written", errVerificationFailed, spec.Name, namespace)
+	}
+	return nil
 }
 
-func createOrUpdateSecret(ctx context.Context, clientset kubernetes.Interface, namespace, secretName, secretKey, token string) error {
+func isSecretWriteConflict(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+}
+
+// writeSecret writes spec.Data without disturbing keys it does not manage:
+// an existing secret is merge-patched, a secret that appears between Get and
+// Create is re-read and patched on the retry, and an immutable secret is
+// recreated with its other keys copied over. Only spec.CleanupKeys are removed.
+func writeSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, spec secretSpec) (secretOperation, error) {
 	secretClient := clientset.CoreV1().Secrets(namespace)
 
-	_, err := secretClient.Get(ctx, secretName, metav1.GetOptions{})
+	var existing *corev1.Secret
+	err := retryKubeCall(ctx, "secret get", func() (err error) {
+		existing, err = secretClient.Get(ctx, spec.Name, metav1.GetOptions{})
+		return err
+	})
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			log.Printf("Secret '%s' not found in namespace '%s'. Creating...", secretName, namespace)
-			secretData := map[string][]byte{
-				secretKey: []byte(token),
+		if apierrors.IsNotFound(err) {
+			if err := checkSecretSize(namespace, spec.Name, spec.Data); err != nil {
+				return "", err
 			}
 			newSecret := &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      secretName,
-					Namespace: namespace,
+					Name:        spec.Name,
+					Namespace:   namespace,
+					Annotations: applyAnnotations(nil, spec.annotations()),
 				},
-				Data: secretData,
-				Type: corev1.SecretTypeOpaque,
+				Data: spec.Data,
+				Type: spec.Type,
+			}
+			if spec.Immutable {
+				newSecret.Immutable = &spec.Immutable
 			}
-			_, createErr := secretClient.Create(ctx, newSecret, metav1.CreateOptions{})
+			createErr := retryKubeCall(ctx, "secret create", func() error {
+				_, err := secretClient.Create(ctx, newSecret, metav1.CreateOptions{FieldManager: spec.FieldManager})
+				return err
+			})
 			if createErr != nil {
-				return fmt.Errorf("failed to create secret '%s' in namespace '%s': %w", secretName, namespace, createErr)
+				if apierrors.IsForbidden(createErr) {
+					return "", forbiddenSecretError("create", namespace, spec.Name, createErr)
+				}
+				return "", fmt.Errorf("failed to create secret '%s' in namespace '%s': %w", spec.Name, namespace, createErr)
 			}
-			return nil
+			return secretCreated, nil
 		} else {
-			return fmt.Errorf("failed to get secret '%s' in namespace '%s': %w", secretName, namespace, err)
+			if apierrors.IsForbidden(err) {
+				return "", forbiddenSecretError("get", namespace, spec.Name, err)
+			}
+			return "", fmt.Errorf("failed to get secret '%s' in namespace '%s': %w", spec.Name, namespace, err)
 		}
 	}
 
-	log.Printf("Secret '%s' found in namespace '%s'. Patching...", secretName, namespace)
+	if existing.Type != spec.Type {
+		return "", fmt.Errorf("%w: secret '%s' in namespace '%s' has type '%s', expected '%s'", errSecretTypeMismatch, spec.Name, namespace, existing.Type, spec.Type)
+	}
 
+	if spec.RefreshBefore > 0 && !spec.hasStaleKeys(existing.Data) && secretIsFresh(existing, spec.Data, spec.RefreshBefore, spec.ClockSkew, spec.now()) {
+		return secretFresh, nil
+	}
+
+	if err := checkSecretSize(namespace, spec.Name, mergedSecretData(existing.Data, spec)); err != nil {
+		return "", err
+	}
+	if existing.Immutable != nil && *existing.Immutable {
+		return replaceImmutableSecret(ctx, clientset, existing, spec)
+	}
+
+	// A null value removes the key in a JSON merge patch.
+	encodedData := make(map[string]interface{}, len(spec.Data)+len(spec.CleanupKeys))
+	for _, key := range spec.CleanupKeys {
+		if _, ok := existing.Data[key]; ok {
+			encodedData[key] = nil
+		}
+	}
+	for key, value := range spec.Data {
+		encodedData[key] = base64.StdEncoding.EncodeToString(value)
+	}
 	patchPayload := map[string]interface{}{
-		"data": map[string]string{
-			secretKey: base64.StdEncoding.EncodeToString([]byte(token)),
+		"metadata": map[string]interface{}{
+			"resourceVersion": existing.ResourceVersion,
+			"annotations":     spec.annotations(),
 		},
+		"data": encodedData,
+	}
+	if spec.Immutable {
+		// Written together with the data, so the next rotation recreates it.
+		patchPayload["immutable"] = true
 	}
 	patchBytes, marshalErr := json.Marshal(patchPayload)
 	if marshalErr != nil {
-		return fmt.Errorf("failed to marshal patch payload for secret '%s' in namespace '%s': %w", secretName, namespace, marshalErr)
+		return "", fmt.Errorf("failed to marshal patch payload for secret '%s' in namespace '%s': %w", spec.Name, namespace, marshalErr)
 	}
 
-	_, patchErr := secretClient.Patch(ctx, secretName, types.MergePatchType, patchBytes, metav1.PatchOptions{})
+	patchErr := retryKubeCall(ctx, "secret patch", func() error {
+		_, err := secretClient.Patch(ctx, spec.Name, types.MergePatchType, patchBytes, metav1.PatchOptions{FieldManager: spec.FieldManager})
+		return err
+	})
 	if patchErr != nil {
-		return fmt.Errorf("failed to patch secret '%s' in namespace '%s': %w", secretName, namespace, patchErr)
+		if apierrors.IsForbidden(patchErr) {
+			return "", forbiddenSecretError("patch", namespace, spec.Name, patchErr)
+		}
+		if apierrors.IsInvalid(patchErr) && strings.Contains(patchErr.Error(), "immutable") {
+			return "", fmt.Errorf("%w: secret '%s' in namespace '%s' became immutable; set ALLOW_IMMUTABLE_RECREATE=true to replace it: %v", errImmutableSecret, spec.Name, namespace, patchErr)
+		}
+		return "", fmt.Errorf("failed to patch secret '%s' in namespace '%s': %w", spec.Name, namespace, patchErr)
 	}
 
-	return nil
+	if secretDataContains(existing.Data, spec.Data) {
+		return secretRewritten, nil
+	}
+	return secretUpdated, nil
 }
 
-func processSecretsInNamespaces(ctx context.Context, kubeClient kubernetes.Interface, namespaces []string, secretName, secretKey, accessToken string) error {
+// replaceImmutableSecret handles a target secret marked immutable. If it
+// already holds the desired data nothing is written. Otherwise it is deleted
+// and recreated with the same metadata and merged data, but only when
+// AllowImmutableRecreate or Immutable is set. The delete is guarded by UID and
+// resourceVersion preconditions and immediately followed by the create to
+// keep the window without a secret as short as possible.
+func replaceImmutableSecret(ctx context.Context, clientset kubernetes.Interface, existing *corev1.Secret, spec secretSpec) (secretOperation, error) {
+	namespace := existing.Namespace
+	if secretDataContains(existing.Data, spec.Data) && !spec.hasStaleKeys(existing.Data) {
+		return secretUnchanged, nil
+	}
+	if !spec.AllowImmutableRecreate && !spec.Immutable {
+		return "", fmt.Errorf("%w: secret '%s' in namespace '%s' is immutable and holds a different value; set ALLOW_IMMUTABLE_RECREATE=true to replace it", errImmutableSecret, spec.Name, namespace)
+	}
+
+	log.Printf("Secret '%s' in namespace '%s' is immutable. Deleting and recreating it...", spec.Name, namespace)
+	secretClient := clientset.CoreV1().Secrets(namespace)
+
+	data := mergedSecretData(existing.Data, spec)
+	replacement := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        existing.Name,
+			Namespace:   namespace,
+			Labels:      existing.Labels,
+			Annotations: applyAnnotations(existing.Annotations, spec.annotations()),
+		},
+		Data:      data,
+		Type:      existing.Type,
+		Immutable: existing.Immutable,
+	}
+
+	deleteErr := retryKubeCall(ctx, "secret delete", func() error {
+		return secretClient.Delete(ctx, spec.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{
+				UID:             &existing.UID,
+				ResourceVersion: &existing.ResourceVersion,
+			},
+		})
+	})
+	if deleteErr != nil {
+		if apierrors.IsForbidden(deleteErr) {
+			return "", forbiddenSecretError("delete", namespace, spec.Name, deleteErr)
+		}
+		return "", fmt.Errorf("failed to delete immutable secret '%s' in namespace '%s': %w", spec.Name, namespace, deleteErr)
+	}
+
+	createErr := retryKubeCall(ctx, "secret create", func() error {
+		_, err := secretClient.Create(ctx, replacement, metav1.CreateOptions{FieldManager: spec.FieldManager})
+		return err
+	})
+	if createErr != nil {
+		return "", fmt.Errorf("failed to recreate secret '%s' in namespace '%s' after deleting it: %w", spec.Name, namespace, createErr)
+	}
+	return secretRecreated, nil
+}
+
+// secretDataContains reports whether every key in want is present in have
+// with the same value.
+func secretDataContains(have, want map[string][]byte) bool {
+	for key, value := range want {
+		existing, ok := have[key]
+		if !ok || !bytes.Equal(existing, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// forbiddenSecretError turns an RBAC denial into an error that names the
+// namespace and the verb the service account is missing on secrets. Quota
+// rejections, which are also reported as Forbidden, are returned unchanged.
+func forbiddenSecretError(verb, namespace, secretName string, err error) error {
+	if isQuotaExceeded(err) {
+		return err
+	}
+	return fmt.Errorf("permission denied: cannot '%s' secret '%s' in namespace '%s'; grant the '%s' verb on 'secrets' in that namespace to the service account: %w", verb, secretName, namespace, verb, err)
+}
+
+// processSummary records how far processSecretsInNamespaces got, so a run
+// that is cut short can still report what it completed.
+type processSummary struct {
+	Total     int
+	Succeeded []string
+	Failed    []string
+	// Created, Updated and Skipped break down Succeeded by what was done;
+	// Skipped counts secrets left unchanged or not yet near expiry.
+	Created int
+	Updated int
+	Skipped int
+	// OverQuota lists namespaces skipped under ON_QUOTA_EXCEEDED=skip.
+	OverQuota   []string
+	Interrupted error
+	// Aborted is the error that stopped processing early because it is
+	// unlikely to be limited to one namespace, such as a timeout.
+	Aborted error
+}
+
+func (s processSummary) String() string {
+	processed := len(s.Succeeded) + len(s.Failed) + len(s.OverQuota)
+	status := "completed"
+	if errors.Is(s.Interrupted, context.DeadlineExceeded) {
+		status = "stopped early: run deadline exceeded"
+	} else if s.Interrupted != nil {
+		status = "stopped early: shutdown signal received"
+	} else if s.Aborted != nil {
+		status = "stopped early: unexpected error"
+	}
+	overQuota := ""
+	if len(s.OverQuota) > 0 {
+		overQuota = fmt.Sprintf("; %d skipped over quota", len(s.OverQuota))
+	}
+	return fmt.Sprintf("Processed %d/%d namespaces (%d succeeded: %d created, %d updated, %d skipped%s; %d failed), %s", processed, s.Total, len(s.Succeeded), s.Created, s.Updated, s.Skipped, overQuota, len(s.Failed), status)
+}
+
+// record counts a successful secret operation.
+func (s *processSummary) record(operation secretOperation) {
+	switch operation {
+	case secretCreated:
+		s.Created++
+	case secretUpdated, secretRewritten, secretRecreated:
+		s.Updated++
+	case secretUnchanged, secretFresh:
+		s.Skipped++
+	}
+}
+
+// merge folds the summary of another batch of namespaces into s.
+func (s *processSummary) merge(other processSummary) {
+	s.Total += other.Total
+	s.Succeeded = append(s.Succeeded, other.Succeeded...)
+	s.Failed = append(s.Failed, other.Failed...)
+	s.OverQuota = append(s.OverQuota, other.OverQuota...)
+	s.Created += other.Created
+	s.Updated += other.Updated
+	s.Skipped += other.Skipped
+	if other.Interrupted != nil {
+		s.Interrupted = other.Interrupted
+	}
+	if other.Aborted != nil {
+		s.Aborted = other.Aborted
+	}
+}
+
+func processSecretsInNamespaces(ctx context.Context, kubeClient kubernetes.Interface, namespaces []string, spec secretSpec, timeouts secretOpTimeouts, batches *namespaceBatcher, progress *progressLogger) (processSummary, error) {
+	summary := processSummary{Total: len(namespaces)}
+	var failures []error
 	for _, ns := range namespaces {
 		select {
 		case <-ctx.Done():
-			log.Printf("Shutdown signal received, stopping further secret operations.")
-			return ctx.Err()
+			log.Printf("Stopping further secret operations: %v", ctx.Err())
+			summary.Interrupted = ctx.Err()
+			return summary, ctx.Err()
 		default:
 		}
+		if err := batches.next(ctx); err != nil {
+			log.Printf("Stopping further secret operations: %v", err)
+			summary.Interrupted = err
+			return summary, err
+		}
 
-		log.Printf("Processing namespace: %s", ns)
-		secretOpCtx, secretOpCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+		if progress.logsEachNamespace() {
+			log.Printf("Processing namespace: %s", ns)
+		}
+		secretOpTimeout := timeouts.forNamespace(ns)
+		secretOpCtx, secretOpCancel := context.WithTimeout(ctx, secretOpTimeout)
 
-		err := createOrUpdateSecret(secretOpCtx, kubeClient, ns, secretName, secretKey, accessToken)
+		nsSpec := spec.forNamespace(ns)
+		var operation secretOperation
+		var err error
+		if spec.Reference != nil {
+			operation, err = createOrUpdateReference(secretOpCtx, kubeClient, ns, spec.Reference, spec.FieldManager)
+		} else if spec.ConfigMap {
+			operation, err = createOrUpdateTokenConfigMap(secretOpCtx, kubeClient, ns, nsSpec)
+		} else {
+			operation, err = createOrUpdateSecret(secretOpCtx, kubeClient, ns, nsSpec)
+		}
 
 		if err != nil {
 			secretOpCancel()
-			if secretOpCtx.Err() == context.DeadlineExceeded {
-				log.Fatalf("Error creating/updating secret in namespace %s: timeout after %v: %v", ns, k8sSecretOpTimeout, err)
-			} else if ctx.Err() == context.Canceled {
-				log.Printf("Shutdown signal received, secret operation in namespace %s interrupted.", ns)
-				return ctx.Err()
+			var tooLarge *SecretTooLargeError
+			if ctx.Err() != nil {
+				log.Printf("Secret operation in namespace %s interrupted: %v", ns, ctx.Err())
+				summary.Interrupted = ctx.Err()
+				return summary, ctx.Err()
+			} else if secretOpCtx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timeout after %v: %w", secretOpTimeout, err)
+			} else if isQuotaExceeded(err) {
+				if spec.SkipOverQuota {
+					log.Printf("Skipping namespace %s: its secret quota is exhausted: %v", ns, err)
+					summary.OverQuota = append(summary.OverQuota, ns)
+					progress.record(false)
+					continue
+				}
+				log.Printf("Error creating/updating secret in namespace %s: secret quota exceeded: %v. Continuing with remaining namespaces.", ns, err)
+				summary.Failed = append(summary.Failed, ns)
+				failures = append(failures, &DistributionError{Namespace: ns, Err: fmt.Errorf("secret quota exceeded: %w", err)})
+				progress.record(true)
+				continue
+			} else if apierrors.IsForbidden(err) || errors.Is(err, errImmutableSecret) || errors.Is(err, errSecretTypeMismatch) || errors.Is(err, errVerificationFailed) || errors.As(err, &tooLarge) {
+				log.Printf("Error creating/updating secret in namespace %s: %v. Continuing with remaining namespaces.", ns, err)
+				summary.Failed = append(summary.Failed, ns)
+				failures = append(failures, &DistributionError{Namespace: ns, Err: err})
+				progress.record(true)
+				continue
 			}
-			log.Fatalf("Error creating/updating secret in namespace %s: %v", ns, err)
+			log.Printf("Error creating/updating secret in namespace %s: %v. Stopping further secret operations.", ns, err)
+			summary.Failed = append(summary.Failed, ns)
+			summary.Aborted = err
+			failures = append(failures, &DistributionError{Namespace: ns, Err: err})
+			progress.record(true)
+			return summary, fmt.Errorf("secret operations failed in %d namespace(s):\n%w", len(summary.Failed), errors.Join(failures...))
 		}
 		secretOpCancel()
-		log.Printf("Successfully created/updated secret '%s' in namespace '%s'", secretName, ns)
+		if spec.RestartConsumers && (operation == secretUpdated || operation == secretRecreated) {
+			// The restart gets its own time budget, not what the write left over.
+			restartCtx, restartCancel := context.WithTimeout(ctx, secretOpTimeout)
+			restartConsumers(restartCtx, kubeClient, ns, nsSpec.Name, nsSpec.restartChecksum(), spec.FieldManager, spec.now())
+			restartCancel()
+		}
+		summary.Succeeded = append(summary.Succeeded, ns)
+		summary.record(operation)
+		progress.record(false)
+		if progress.logsEachNamespace() {
+			if spec.Reference != nil {
+				log.Printf("Reference configmap '%s' in namespace '%s' %s.", spec.Reference.ConfigMapName, ns, operation)
+			} else if spec.ConfigMap {
+				log.Printf("Configmap '%s' in namespace '%s' %s.", nsSpec.Name, ns, operation)
+			} else {
+				log.Printf("Secret '%s' in namespace '%s' %s.", nsSpec.Name, ns, operation)
+			}
+		}
 	}
-	return nil
+
+	if len(summary.Failed) > 0 {
+		return summary, fmt.Errorf("secret operations failed in %d namespace(s):\n%w", len(summary.Failed), errors.Join(failures...))
+	}
+	return summary, nil
 }
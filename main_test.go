@@ -0,0 +1,1707 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testSpec is a minimal secret spec for writing a token to namespaces.
+func testSpec() secretSpec {
+	return secretSpec{
+		Name:         "oidc-token",
+		Data:         map[string][]byte{"token": []byte("header.payload.signature")},
+		FieldManager: "oidc-jwt-fetcher",
+		TokenKey:     "token",
+	}
+}
+
+func testNamespaces(n int) []string {
+	namespaces := make([]string, n)
+	for i := range namespaces {
+		namespaces[i] = fmt.Sprintf("team-%d", i)
+	}
+	return namespaces
+}
+
+func TestProcessSecretsInNamespacesRunDeadline(t *testing.T) {
+	// The third secret create is slower than the whole run deadline.
+	var creates atomic.Int32
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if creates.Add(1) == 3 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return false, nil, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	namespaces := testNamespaces(5)
+	summary, err := processSecretsInNamespaces(ctx, clientset, namespaces, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("processSecretsInNamespaces() error = %v, want the run deadline", err)
+	}
+	if !errors.Is(summary.Interrupted, context.DeadlineExceeded) {
+		t.Errorf("summary.Interrupted = %v, want the run deadline", summary.Interrupted)
+	}
+	if n := len(summary.Succeeded); n < 2 || n >= len(namespaces) {
+		t.Errorf("summary.Succeeded = %v, want a partial run", summary.Succeeded)
+	}
+	if got := summary.String(); !strings.Contains(got, "stopped early: run deadline exceeded") || !strings.Contains(got, "/5 namespaces") {
+		t.Errorf("summary = %q, want a partial run stopped by the deadline", got)
+	}
+}
+
+func TestProcessSummaryCompleted(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	namespaces := testNamespaces(3)
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	if got, want := summary.String(), "Processed 3/3 namespaces (3 succeeded: 3 created, 0 updated, 0 skipped; 0 failed), completed"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestProcessSummaryCountsUnchanged(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	run := func(namespaces []string, spec secretSpec) processSummary {
+		t.Helper()
+		summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+		if err != nil {
+			t.Fatalf("processSecretsInNamespaces() = %v", err)
+		}
+		return summary
+	}
+
+	// Immutable secrets that already hold the token are not written again.
+	spec := testSpec()
+	spec.Immutable = true
+	run(testNamespaces(2), spec)
+	summary := run(testNamespaces(3), spec)
+	if summary.Skipped != 2 || summary.Created != 1 || summary.Updated != 0 {
+		t.Errorf("summary = %s, want 2 skipped and 1 created", summary)
+	}
+	if !strings.Contains(summary.String(), "1 created, 0 updated, 2 skipped") {
+		t.Errorf("summary line %q does not report the skipped secrets", summary)
+	}
+
+	spec.Data = map[string][]byte{"token": []byte("rotated")}
+	summary = run(testNamespaces(3), spec)
+	if summary.Skipped != 0 || summary.Updated != 3 {
+		t.Errorf("summary = %s, want every secret replaced with the new token", summary)
+	}
+}
+
+func TestProcessSummaryRecord(t *testing.T) {
+	var summary processSummary
+	for _, operation := range []secretOperation{secretCreated, secretUpdated, secretRewritten, secretRecreated, secretUnchanged, secretFresh} {
+		summary.record(operation)
+	}
+	summary.merge(processSummary{Skipped: 2})
+	if summary.Created != 1 || summary.Updated != 3 || summary.Skipped != 4 {
+		t.Errorf("summary = %+v, want 1 created, 3 updated and 4 skipped", summary)
+	}
+}
+
+// captureLog redirects the standard logger for the rest of the test and
+// returns the buffer it writes to.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	writer, flags, prefix := log.Writer(), log.Flags(), log.Prefix()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	})
+	return &buf
+}
+
+func TestProcessSecretsInNamespacesAbortsOnUnexpectedError(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "team-1" {
+			return true, nil, apierrors.NewBadRequest("admission webhook rejected the request")
+		}
+		return false, nil, nil
+	})
+	namespaces := testNamespaces(3)
+
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, testSpec(), secretOpTimeouts{Default: k8sSecretOpTimeout}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err == nil || summary.Aborted == nil {
+		t.Fatalf("processSecretsInNamespaces() = %v, Aborted = %v, want the run stopped", err, summary.Aborted)
+	}
+	if !slices.Equal(summary.Succeeded, []string{"team-0"}) || !slices.Equal(summary.Failed, []string{"team-1"}) {
+		t.Errorf("Succeeded = %v, Failed = %v, want team-0 and team-1", summary.Succeeded, summary.Failed)
+	}
+	if errs := distributionErrors(err); errs["team-1"] == nil {
+		t.Errorf("error %v does not name team-1", err)
+	}
+	if !strings.Contains(summary.String(), "stopped early") {
+		t.Errorf("summary = %q, want it marked as stopped early", summary)
+	}
+}
+
+// testTokenRequest is a client credentials request against tokenURL.
+func testTokenRequest(tokenURL string) tokenRequest {
+	return tokenRequest{
+		URLs:             []string{tokenURL},
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		ContentType:      "application/x-www-form-urlencoded",
+		Accept:           "application/json",
+		MaxResponseBytes: 1 << 20,
+	}
+}
+
+// recordedRequest is a token request received by a fakeTokenServer.
+type recordedRequest struct {
+	Header http.Header
+	Form   url.Values
+}
+
+// fakeTokenServer is a token endpoint that answers every request with body
+// and records the requests it received.
+type fakeTokenServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []recordedRequest
+}
+
+func newFakeTokenServer(t *testing.T, body string) *fakeTokenServer {
+	server := &fakeTokenServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("token request form: %v", err)
+		}
+		server.mu.Lock()
+		server.received = append(server.received, recordedRequest{Header: r.Header.Clone(), Form: r.PostForm})
+		server.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakeTokenServer) requests() []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedRequest(nil), s.received...)
+}
+
+const testTokenBody = `{"access_token":"header.payload.signature","expires_in":3600}`
+
+// rateLimitedIdP answers the first token request with 429 and the given
+// Retry-After header, and every later one with a token.
+func rateLimitedIdP(t *testing.T, retryAfter func() string) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", retryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, testTokenBody)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestFetchOIDCTokenRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		minWait    time.Duration
+	}{
+		{"seconds", func() string { return "1" }, 900 * time.Millisecond},
+		// HTTP-dates have a one second resolution.
+		{"date", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, 900 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := rateLimitedIdP(t, tt.retryAfter)
+			start := time.Now()
+			response, err := fetchOIDCToken(context.Background(), server.Client(), testTokenRequest(server.URL))
+			if err != nil {
+				t.Fatalf("fetchOIDCToken() = %v", err)
+			}
+			if response.AccessToken != "header.payload.signature" {
+				t.Errorf("access token = %q", response.AccessToken)
+			}
+			if got := requests.Load(); got != 2 {
+				t.Errorf("token endpoint called %d times, want 2", got)
+			}
+			if waited := time.Since(start); waited < tt.minWait {
+				t.Errorf("retried after %v, want at least %v as the server asked", waited, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestFetchOIDCTokenRetryAfterCappedByDeadline(t *testing.T) {
+	server, requests := rateLimitedIdP(t, func() string { return "60" })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := fetchOIDCToken(ctx, server.Client(), testTokenRequest(server.URL))
+	if err == nil {
+		t.Fatal("fetchOIDCToken() = nil, want an error once the deadline passes")
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("fetchOIDCToken() waited %v, want it to stop at the deadline", waited)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("token endpoint called %d times, want 1", got)
+	}
+}
+
+func TestFetchOIDCTokenUserAgent(t *testing.T) {
+	for _, userAgent := range []string{defaultUserAgent(), "platform-team/2.0"} {
+		server := newFakeTokenServer(t, testTokenBody)
+		tokenReq := testTokenRequest(server.URL)
+		tokenReq.UserAgent = userAgent
+		if _, err := fetchOIDCToken(context.Background(), server.Client(), tokenReq); err != nil {
+			t.Fatalf("fetchOIDCToken() = %v", err)
+		}
+		if got := server.requests()[0].Header.Get("User-Agent"); got != userAgent {
+			t.Errorf("User-Agent = %q, want %q", got, userAgent)
+		}
+	}
+}
+
+func TestFetchOIDCTokenHeaderOverrides(t *testing.T) {
+	for _, headers := range []struct{ accept, contentType string }{
+		{defaultTokenAccept, formContentType},
+		{"application/vnd.gateway+json", "application/x-www-form-urlencoded; charset=utf-8"},
+	} {
+		server := newFakeTokenServer(t, testTokenBody)
+		tokenReq := testTokenRequest(server.URL)
+		tokenReq.Accept, tokenReq.ContentType = headers.accept, headers.contentType
+		if _, err := fetchOIDCToken(context.Background(), server.Client(), tokenReq); err != nil {
+			t.Fatalf("fetchOIDCToken() = %v", err)
+		}
+		request := server.requests()[0]
+		if got := request.Header.Get("Accept"); got != headers.accept {
+			t.Errorf("Accept = %q, want %q", got, headers.accept)
+		}
+		if got := request.Header.Get("Content-Type"); got != headers.contentType {
+			t.Errorf("Content-Type = %q, want %q", got, headers.contentType)
+		}
+		if request.Form.Get("client_id") != "client" {
+			t.Errorf("form body was not decoded with Content-Type %q: %v", headers.contentType, request.Form)
+		}
+	}
+}
+
+func TestBuildSecretDataClaimsKey(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("WRITE_CLAIMS_KEY", "claims")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+
+	claims := map[string]interface{}{"sub": "svc-deployer", "aud": "api", "exp": float64(1893456000)}
+	data, err := buildSecretData(cfg, parseToken(testJWT(t, claims)), time.Time{})
+	if err != nil {
+		t.Fatalf("buildSecretData() = %v", err)
+	}
+	var stored map[string]interface{}
+	if err := json.Unmarshal(data["claims"], &stored); err != nil {
+		t.Fatalf("claims key is not valid JSON: %v (%q)", err, data["claims"])
+	}
+	want, _ := json.Marshal(claims)
+	got, _ := json.Marshal(stored)
+	if !bytes.Equal(got, want) {
+		t.Errorf("claims = %s, want %s", got, want)
+	}
+
+	// Opaque tokens are written without a claims key.
+	data, err = buildSecretData(cfg, parseToken("opaque-token"), time.Time{})
+	if err != nil {
+		t.Fatalf("buildSecretData() for an opaque token = %v", err)
+	}
+	if _, ok := data["claims"]; ok {
+		t.Errorf("claims key written for an opaque token: %q", data["claims"])
+	}
+}
+
+func TestBuildSecretDataJSONPretty(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("WRITE_CLAIMS_KEY", "claims")
+	token := parseToken(testJWT(t, map[string]interface{}{"sub": "svc-deployer", "aud": "api"}))
+
+	for pretty, want := range map[string]string{
+		"":     `{"aud":"api","sub":"svc-deployer"}`,
+		"true": "{\n  \"aud\": \"api\",\n  \"sub\": \"svc-deployer\"\n}",
+	} {
+		t.Setenv("JSON_PRETTY", pretty)
+		cfg, err := loadConfig(false, false)
+		if err != nil {
+			t.Fatalf("loadConfig() = %v", err)
+		}
+		data, err := buildSecretData(cfg, token, time.Time{})
+		if err != nil {
+			t.Fatalf("buildSecretData() = %v", err)
+		}
+		if got := string(data["claims"]); got != want {
+			t.Errorf("JSON_PRETTY=%q: claims = %q, want %q", pretty, got, want)
+		}
+	}
+}
+
+func TestBuildSecretDataEncoding(t *testing.T) {
+	setBaseEnv(t)
+	token := parseToken(testJWT(t, map[string]interface{}{"sub": "svc"}))
+	for encoding, want := range map[string]string{
+		secretEncodingRaw:    token.Raw,
+		secretEncodingBase64: base64.StdEncoding.EncodeToString([]byte(token.Raw)),
+	} {
+		t.Run(encoding, func(t *testing.T) {
+			t.Setenv("SECRET_ENCODING", encoding)
+			cfg, err := loadConfig(false, false)
+			if err != nil {
+				t.Fatalf("loadConfig() = %v", err)
+			}
+			data, err := buildSecretData(cfg, token, time.Time{})
+			if err != nil {
+				t.Fatalf("buildSecretData() = %v", err)
+			}
+
+			// Written and read back through the clientset, as consumers read it.
+			clientset := fake.NewSimpleClientset()
+			spec := testSpec()
+			spec.Data = data
+			if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+				t.Fatalf("createOrUpdateSecret() = %v", err)
+			}
+			if got := secretToken(t, clientset); got != want {
+				t.Errorf("stored token = %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Setenv("SECRET_ENCODING", "hex")
+	if _, err := loadConfig(false, false); err == nil {
+		t.Error("loadConfig() = nil, want an unknown SECRET_ENCODING rejected")
+	}
+}
+
+func TestOversizedClaimsRejectedBeforeWrite(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("WRITE_CLAIMS_KEY", "claims")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	token := parseToken(testJWT(t, map[string]interface{}{"sub": "svc", "blob": strings.Repeat("x", 600<<10)}))
+	spec := testSpec()
+	if spec.Data, err = buildSecretData(cfg, token, time.Time{}); err != nil {
+		t.Fatalf("buildSecretData() = %v", err)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	_, err = createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+	var tooLarge *SecretTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("createOrUpdateSecret() = %v, want a *SecretTooLargeError", err)
+	}
+	if len(tooLarge.Keys) != 2 || tooLarge.Keys[1].Key != "claims" {
+		t.Errorf("Keys = %v, want the token and claims keys", tooLarge.Keys)
+	}
+	if !strings.Contains(err.Error(), "CLAIMS_ALLOWLIST or CLAIMS_GZIP") {
+		t.Errorf("error = %q, want a hint to shrink the claims", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" {
+			t.Errorf("oversized secret was written: %v", action)
+		}
+	}
+
+	cfg.ClaimsAllowlist = []string{"sub"}
+	if spec.Data, err = buildSecretData(cfg, token, time.Time{}); err != nil {
+		t.Fatalf("buildSecretData() with CLAIMS_ALLOWLIST = %v", err)
+	}
+	if got := string(spec.Data["claims"]); got != `{"sub":"svc"}` {
+		t.Errorf("claims = %s, want only the allowlisted claim", got)
+	}
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Errorf("createOrUpdateSecret() with CLAIMS_ALLOWLIST = %v", err)
+	}
+}
+
+func TestProcessSecretsInNamespacesForbidden(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "team-1" {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "oidc-token", errors.New("RBAC: access denied"))
+		}
+		return false, nil, nil
+	})
+
+	namespaces := testNamespaces(3)
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err == nil {
+		t.Fatal("processSecretsInNamespaces() = nil, want the forbidden namespace reported")
+	}
+	want := "permission denied: cannot 'create' secret 'oidc-token' in namespace 'team-1'; grant the 'create' verb on 'secrets'"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want it to contain %q", err, want)
+	}
+	var distErr *DistributionError
+	if !errors.As(err, &distErr) || distErr.Namespace != "team-1" {
+		t.Errorf("error = %v, want a DistributionError for team-1", err)
+	}
+	if got := strings.Join(summary.Succeeded, ","); got != "team-0,team-2" {
+		t.Errorf("succeeded = %s, want the other namespaces processed", got)
+	}
+	if got := strings.Join(summary.Failed, ","); got != "team-1" {
+		t.Errorf("failed = %s, want team-1", got)
+	}
+	for _, ns := range []string{"team-0", "team-2"} {
+		if _, err := clientset.CoreV1().Secrets(ns).Get(context.Background(), "oidc-token", metav1.GetOptions{}); err != nil {
+			t.Errorf("secret in %s: %v", ns, err)
+		}
+	}
+}
+
+// exhaustQuota makes secret creates in namespace fail as the API server does
+// when the namespace's ResourceQuota on secrets is used up.
+func exhaustQuota(clientset *fake.Clientset, namespace string) {
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != namespace {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "oidc-token",
+			errors.New("exceeded quota: secret-quota, requested: count/secrets=1, used: count/secrets=10, limited: count/secrets=10"))
+	})
+}
+
+func TestProcessSecretsInNamespacesQuotaExceeded(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			logs := captureLog(t)
+			clientset := fake.NewSimpleClientset()
+			exhaustQuota(clientset, "team-1")
+			spec := testSpec()
+			spec.SkipOverQuota = skip
+
+			namespaces := testNamespaces(3)
+			summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+			if got := strings.Join(summary.Succeeded, ","); got != "team-0,team-2" {
+				t.Errorf("succeeded = %s, want the other namespaces processed", got)
+			}
+			if skip {
+				if err != nil || !slices.Equal(summary.OverQuota, []string{"team-1"}) || len(summary.Failed) != 0 {
+					t.Errorf("error %v, summary %s, want team-1 skipped over quota", err, summary)
+				}
+				if !strings.Contains(logs.String(), "Skipping namespace team-1: its secret quota is exhausted") {
+					t.Errorf("log %q does not report the skip", logs)
+				}
+				return
+			}
+			var distErr *DistributionError
+			if !errors.As(err, &distErr) || distErr.Namespace != "team-1" || !strings.Contains(err.Error(), "secret quota exceeded") {
+				t.Errorf("error = %v, want a quota DistributionError for team-1", err)
+			}
+			if !slices.Equal(summary.Failed, []string{"team-1"}) {
+				t.Errorf("failed = %v, want team-1", summary.Failed)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateSecretOnlyCreatesWhenNotFound(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("get", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		// Mentions "not found" but is not a NotFound status.
+		return true, nil, apierrors.NewBadRequest("webhook configuration not found")
+	})
+
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", testSpec()); err == nil {
+		t.Fatal("createOrUpdateSecret() = nil, want the get error returned")
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" {
+			t.Error("secret created after a get error that is not NotFound")
+		}
+	}
+}
+
+func TestCreateOrUpdateSecretRetriesConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a", ResourceVersion: "1"},
+		Data:       map[string][]byte{"token": []byte("old")},
+	})
+	patches := 0
+	clientset.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			// Another writer updated the secret between our Get and Patch.
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "oidc-token", errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+
+	operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", testSpec())
+	if err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	if operation != secretUpdated {
+		t.Errorf("operation = %s, want %s", operation, secretUpdated)
+	}
+	if patches != 2 {
+		t.Errorf("patched %d times, want 2", patches)
+	}
+	gets := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "secrets" {
+			gets++
+		}
+	}
+	if gets != 2 {
+		t.Errorf("secret read %d times, want it re-read after the conflict", gets)
+	}
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data["token"]); got != "header.payload.signature" {
+		t.Errorf("token = %q, want the new token", got)
+	}
+}
+
+func TestLogClaimsRedacts(t *testing.T) {
+	raw := testJWT(t, map[string]interface{}{"iss": "https://idp.example.com", "sub": "svc-deployer", "email": "ops@example.com"})
+	logs := captureLog(t)
+	logClaims(parseToken(raw))
+
+	got := logs.String()
+	for _, want := range []string{`iss="https://idp.example.com"`, `sub="svc-deployer"`, "email=" + redactedClaimValue} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q does not contain %q", got, want)
+		}
+	}
+	for _, secret := range []string{"ops@example.com", raw, "c2lnbmF0dXJl"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("log %q leaks %q", got, secret)
+		}
+	}
+}
+
+func TestFetchOIDCTokenCompressedResponse(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		// Raw DEFLATE, as some servers send instead of a zlib stream.
+		"deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	for encoding, newEncoder := range encoders {
+		t.Run(encoding, func(t *testing.T) {
+			var acceptEncoding string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", encoding)
+				encoder := newEncoder(w)
+				fmt.Fprint(encoder, testTokenBody)
+				encoder.Close()
+			}))
+			defer server.Close()
+
+			response, err := fetchOIDCToken(context.Background(), server.Client(), testTokenRequest(server.URL))
+			if err != nil {
+				t.Fatalf("fetchOIDCToken() = %v", err)
+			}
+			if response.AccessToken != "header.payload.signature" {
+				t.Errorf("access token = %q", response.AccessToken)
+			}
+			if acceptEncoding != "gzip, deflate" {
+				t.Errorf("Accept-Encoding = %q", acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateSecretCleanupKeys(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a"},
+		Data: map[string][]byte{
+			"token":        []byte("old"),
+			"access-token": []byte("legacy"),
+			"ca.crt":       []byte("owned by another tool"),
+		},
+	})
+	spec := testSpec()
+	spec.CleanupKeys = []string{"access-token", "never-written"}
+
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["access-token"]; ok {
+		t.Error("listed key access-token was not removed")
+	}
+	if got := string(secret.Data["token"]); got != "header.payload.signature" {
+		t.Errorf("token = %q, want the current key written", got)
+	}
+	if got := string(secret.Data["ca.crt"]); got != "owned by another tool" {
+		t.Errorf("ca.crt = %q, want unlisted keys kept", got)
+	}
+}
+
+func TestFetchOIDCTokenOversizedResponse(t *testing.T) {
+	saved := tokenRetryPolicy
+	tokenRetryPolicy.BaseDelay, tokenRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { tokenRetryPolicy = saved })
+
+	padding := strings.Repeat("x", 4096)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token":"t","padding":"%s"}`, padding)
+	}))
+	defer plain.Close()
+	// A small compressed body that inflates past the limit.
+	compressed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		fmt.Fprintf(writer, `{"access_token":"t","padding":"%s"}`, padding)
+		writer.Close()
+	}))
+	defer compressed.Close()
+
+	for name, server := range map[string]*httptest.Server{"plain": plain, "gzip": compressed} {
+		t.Run(name, func(t *testing.T) {
+			tokenReq := testTokenRequest(server.URL)
+			tokenReq.MaxResponseBytes = 1024
+			_, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq)
+			if err == nil || !strings.Contains(err.Error(), "response exceeds 1024 bytes (OIDC_MAX_RESPONSE_BYTES)") {
+				t.Errorf("fetchOIDCToken() = %v, want the size limit reported", err)
+			}
+
+			tokenReq.MaxResponseBytes = 1 << 20
+			if _, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq); err != nil {
+				t.Errorf("fetchOIDCToken() under the limit = %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateSecretFieldManager(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.FieldManager = "oidc-jwt-fetcher-staging"
+	ctx := context.Background()
+	// The first write creates the secret, the second patches it.
+	for _, token := range []string{"first", "second"} {
+		spec.Data = map[string][]byte{"token": []byte(token)}
+		if _, err := createOrUpdateSecret(ctx, clientset, "team-a", spec); err != nil {
+			t.Fatalf("createOrUpdateSecret() = %v", err)
+		}
+	}
+
+	var writes int
+	for _, action := range clientset.Actions() {
+		var manager string
+		switch action := action.(type) {
+		case k8stesting.CreateActionImpl:
+			manager = action.CreateOptions.FieldManager
+		case k8stesting.PatchActionImpl:
+			manager = action.PatchOptions.FieldManager
+		default:
+			continue
+		}
+		writes++
+		if manager != spec.FieldManager {
+			t.Errorf("%s used field manager %q, want %q", action.GetVerb(), manager, spec.FieldManager)
+		}
+	}
+	if writes != 2 {
+		t.Errorf("got %d writes, want a create and a patch", writes)
+	}
+}
+
+func TestWaitForTokenPropagation(t *testing.T) {
+	logs := captureLog(t)
+	if err := waitForTokenPropagation(context.Background(), 0); err != nil || logs.Len() != 0 {
+		t.Errorf("waitForTokenPropagation(0) = %v, logged %q, want no wait", err, logs)
+	}
+
+	start := time.Now()
+	if err := waitForTokenPropagation(context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatalf("waitForTokenPropagation() = %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("waited %v, want the 50ms delay", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start = time.Now()
+	if err := waitForTokenPropagation(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForTokenPropagation() = %v, want it interrupted", err)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Errorf("interrupted wait took %v", waited)
+	}
+}
+
+func TestCheckTokenType(t *testing.T) {
+	tests := []struct {
+		tokenType     string
+		requireBearer bool
+		wantErr       bool
+	}{
+		{"Bearer", true, false},
+		{"bearer", true, false},
+		{"mac", true, true},
+		{"", true, true},
+		{"mac", false, false},
+	}
+	for _, tt := range tests {
+		err := checkTokenType(tt.tokenType, tt.requireBearer)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkTokenType(%q, %v) = %v, want error %v", tt.tokenType, tt.requireBearer, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFetchOIDCTokenTokenType(t *testing.T) {
+	server := newFakeTokenServer(t, `{"access_token":"header.payload.signature","token_type":"mac"}`)
+	response, err := fetchOIDCToken(context.Background(), server.Client(), testTokenRequest(server.URL))
+	if err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	if response.TokenType != "mac" {
+		t.Errorf("TokenType = %q, want the type the IdP returned", response.TokenType)
+	}
+	if err := checkTokenType(response.TokenType, true); err == nil || !strings.Contains(err.Error(), "token_type 'mac'") {
+		t.Errorf("checkTokenType() = %v, want the returned type named", err)
+	}
+}
+
+func immutableSecret(token string) *corev1.Secret {
+	immutable := true
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a", UID: "uid-1", ResourceVersion: "1", Labels: map[string]string{"app": "billing"}},
+		Data:       map[string][]byte{"token": []byte(token)},
+		Immutable:  &immutable,
+	}
+}
+
+func secretToken(t *testing.T, clientset *fake.Clientset) string {
+	t.Helper()
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("reading the secret: %v", err)
+	}
+	return string(secret.Data["token"])
+}
+
+func TestCreateOrUpdateSecretImmutableRefused(t *testing.T) {
+	clientset := fake.NewSimpleClientset(immutableSecret("old"))
+	_, err := createOrUpdateSecret(context.Background(), clientset, "team-a", testSpec())
+	if !errors.Is(err, errImmutableSecret) || !strings.Contains(err.Error(), "ALLOW_IMMUTABLE_RECREATE") {
+		t.Fatalf("createOrUpdateSecret() = %v, want an immutable secret error", err)
+	}
+	if got := secretToken(t, clientset); got != "old" {
+		t.Errorf("token = %q, want the secret left alone", got)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "delete" || action.GetVerb() == "patch" {
+			t.Errorf("unexpected %s of the immutable secret", action.GetVerb())
+		}
+	}
+}
+
+func TestCreateOrUpdateSecretImmutableRecreated(t *testing.T) {
+	clientset := fake.NewSimpleClientset(immutableSecret("old"))
+	spec := testSpec()
+	spec.AllowImmutableRecreate = true
+	operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+	if err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	if operation != secretRecreated {
+		t.Errorf("operation = %s, want %s", operation, secretRecreated)
+	}
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["token"]) != "header.payload.signature" || secret.Immutable == nil || !*secret.Immutable || secret.Labels["app"] != "billing" {
+		t.Errorf("recreated secret = %+v, want the new token with the old labels, still immutable", secret)
+	}
+
+	// An immutable secret that already holds the token is not recreated.
+	clientset = fake.NewSimpleClientset(immutableSecret("header.payload.signature"))
+	if operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil || operation != secretUnchanged {
+		t.Errorf("createOrUpdateSecret() = %s, %v, want %s", operation, err, secretUnchanged)
+	}
+}
+
+func TestSecretImmutableCreateAndRotate(t *testing.T) {
+	captureLog(t)
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.Immutable = true
+	isImmutable := func() bool {
+		secret, err := clientset.CoreV1().Secrets("team-a").Get(ctx, "oidc-token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret.Immutable != nil && *secret.Immutable
+	}
+
+	if operation, err := createOrUpdateSecret(ctx, clientset, "team-a", spec); err != nil || operation != secretCreated {
+		t.Fatalf("createOrUpdateSecret() = %s, %v, want %s", operation, err, secretCreated)
+	}
+	if !isImmutable() {
+		t.Error("created secret is not immutable")
+	}
+
+	// The same token leaves the immutable secret alone.
+	if operation, err := createOrUpdateSecret(ctx, clientset, "team-a", spec); err != nil || operation != secretUnchanged {
+		t.Errorf("createOrUpdateSecret() with the same token = %s, %v, want %s", operation, err, secretUnchanged)
+	}
+
+	// A rotated token recreates it, without ALLOW_IMMUTABLE_RECREATE.
+	spec.Data = map[string][]byte{"token": []byte("rotated.payload.signature")}
+	if operation, err := createOrUpdateSecret(ctx, clientset, "team-a", spec); err != nil || operation != secretRecreated {
+		t.Fatalf("createOrUpdateSecret() after rotation = %s, %v, want %s", operation, err, secretRecreated)
+	}
+	if got := secretToken(t, clientset); got != "rotated.payload.signature" {
+		t.Errorf("token = %q, want the rotated token", got)
+	}
+	if !isImmutable() {
+		t.Error("recreated secret is not immutable")
+	}
+}
+
+func TestSecretImmutableMarksExistingSecret(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a"},
+		Data:       map[string][]byte{"token": []byte("old")},
+	})
+	spec := testSpec()
+	spec.Immutable = true
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Immutable == nil || !*secret.Immutable || string(secret.Data["token"]) != "header.payload.signature" {
+		t.Errorf("secret = %+v, want the new token written and the secret marked immutable", secret)
+	}
+}
+
+func TestRunIDInLogsAndRequest(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("RUN_ID", "pipeline-4711")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+
+	logs := captureLog(t)
+	setLogRunID(cfg.RunID)
+	server := newFakeTokenServer(t, testTokenBody)
+	tokenReq := testTokenRequest(server.URL)
+	tokenReq.RunID = cfg.RunID
+	if _, err := fetchOIDCToken(context.Background(), server.Client(), tokenReq); err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	log.Print("Token fetched.")
+
+	if got := server.requests()[0].Header.Get(runIDHeader); got != "pipeline-4711" {
+		t.Errorf("%s = %q, want the run ID", runIDHeader, got)
+	}
+	if got := logs.String(); !strings.HasPrefix(got, "run_id=pipeline-4711 Token fetched.") {
+		t.Errorf("log = %q, want it tagged with the run ID", got)
+	}
+}
+
+func TestRunIDGenerated(t *testing.T) {
+	setBaseEnv(t)
+	first, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	second, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if len(first.RunID) != 36 || first.RunID == second.RunID {
+		t.Errorf("generated run IDs %q and %q, want distinct UUIDs", first.RunID, second.RunID)
+	}
+}
+
+func TestFetchOIDCTokenGatewayBasicAuth(t *testing.T) {
+	server := newFakeTokenServer(t, testTokenBody)
+	tokenReq := testTokenRequest(server.URL)
+	tokenReq.GatewayBasicUser = "gateway"
+	tokenReq.GatewayBasicPassword = "gateway-pass"
+	if _, err := fetchOIDCToken(context.Background(), server.Client(), tokenReq); err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+
+	request := server.requests()[0]
+	req := &http.Request{Header: request.Header}
+	user, password, ok := req.BasicAuth()
+	if !ok || user != "gateway" || password != "gateway-pass" {
+		t.Errorf("gateway Basic auth = %q, %q, %v, want the gateway credentials", user, password, ok)
+	}
+	if request.Form.Get("client_id") != "client" || request.Form.Get("client_secret") != "secret" {
+		t.Errorf("form = %v, want the OAuth client credentials in the body", request.Form)
+	}
+}
+
+func TestProcessSecretsInNamespacesRefreshBeforeExpiry(t *testing.T) {
+	now := time.Now()
+	tokenSecret := func(namespace string, expiresAt time.Time) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "oidc-token",
+				Namespace:   namespace,
+				Annotations: map[string]string{expiresAtAnnotation: expiresAt.UTC().Format(time.RFC3339)},
+			},
+			Data: map[string][]byte{"token": []byte("old")},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		tokenSecret("fresh", now.Add(2*time.Hour)),
+		tokenSecret("stale", now.Add(5*time.Minute)),
+		tokenSecret("expired", now.Add(-time.Minute)),
+	)
+	spec := testSpec()
+	spec.ExpiresAt = now.Add(3 * time.Hour)
+	spec.RefreshBefore = 30 * time.Minute
+
+	namespaces := []string{"fresh", "stale", "expired", "new"}
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	if summary.Skipped != 1 || summary.Updated != 2 || summary.Created != 1 {
+		t.Errorf("summary = %s, want 1 skipped, 2 updated and 1 created", summary)
+	}
+	for namespace, want := range map[string]string{"fresh": "old", "stale": "header.payload.signature", "expired": "header.payload.signature", "new": "header.payload.signature"} {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(context.Background(), "oidc-token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("secret in %s: %v", namespace, err)
+		}
+		if got := string(secret.Data["token"]); got != want {
+			t.Errorf("token in %s = %q, want %q", namespace, got, want)
+		}
+	}
+}
+
+// fakeAPIServer is a TLS API server that answers /version and records the
+// headers of the last request, unless newFakeAPIServer is given a handler of
+// its own. Its CA certificate is written to caFile.
+type fakeAPIServer struct {
+	*httptest.Server
+	caFile     string
+	mu         sync.Mutex
+	lastHeader http.Header
+}
+
+func newFakeAPIServer(t *testing.T, handler http.Handler) *fakeAPIServer {
+	server := &fakeAPIServer{}
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			server.mu.Lock()
+			server.lastHeader = r.Header.Clone()
+			server.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"major":"1","minor":"30","gitVersion":"v1.30.2"}`)
+		})
+	}
+	server.Server = httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	server.caFile = filepath.Join(t.TempDir(), "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(server.caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Keep rest.InClusterConfig from finding a cluster.
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	return server
+}
+
+func (s *fakeAPIServer) headers() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastHeader.Clone()
+}
+
+func TestTokenHTTPClientDisableHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	rootCAs := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for disable, want := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		client := newTokenHTTPClient(&tls.Config{RootCAs: rootCAs}, tokenTransportOptions{DisableHTTP2: disable, MaxIdleConnsPerHost: 2, IdleConnTimeout: time.Minute})
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		proto, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(proto) != want {
+			t.Errorf("DisableHTTP2=%v: server saw %s, want %s", disable, proto, want)
+		}
+	}
+}
+
+func TestLoadConfigDisableHTTP2(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OIDC_DISABLE_HTTP2", "true")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !cfg.DisableHTTP2 {
+		t.Error("DisableHTTP2 = false, want OIDC_DISABLE_HTTP2 honoured")
+	}
+}
+
+func TestGetKubeClientExplicitServer(t *testing.T) {
+	server := newFakeAPIServer(t, nil)
+	clientset, err := getKubeClient(kubeConnection{APIServer: server.URL, BearerToken: "sa-token", CAFile: server.caFile})
+	if err != nil {
+		t.Fatalf("getKubeClient() = %v", err)
+	}
+	info, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatalf("ServerVersion() = %v", err)
+	}
+	if info.GitVersion != "v1.30.2" {
+		t.Errorf("GitVersion = %q", info.GitVersion)
+	}
+	if got := server.headers().Get("Authorization"); got != "Bearer sa-token" {
+		t.Errorf("Authorization = %q, want the K8S_BEARER_TOKEN", got)
+	}
+}
+
+func TestExplicitKubeConfigTLSMinVersion(t *testing.T) {
+	server := newFakeAPIServer(t, nil)
+	config, err := explicitKubeConfig(kubeConnection{APIServer: server.URL, BearerToken: "sa-token", CAFile: server.caFile, TLSMinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("explicitKubeConfig() = %v", err)
+	}
+	transport, ok := config.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Transport = %T, want *http.Transport", config.Transport)
+	}
+	if got := transport.TLSClientConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %#x, want TLS 1.3", got)
+	}
+	if transport.TLSClientConfig.RootCAs == nil {
+		t.Error("RootCAs = nil, want the K8S_CA_FILE certificate")
+	}
+}
+
+func TestLoadConfigKubeTLSMinVersion(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("K8S_TLS_MIN_VERSION", "1.3")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Kube.TLSMinVersion != tls.VersionTLS13 {
+		t.Errorf("Kube.TLSMinVersion = %#x, want TLS 1.3", cfg.Kube.TLSMinVersion)
+	}
+	t.Setenv("K8S_TLS_MIN_VERSION", "1.4")
+	if _, err := loadConfig(false, false); err == nil {
+		t.Error("loadConfig() = nil, want K8S_TLS_MIN_VERSION=1.4 rejected")
+	}
+}
+
+func TestLoadConfigExplicitServerValidated(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("K8S_API_SERVER", "http://api.example.com")
+	if _, err := loadConfig(false, false); err == nil {
+		t.Error("loadConfig() = nil, want a non-https K8S_API_SERVER rejected")
+	}
+	t.Setenv("K8S_API_SERVER", "https://api.example.com:6443")
+	if _, err := loadConfig(false, false); err == nil {
+		t.Error("loadConfig() = nil, want K8S_BEARER_TOKEN required")
+	}
+	t.Setenv("K8S_BEARER_TOKEN", "sa-token")
+	if _, err := loadConfig(false, false); err != nil {
+		t.Errorf("loadConfig() = %v", err)
+	}
+}
+
+func TestFetchOIDCTokenFailsOver(t *testing.T) {
+	saved := tokenRetryPolicy
+	tokenRetryPolicy.BaseDelay, tokenRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { tokenRetryPolicy = saved })
+
+	var failing atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+	healthy := newFakeTokenServer(t, testTokenBody)
+
+	logs := captureLog(t)
+	tokenReq := testTokenRequest(broken.URL)
+	tokenReq.URLs = append(tokenReq.URLs, healthy.URL)
+	response, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq)
+	if err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	if response.TokenURL != healthy.URL {
+		t.Errorf("TokenURL = %q, want the second endpoint", response.TokenURL)
+	}
+	if got := failing.Load(); got != int32(tokenRetryPolicy.Attempts) {
+		t.Errorf("first endpoint tried %d times, want the full retry policy (%d)", got, tokenRetryPolicy.Attempts)
+	}
+	if !strings.Contains(logs.String(), "Failing over to "+healthy.URL) {
+		t.Errorf("log %q does not mention the failover", logs)
+	}
+}
+
+func TestFetchOIDCTokenAllEndpointsFail(t *testing.T) {
+	saved := tokenRetryPolicy
+	tokenRetryPolicy.BaseDelay, tokenRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { tokenRetryPolicy = saved })
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	tokenReq := testTokenRequest(broken.URL)
+	tokenReq.URLs = []string{broken.URL + "/a", broken.URL + "/b"}
+	_, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq)
+	if err == nil || !strings.Contains(err.Error(), "all 2 token endpoints failed") {
+		t.Errorf("fetchOIDCToken() = %v, want both endpoints reported", err)
+	}
+}
+
+func TestVerifyAfterWriteMismatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	written := false
+	clientset.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		written = true
+		return false, nil, nil
+	})
+	// Once written, reads return a secret that lost the value.
+	clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !written {
+			return false, nil, nil
+		}
+		return true, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: action.GetNamespace()},
+			Data:       map[string][]byte{"token": []byte("stale")},
+		}, nil
+	})
+	spec := testSpec()
+	spec.VerifyAfterWrite = true
+
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, []string{"team-a"}, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, 1))
+	if !errors.Is(err, errVerificationFailed) {
+		t.Fatalf("processSecretsInNamespaces() = %v, want a verification failure", err)
+	}
+	if len(summary.Failed) != 1 {
+		t.Errorf("summary = %s, want the namespace failed", summary)
+	}
+}
+
+func TestVerifyAfterWriteMatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.VerifyAfterWrite = true
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	gets := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" {
+			gets++
+		}
+	}
+	if gets != 2 {
+		t.Errorf("secret read %d times, want it read back once after the write", gets)
+	}
+}
+
+// mainProcessEnv makes a subprocess run of the test binary call main()
+// instead of running the tests, so tests can observe its exit code.
+const mainProcessEnv = "OIDC_JWT_FETCHER_RUN_MAIN"
+
+func init() {
+	if os.Getenv(mainProcessEnv) == "1" {
+		os.Args = os.Args[:1]
+		main()
+		os.Exit(0)
+	}
+}
+
+// runMain runs main() in a subprocess with env and returns its exit code and
+// combined output. When ready is not nil, the subprocess is sent SIGTERM once
+// ready is closed.
+func runMain(t *testing.T, env []string, ready <-chan struct{}) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), append(env, mainProcessEnv+"=1")...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("subprocess never reached the signal point:\n%s", output.String())
+		}
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd.Wait()
+	t.Logf("subprocess output:\n%s", output.String())
+	return cmd.ProcessState.ExitCode(), output.String()
+}
+
+// blockingHandler closes arrived on its first request and holds every
+// request open until the client gives up.
+func blockingHandler(arrived chan struct{}) http.HandlerFunc {
+	var once sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Drain the body so the server notices the client going away.
+		io.Copy(io.Discard, r.Body)
+		once.Do(func() { close(arrived) })
+		<-r.Context().Done()
+	}
+}
+
+func readRunReport(t *testing.T, path string) runReport {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("summary file not written: %v", err)
+	}
+	var report runReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		t.Fatalf("summary file is not JSON: %v", err)
+	}
+	return report
+}
+
+func TestMainSignalDuringTokenFetch(t *testing.T) {
+	arrived := make(chan struct{})
+	idp := httptest.NewServer(blockingHandler(arrived))
+	defer idp.Close()
+	var apiRequests atomic.Int32
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiRequests.Add(1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	}))
+	defer api.Close()
+	summary := filepath.Join(t.TempDir(), "summary.json")
+
+	code, _ := runMain(t, []string{
+		"OIDC_CLIENT_ID=client",
+		"OIDC_CLIENT_SECRET=secret",
+		"OIDC_TOKEN_URL=" + idp.URL,
+		"SINGLE_NAMESPACE=team-a",
+		"K8S_API_SERVER=" + api.URL,
+		"K8S_BEARER_TOKEN=sa-token",
+		"SUMMARY_FILE_PATH=" + summary,
+	}, arrived)
+
+	if code != exitInterrupted {
+		t.Errorf("exit code = %d, want %d", code, exitInterrupted)
+	}
+	if n := apiRequests.Load(); n != 0 {
+		t.Errorf("API server received %d requests; nothing may be written after a signal during the token fetch", n)
+	}
+	if report := readRunReport(t, summary); report.Result != runInterrupted {
+		t.Errorf("summary result = %q, want %q", report.Result, runInterrupted)
+	}
+}
+
+func TestMainSignalDuringNamespaceDiscovery(t *testing.T) {
+	idp := newFakeTokenServer(t, testTokenBody)
+	arrived := make(chan struct{})
+	block := blockingHandler(arrived)
+	var writes atomic.Int32
+	api := newFakeAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/version":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"major":"1","minor":"30","gitVersion":"v1.30.2"}`)
+		case r.Method != http.MethodGet:
+			writes.Add(1)
+			http.Error(w, "unexpected write", http.StatusInternalServerError)
+		default:
+			block(w, r)
+		}
+	}))
+	summary := filepath.Join(t.TempDir(), "summary.json")
+
+	code, _ := runMain(t, []string{
+		"OIDC_CLIENT_ID=client",
+		"OIDC_CLIENT_SECRET=secret",
+		"OIDC_TOKEN_URL=" + idp.URL,
+		"SINGLE_NAMESPACE=team-a",
+		"K8S_API_SERVER=" + api.URL,
+		"K8S_BEARER_TOKEN=sa-token",
+		"K8S_CA_FILE=" + api.caFile,
+		"SUMMARY_FILE_PATH=" + summary,
+	}, arrived)
+
+	if code != exitInterrupted {
+		t.Errorf("exit code = %d, want %d", code, exitInterrupted)
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("API server received %d writes after a signal during namespace discovery", n)
+	}
+	if report := readRunReport(t, summary); report.Result != runInterrupted {
+		t.Errorf("summary result = %q, want %q", report.Result, runInterrupted)
+	}
+}
+
+func TestCreateOrUpdateSecretKeepsForeignKeys(t *testing.T) {
+	foreignSecret := func(immutable bool) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a", ResourceVersion: "1"},
+			Data:       map[string][]byte{"token": []byte("old"), "foreign": []byte("managed elsewhere")},
+			Immutable:  &immutable,
+		}
+	}
+	tests := map[string]struct {
+		clientset func() *fake.Clientset
+		want      secretOperation
+	}{
+		"patch": {
+			clientset: func() *fake.Clientset { return fake.NewSimpleClientset(foreignSecret(false)) },
+			want:      secretUpdated,
+		},
+		"create-then-update": {
+			clientset: func() *fake.Clientset {
+				clientset := fake.NewSimpleClientset()
+				clientset.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+					// Another writer created the secret between our Get and Create.
+					if err := clientset.Tracker().Add(foreignSecret(false)); err != nil {
+						return true, nil, err
+					}
+					return true, nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, "oidc-token")
+				})
+				return clientset
+			},
+			want: secretUpdated,
+		},
+		"immutable recreate": {
+			clientset: func() *fake.Clientset { return fake.NewSimpleClientset(foreignSecret(true)) },
+			want:      secretRecreated,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			captureLog(t)
+			clientset := tt.clientset()
+			spec := testSpec()
+			spec.AllowImmutableRecreate = true
+
+			operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+			if err != nil {
+				t.Fatalf("createOrUpdateSecret() = %v", err)
+			}
+			if operation != tt.want {
+				t.Errorf("operation = %s, want %s", operation, tt.want)
+			}
+			secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(secret.Data["foreign"]); got != "managed elsewhere" {
+				t.Errorf("foreign = %q, want it preserved", got)
+			}
+			if got := string(secret.Data["token"]); got != "header.payload.signature" {
+				t.Errorf("token = %q, want the new token", got)
+			}
+		})
+	}
+}
+
+func TestMainPreflightFailureWritesSummary(t *testing.T) {
+	idp := newFakeTokenServer(t, testTokenBody)
+	var writes atomic.Int32
+	api := newFakeAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/version":
+			fmt.Fprint(w, `{"major":"1","minor":"30","gitVersion":"v1.30.2"}`)
+		case strings.HasSuffix(r.URL.Path, "/selfsubjectaccessreviews"):
+			fmt.Fprint(w, `{"apiVersion":"authorization.k8s.io/v1","kind":"SelfSubjectAccessReview","status":{"allowed":false}}`)
+		case r.Method == http.MethodGet:
+			fmt.Fprint(w, `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team-a","uid":"1"}}`)
+		default:
+			writes.Add(1)
+			http.Error(w, "unexpected write", http.StatusInternalServerError)
+		}
+	}))
+	summary := filepath.Join(t.TempDir(), "summary.json")
+
+	code, _ := runMain(t, []string{
+		"OIDC_CLIENT_ID=client",
+		"OIDC_CLIENT_SECRET=secret",
+		"OIDC_TOKEN_URL=" + idp.URL,
+		"SINGLE_NAMESPACE=team-a",
+		"PREFLIGHT_RBAC_CHECK=true",
+		"K8S_API_SERVER=" + api.URL,
+		"K8S_BEARER_TOKEN=sa-token",
+		"K8S_CA_FILE=" + api.caFile,
+		"SUMMARY_FILE_PATH=" + summary,
+	}, nil)
+
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("API server received %d writes after a failed preflight check", n)
+	}
+	report := readRunReport(t, summary)
+	if report.Result != runFailed || !strings.Contains(report.Error, "Preflight RBAC check failed") {
+		t.Errorf("summary result = %q (%q), want %q with the preflight error", report.Result, report.Error, runFailed)
+	}
+}
+
+func TestFetchOIDCTokenInvalidClient(t *testing.T) {
+	tests := map[string]struct {
+		status        int
+		body          string
+		invalidClient bool
+	}{
+		"401":                {http.StatusUnauthorized, `{"error":"invalid_client","error_description":"bad secret"}`, true},
+		"401 without body":   {http.StatusUnauthorized, "", true},
+		"400 invalid_client": {http.StatusBadRequest, `{"error":"invalid_client"}`, true},
+		"400 invalid_scope":  {http.StatusBadRequest, `{"error":"invalid_scope"}`, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			captureLog(t)
+			var requests atomic.Int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+			primary := httptest.NewServer(handler)
+			defer primary.Close()
+			secondary := httptest.NewServer(handler)
+			defer secondary.Close()
+			tokenReq := testTokenRequest(primary.URL)
+			tokenReq.URLs = append(tokenReq.URLs, secondary.URL)
+
+			_, err := fetchOIDCToken(context.Background(), primary.Client(), tokenReq)
+			if err == nil {
+				t.Fatal("fetchOIDCToken() = nil, want an error")
+			}
+			if got := errors.Is(err, errInvalidClient); got != tt.invalidClient {
+				t.Fatalf("errors.Is(%v, errInvalidClient) = %v, want %v", err, got, tt.invalidClient)
+			}
+			if !tt.invalidClient {
+				return
+			}
+			if !strings.Contains(err.Error(), "check OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_AUTH_METHOD") {
+				t.Errorf("error %q does not point at the credentials", err)
+			}
+			if got := requests.Load(); got != 1 {
+				t.Errorf("token endpoints called %d times, want 1: bad credentials are neither retried nor failed over", got)
+			}
+		})
+	}
+}
+
+func TestMainNoKube(t *testing.T) {
+	idp := newFakeTokenServer(t, testTokenBody)
+	baseEnv := []string{
+		"OIDC_CLIENT_ID=client",
+		"OIDC_CLIENT_SECRET=secret",
+		"OIDC_TOKEN_URL=" + idp.URL,
+		"NO_KUBE=true",
+		// Any attempt to reach a cluster would fail the run.
+		"KUBERNETES_SERVICE_HOST=",
+		"KUBECONFIG=" + filepath.Join(t.TempDir(), "missing"),
+	}
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		code, _ := runMain(t, append(baseEnv, "OUTPUT_FILE="+path), nil)
+		if code != 0 {
+			t.Fatalf("exit code = %d, want 0", code)
+		}
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("token file not written: %v", err)
+		}
+		if strings.TrimSpace(string(written)) != "header.payload.signature" {
+			t.Errorf("token file = %q", written)
+		}
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		code, output := runMain(t, baseEnv, nil)
+		if code != 0 {
+			t.Fatalf("exit code = %d, want 0", code)
+		}
+		if !slices.Contains(strings.Split(output, "\n"), "header.payload.signature") {
+			t.Error("token not printed on a line of its own")
+		}
+	})
+
+	if n := len(idp.requests()); n != 2 {
+		t.Errorf("token endpoint called %d times, want once per run", n)
+	}
+}
+
+// paginatedNamespaces serves the namespace list in pages of the given
+// names, answering the request for page failOn, if any, with err.
+func paginatedNamespaces(clientset *fake.Clientset, pages [][]string, failOn int, err error) *[]metav1.ListOptions {
+	var requests []metav1.ListOptions
+	clientset.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		opts := action.(k8stesting.ListActionImpl).ListOptions
+		requests = append(requests, opts)
+		page := 0
+		if opts.Continue != "" {
+			fmt.Sscanf(opts.Continue, "page-%d", &page)
+		}
+		if page == failOn {
+			return true, nil, err
+		}
+		list := &corev1.NamespaceList{}
+		for _, name := range pages[page] {
+			list.Items = append(list.Items, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+		if page+1 < len(pages) {
+			list.Continue = fmt.Sprintf("page-%d", page+1)
+		}
+		return true, list, nil
+	})
+	return &requests
+}
+
+func TestListNamespacesPaginated(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	requests := paginatedNamespaces(clientset, [][]string{{"team-a", "team-b"}, {"team-c"}, {"team-d"}}, -1, nil)
+
+	namespaces, err := listNamespaces(context.Background(), clientset, metav1.ListOptions{}, false)
+	if err != nil {
+		t.Fatalf("listNamespaces() = %v", err)
+	}
+	if got := namespaceNames(namespaces); !slices.Equal(got, []string{"team-a", "team-b", "team-c", "team-d"}) {
+		t.Errorf("namespaces = %v, want every page", got)
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("listed %d pages, want 3", len(*requests))
+	}
+	for i, opts := range *requests {
+		if opts.Limit != namespaceListPageSize {
+			t.Errorf("page %d Limit = %d, want %d", i+1, opts.Limit, namespaceListPageSize)
+		}
+	}
+	if got := (*requests)[2].Continue; got != "page-2" {
+		t.Errorf("third request Continue = %q, want the token of the second page", got)
+	}
+}
+
+func TestListNamespacesFailsMidPagination(t *testing.T) {
+	expired := apierrors.NewResourceExpired("continue token expired")
+	tests := map[string]struct {
+		failOn          int
+		err             error
+		toleratePartial bool
+		want            []string
+		wantErr         string
+	}{
+		"second page":                       {1, apierrors.NewBadRequest("aggregated API unavailable"), false, nil, "page 2 after 2 namespaces (set TOLERATE_PARTIAL_LIST=true"},
+		"expired continue token":            {1, expired, false, nil, "the list changed too much while it was being paginated"},
+		"second page tolerated":             {1, apierrors.NewBadRequest("aggregated API unavailable"), true, []string{"team-a", "team-b"}, ""},
+		"third page tolerated":              {2, expired, true, []string{"team-a", "team-b", "team-c"}, ""},
+		"first page fails even if tolerant": {0, apierrors.NewBadRequest("unavailable"), true, nil, "failed to list namespaces"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLog(t)
+			clientset := fake.NewSimpleClientset()
+			paginatedNamespaces(clientset, [][]string{{"team-a", "team-b"}, {"team-c"}, {"team-d"}}, tt.failOn, tt.err)
+
+			namespaces, err := listNamespaces(context.Background(), clientset, metav1.ListOptions{}, tt.toleratePartial)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listNamespaces() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listNamespaces() = %v", err)
+			}
+			if got := namespaceNames(namespaces); !slices.Equal(got, tt.want) {
+				t.Errorf("namespaces = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), "TOLERATE_PARTIAL_LIST is set") {
+				t.Errorf("partial list not logged:\n%s", logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Token metadata fields SECRET_METADATA_KEYS can write under their own keys.
+const (
+	metadataExpiry   = "expiry"
+	metadataIssuer   = "issuer"
+	metadataChecksum = "checksum"
+)
+
+var metadataFields = []string{metadataExpiry, metadataIssuer, metadataChecksum}
+
+// secretMetadataKeys maps token metadata fields to the secret keys they are
+// written under, from SECRET_METADATA_KEYS, e.g.
+// "expiry=token-expiry,issuer=token-issuer".
+type secretMetadataKeys map[string]string
+
+func parseSecretMetadataKeys(value string) (secretMetadataKeys, error) {
+	keys := make(secretMetadataKeys)
+	var problems []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, key, ok := strings.Cut(entry, "=")
+		field, key = strings.TrimSpace(field), strings.TrimSpace(key)
+		switch {
+		case !ok || field == "" || key == "":
+			problems = append(problems, fmt.Sprintf("expected field=key, got '%s'", entry))
+		case !slices.Contains(metadataFields, field):
+			problems = append(problems, fmt.Sprintf("unknown field '%s' (expected %s)", field, strings.Join(metadataFields, ", ")))
+		case keys[field] != "":
+			problems = append(problems, fmt.Sprintf("field '%s' is mapped twice", field))
+		case slices.Contains(keys.keys(), key):
+			problems = append(problems, fmt.Sprintf("key '%s' is used for more than one field", key))
+		default:
+			if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+				problems = append(problems, fmt.Sprintf("invalid key '%s': %s", key, strings.Join(errs, "; ")))
+				continue
+			}
+			keys[field] = key
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return keys, nil
+}
+
+// keys lists the secret keys written, in a stable order.
+func (m secretMetadataKeys) keys() []string {
+	keys := make([]string, 0, len(m))
+	for _, field := range metadataFields {
+		if key, ok := m[field]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// data returns the metadata of token to write alongside it. A field whose
+// value is unknown, such as the issuer of an opaque token, is left out with a
+// log line.
+func (m secretMetadataKeys) data(token *parsedToken, expiresAt time.Time) map[string][]byte {
+	data := make(map[string][]byte, len(m))
+	for _, field := range metadataFields {
+		key, ok := m[field]
+		if !ok {
+			continue
+		}
+		var value string
+		switch field {
+		case metadataExpiry:
+			if !expiresAt.IsZero() {
+				value = expiresAt.UTC().Format(time.RFC3339)
+			}
+		case metadataIssuer:
+			value = token.Issuer()
+		case metadataChecksum:
+			value = tokenChecksum(token.Raw)
+		}
+		if value == "" {
+			log.Printf("SECRET_METADATA_KEYS maps '%s' to key '%s', but the token has no %s. Skipping that key.", field, key, field)
+			continue
+		}
+		data[key] = []byte(value)
+	}
+	return data
+}
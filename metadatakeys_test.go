@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseSecretMetadataKeys(t *testing.T) {
+	keys, err := parseSecretMetadataKeys(" expiry=token-expiry, issuer = token-issuer,checksum=token.sha256 ,")
+	if err != nil {
+		t.Fatalf("parseSecretMetadataKeys() = %v", err)
+	}
+	want := []string{"token-expiry", "token-issuer", "token.sha256"}
+	if got := keys.keys(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("keys() = %v, want %v", got, want)
+	}
+
+	for value, problem := range map[string]string{
+		"expiry":                        "expected field=key",
+		"audience=token-aud":            "unknown field 'audience'",
+		"expiry=a,expiry=b":             "mapped twice",
+		"expiry=same,issuer=same":       "used for more than one field",
+		"checksum=not/a/valid/key name": "invalid key",
+	} {
+		if _, err := parseSecretMetadataKeys(value); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("parseSecretMetadataKeys(%q) = %v, want an error containing %q", value, err, problem)
+		}
+	}
+}
+
+func TestSecretMetadataKeysWrittenInOneWrite(t *testing.T) {
+	captureLog(t)
+	setBaseEnv(t)
+	t.Setenv("SECRET_METADATA_KEYS", "expiry=token-expiry,issuer=token-issuer,checksum=token-checksum")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	raw := testJWT(t, map[string]interface{}{"iss": "https://idp.example.com", "exp": expiresAt.Unix()})
+	data, err := buildSecretData(cfg, parseToken(raw), expiresAt)
+	if err != nil {
+		t.Fatalf("buildSecretData() = %v", err)
+	}
+	spec := testSpec()
+	spec.Data = data
+
+	clientset := fake.NewSimpleClientset()
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	writes := 0
+	for _, action := range clientset.Actions() {
+		if verb := action.GetVerb(); verb == "create" || verb == "patch" || verb == "update" {
+			writes++
+		}
+	}
+	if writes != 1 {
+		t.Errorf("secret written %d times, want the token and its metadata in one write", writes)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"token":          raw,
+		"token-expiry":   "2026-03-01T12:00:00Z",
+		"token-issuer":   "https://idp.example.com",
+		"token-checksum": tokenChecksum(raw),
+	}
+	for key, value := range want {
+		if got := string(secret.Data[key]); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestSecretMetadataKeysOpaqueToken(t *testing.T) {
+	logs := captureLog(t)
+	keys := secretMetadataKeys{metadataIssuer: "token-issuer", metadataChecksum: "token-checksum"}
+	data := keys.data(parseToken("opaque-token"), time.Time{})
+	if _, ok := data["token-issuer"]; ok {
+		t.Errorf("issuer written for an opaque token: %q", data["token-issuer"])
+	}
+	if string(data["token-checksum"]) != tokenChecksum("opaque-token") {
+		t.Errorf("checksum = %q, want it written for opaque tokens too", data["token-checksum"])
+	}
+	if !strings.Contains(logs.String(), "Skipping that key") {
+		t.Errorf("skipped issuer not logged:\n%s", logs)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Namespace discovery strategies used when TARGET_NAMESPACES is not set.
+const (
+	discoverFromList      = "list"
+	discoverFromFile      = "file"
+	discoverFromConfigMap = "configmap"
+
+	defaultNamespacesConfigMapKey = "namespaces"
+
+	// namespaceDisabledAnnotation lets a namespace opt out of distribution.
+	namespaceDisabledAnnotation = "oidc.token/disabled"
+
+	// namespaceSecretOpTimeoutAnnotation overrides K8S_SECRET_OP_TIMEOUT for
+	// one namespace, e.g. where slow admission webhooks delay secret writes.
+	namespaceSecretOpTimeoutAnnotation = "oidc.token/secret-op-timeout"
+	maxSecretOpTimeout                 = 5 * time.Minute
+
+	// namespaceSecretKeyAnnotation names the key a namespace wants the token
+	// under. With REQUIRE_NAMESPACE_OPT_IN, its presence is also the opt-in.
+	namespaceSecretKeyAnnotation = "oidc.token/secret-key"
+
+	// namespacePriorityAnnotation moves a namespace ahead of those with a
+	// lower priority, so critical namespaces get the new token first should
+	// the run be interrupted.
+	namespacePriorityAnnotation = "oidc.token/priority"
+)
+
+// parseNamespaceList splits a comma- or newline-separated list of namespace
+// names, as given in TARGET_NAMESPACES, a namespaces file or configmap.
+func parseNamespaceList(value string) []string {
+	return parseList(value)
+}
+
+// namespaceSource captures how the set of target namespaces is determined:
+// a single namespace, an explicit TARGET_NAMESPACES list or a discovery
+// strategy.
+type namespaceSource struct {
+	Single  string
+	Targets string
+	// TargetsFile holds the TARGET_NAMESPACES list instead, e.g. a namespace
+	// annotation projected by the downward API.
+	TargetsFile  string
+	Discover     string
+	File         string
+	ConfigMap    string
+	ConfigMapKey string
+
+	// LabelSelector, FieldSelector and NameRegex narrow
+	// DISCOVER_NAMESPACES=list. NameRegex is applied to the names listed.
+	LabelSelector string
+	FieldSelector string
+	NameRegex     *regexp.Regexp
+	// ToleratePartialList continues with the namespaces already listed when a
+	// later page of the list fails.
+	ToleratePartialList bool
+}
+
+// listsCluster reports whether resolving this source lists every namespace
+// in the cluster, which requires cluster-wide list permission.
+func (src namespaceSource) listsCluster() bool {
+	return src.Single == "" && !src.hasTargets() && src.Discover == discoverFromList
+}
+
+// hasTargets reports whether namespaces are named explicitly, in
+// TARGET_NAMESPACES or TARGET_NAMESPACES_FILE.
+func (src namespaceSource) hasTargets() bool {
+	return src.Targets != "" || src.TargetsFile != ""
+}
+
+func (src namespaceSource) validate() error {
+	if (src.LabelSelector != "" || src.FieldSelector != "" || src.NameRegex != nil) && !src.listsCluster() {
+		return fmt.Errorf("NAMESPACE_LABEL_SELECTOR, NAMESPACE_FIELD_SELECTOR and NAMESPACE_NAME_REGEX require DISCOVER_NAMESPACES=%s", discoverFromList)
+	}
+	if src.Single != "" {
+		if src.hasTargets() || src.Discover != "" {
+			return fmt.Errorf("SINGLE_NAMESPACE cannot be combined with %s, TARGET_NAMESPACES_FILE or DISCOVER_NAMESPACES", TargetNamespacesEnvVar)
+		}
+		if strings.ContainsAny(src.Single, ", \n") {
+			return fmt.Errorf("SINGLE_NAMESPACE must name exactly one namespace, got '%s'", src.Single)
+		}
+		return nil
+	}
+	if src.Targets != "" && src.TargetsFile != "" {
+		return fmt.Errorf("%s and TARGET_NAMESPACES_FILE cannot both be set", TargetNamespacesEnvVar)
+	}
+	if src.hasTargets() {
+		return nil
+	}
+	switch src.Discover {
+	case discoverFromList:
+		if _, err := labels.Parse(src.LabelSelector); err != nil {
+			return fmt.Errorf("NAMESPACE_LABEL_SELECTOR is invalid: %w", err)
+		}
+		if _, err := fields.ParseSelector(src.FieldSelector); err != nil {
+			return fmt.Errorf("NAMESPACE_FIELD_SELECTOR is invalid: %w", err)
+		}
+		return nil
+	case discoverFromFile:
+		if src.File == "" {
+			return fmt.Errorf("DISCOVER_NAMESPACES=%s requires NAMESPACES_FILE", discoverFromFile)
+		}
+		return nil
+	case discoverFromConfigMap:
+		if _, _, err := splitConfigMapRef(src.ConfigMap); err != nil {
+			return fmt.Errorf("DISCOVER_NAMESPACES=%s requires NAMESPACES_CONFIGMAP: %w", discoverFromConfigMap, err)
+		}
+		return nil
+	case "":
+		return fmt.Errorf("neither %s nor DISCOVER_NAMESPACES is set; set DISCOVER_NAMESPACES=%s to process every namespace in the cluster", TargetNamespacesEnvVar, discoverFromList)
+	default:
+		return fmt.Errorf("unknown DISCOVER_NAMESPACES value '%s' (expected %s, %s or %s)", src.Discover, discoverFromList, discoverFromFile, discoverFromConfigMap)
+	}
+}
+
+// resolveNamespaces returns the namespaces to process. Listed namespaces carry
+// their full metadata; namespaces named explicitly carry only their name until
+// loadNamespaceMetadata is called. It only reads from the cluster.
+func resolveNamespaces(ctx context.Context, clientset kubernetes.Interface, src namespaceSource) ([]corev1.Namespace, error) {
+	if src.Single != "" {
+		log.Printf("SINGLE_NAMESPACE is set: writing only to namespace '%s'.", src.Single)
+		return namespacesFromNames([]string{src.Single}), nil
+	}
+	if src.Targets != "" {
+		log.Printf("TARGET_NAMESPACES is set: '%s'. Processing only these namespaces.", src.Targets)
+		namespaces := parseNamespaceList(src.Targets)
+		if len(namespaces) == 0 {
+			log.Println("TARGET_NAMESPACES was set but resulted in an empty list after parsing. No namespaces to process.")
+		}
+		return namespacesFromNames(namespaces), nil
+	}
+	if src.TargetsFile != "" {
+		log.Printf("TARGET_NAMESPACES_FILE is set. Processing only the namespaces listed in '%s'.", src.TargetsFile)
+		names, err := readNamespacesFile(src.TargetsFile)
+		if err == nil && len(names) == 0 {
+			log.Println("TARGET_NAMESPACES_FILE is empty after parsing. No namespaces to process.")
+		}
+		return namespacesFromNames(names), err
+	}
+
+	switch src.Discover {
+	case discoverFromList:
+		listOptions := metav1.ListOptions{LabelSelector: src.LabelSelector, FieldSelector: src.FieldSelector}
+		if listOptions.LabelSelector != "" || listOptions.FieldSelector != "" {
+			log.Printf("DISCOVER_NAMESPACES=list. Attempting to list namespaces matching label selector '%s' and field selector '%s'.", src.LabelSelector, src.FieldSelector)
+		} else {
+			log.Println("DISCOVER_NAMESPACES=list. Attempting to list all namespaces in the cluster.")
+		}
+		listCtx, listCancel := context.WithTimeout(ctx, k8sListNamespaceTimeout)
+		defer listCancel()
+		namespaces, err := listNamespaces(listCtx, clientset, listOptions, src.ToleratePartialList)
+		if err != nil && ctx.Err() == nil && listCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timeout after %v: %w", k8sListNamespaceTimeout, err)
+		}
+		if err == nil && src.NameRegex != nil {
+			namespaces = filterNamespacesByName(namespaces, src.NameRegex)
+		}
+		if err == nil && len(namespaces) == 0 {
+			log.Println("Listed namespaces successfully, but the API server returned none. Check that the ServiceAccount's RBAC grants list on namespaces cluster-wide; a policy that filters results can yield an empty list instead of an error. Also check NAMESPACE_LABEL_SELECTOR, NAMESPACE_FIELD_SELECTOR and NAMESPACE_NAME_REGEX.")
+		}
+		return namespaces, err
+	case discoverFromFile:
+		log.Printf("DISCOVER_NAMESPACES=file. Reading namespaces from '%s'.", src.File)
+		names, err := readNamespacesFile(src.File)
+		return namespacesFromNames(names), err
+	case discoverFromConfigMap:
+		log.Printf("DISCOVER_NAMESPACES=configmap. Reading namespaces from configmap '%s' key '%s'.", src.ConfigMap, src.ConfigMapKey)
+		configMapCtx, configMapCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+		defer configMapCancel()
+		names, err := readNamespacesConfigMap(configMapCtx, clientset, src.ConfigMap, src.ConfigMapKey)
+		return namespacesFromNames(names), err
+	default:
+		return nil, src.validate()
+	}
+}
+
+func namespacesFromNames(names []string) []corev1.Namespace {
+	namespaces := make([]corev1.Namespace, 0, len(names))
+	for _, name := range names {
+		namespaces = append(namespaces, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	return namespaces
+}
+
+// secretOpTimeouts resolves the secret operation timeout for each namespace.
+type secretOpTimeouts struct {
+	Default      time.Duration
+	PerNamespace map[string]time.Duration
+}
+
+func (t secretOpTimeouts) forNamespace(namespace string) time.Duration {
+	if timeout, ok := t.PerNamespace[namespace]; ok {
+		return timeout
+	}
+	return t.Default
+}
+
+// namespaceSecretOpTimeouts reads namespaceSecretOpTimeoutAnnotation from each
+// namespace. Invalid values are ignored with a warning; values above
+// maxSecretOpTimeout are clamped to it.
+func namespaceSecretOpTimeouts(namespaces []corev1.Namespace, defaultTimeout time.Duration) secretOpTimeouts {
+	timeouts := secretOpTimeouts{Default: defaultTimeout, PerNamespace: make(map[string]time.Duration)}
+	for _, ns := range namespaces {
+		value, ok := ns.Annotations[namespaceSecretOpTimeoutAnnotation]
+		if !ok {
+			continue
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			log.Printf("Warning: namespace '%s' has an invalid %s annotation '%s'. Using the default timeout of %v.", ns.Name, namespaceSecretOpTimeoutAnnotation, value, defaultTimeout)
+			continue
+		}
+		if timeout > maxSecretOpTimeout {
+			log.Printf("Warning: namespace '%s' requests a secret operation timeout of %v. Clamping it to %v.", ns.Name, timeout, maxSecretOpTimeout)
+			timeout = maxSecretOpTimeout
+		}
+		timeouts.PerNamespace[ns.Name] = timeout
+	}
+	return timeouts
+}
+
+// namespaceSecretKeys reads namespaceSecretKeyAnnotation from each namespace.
+// An empty value keeps the default key. Values that are not valid secret keys
+// or that name a key reserved for other data are ignored with a warning.
+func namespaceSecretKeys(namespaces []corev1.Namespace, reserved []string) map[string]string {
+	keys := make(map[string]string)
+	for _, ns := range namespaces {
+		key := strings.TrimSpace(ns.Annotations[namespaceSecretKeyAnnotation])
+		if key == "" {
+			continue
+		}
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			log.Printf("Warning: namespace '%s' has an invalid %s annotation '%s' (%s). Using the default key.", ns.Name, namespaceSecretKeyAnnotation, key, strings.Join(errs, "; "))
+			continue
+		}
+		if slices.Contains(reserved, key) {
+			log.Printf("Warning: namespace '%s' requests the token under key '%s', which is reserved for other data. Using the default key.", ns.Name, key)
+			continue
+		}
+		keys[ns.Name] = key
+	}
+	return keys
+}
+
+// filterOptedInNamespaces keeps only namespaces that opted in by carrying
+// namespaceSecretKeyAnnotation, with or without a value.
+func filterOptedInNamespaces(namespaces []corev1.Namespace) []corev1.Namespace {
+	optedIn := make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if _, ok := ns.Annotations[namespaceSecretKeyAnnotation]; !ok {
+			log.Printf("Namespace '%s' has no %s annotation and REQUIRE_NAMESPACE_OPT_IN is set. Skipping.", ns.Name, namespaceSecretKeyAnnotation)
+			continue
+		}
+		optedIn = append(optedIn, ns)
+	}
+	return optedIn
+}
+
+// sortNamespaces orders namespaces by name, so processing order and logs are
+// the same from run to run regardless of the order the API returned them in.
+func sortNamespaces(namespaces []corev1.Namespace) {
+	slices.SortFunc(namespaces, func(a, b corev1.Namespace) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// prioritizeNamespaces stably orders namespaces by namespacePriorityAnnotation,
+// highest first, so namespaces of equal priority keep their existing order.
+// Namespaces without the annotation have priority 0; invalid values are
+// ignored with a warning.
+func prioritizeNamespaces(namespaces []corev1.Namespace) {
+	priorities := make(map[string]int, len(namespaces))
+	for _, ns := range namespaces {
+		value, ok := ns.Annotations[namespacePriorityAnnotation]
+		if !ok {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			log.Printf("Warning: namespace '%s' has an invalid %s annotation '%s'. Using priority 0.", ns.Name, namespacePriorityAnnotation, value)
+			continue
+		}
+		priorities[ns.Name] = priority
+	}
+	if len(priorities) == 0 {
+		return
+	}
+	slices.SortStableFunc(namespaces, func(a, b corev1.Namespace) int {
+		return cmp.Compare(priorities[b.Name], priorities[a.Name])
+	})
+}
+
+func namespaceNames(namespaces []corev1.Namespace) []string {
+	names := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
+	}
+	return names
+}
+
+// namespaceLoadOptions controls how loadNamespaceMetadata treats named
+// namespaces that do not exist.
+type namespaceLoadOptions struct {
+	// RequireExist reports every missing or unreadable namespace in one error.
+	RequireExist bool
+	// CreateMissing creates missing namespaces, managed by FieldManager.
+	CreateMissing bool
+	FieldManager  string
+}
+
+// loadNamespaceMetadata fetches labels and annotations for namespaces that
+// were named explicitly rather than listed. A namespace that cannot be read
+// (forbidden or not found) is kept without metadata and a warning is logged,
+// unless opts.RequireExist is set: then every namespace that does not exist
+// or cannot be read is reported in one error. With opts.CreateMissing, a
+// namespace that does not exist is created instead.
+func loadNamespaceMetadata(ctx context.Context, clientset kubernetes.Interface, namespaces []corev1.Namespace, opts namespaceLoadOptions) ([]corev1.Namespace, error) {
+	var missing, unreadable []string
+	loaded := make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if ns.UID != "" {
+			loaded = append(loaded, ns)
+			continue
+		}
+
+		getCtx, getCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+		var fetched *corev1.Namespace
+		err := retryKubeCall(getCtx, "namespace get", func() (err error) {
+			fetched, err = clientset.CoreV1().Namespaces().Get(getCtx, ns.Name, metav1.GetOptions{})
+			return err
+		})
+		getCancel()
+
+		switch {
+		case err == nil:
+			loaded = append(loaded, *fetched)
+		case opts.CreateMissing && apierrors.IsNotFound(err):
+			created, err := createNamespace(ctx, clientset, ns.Name, opts.FieldManager)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, *created)
+		case opts.RequireExist && apierrors.IsNotFound(err):
+			missing = append(missing, ns.Name)
+		case opts.RequireExist && apierrors.IsForbidden(err):
+			unreadable = append(unreadable, ns.Name)
+		case apierrors.IsForbidden(err) || apierrors.IsNotFound(err):
+			log.Printf("Warning: cannot read namespace '%s' (%v); its labels and annotations will be ignored.", ns.Name, err)
+			loaded = append(loaded, ns)
+		default:
+			return nil, fmt.Errorf("failed to get namespace '%s': %w", ns.Name, err)
+		}
+	}
+
+	var errs []error
+	if len(missing) > 0 {
+		errs = append(errs, fmt.Errorf("%d target namespace(s) do not exist: %s", len(missing), strings.Join(missing, ", ")))
+	}
+	if len(unreadable) > 0 {
+		errs = append(errs, fmt.Errorf("cannot verify that %d target namespace(s) exist, get on namespaces is forbidden: %s", len(unreadable), strings.Join(unreadable, ", ")))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return loaded, nil
+}
+
+// createNamespace creates a target namespace that does not exist yet. A
+// namespace created concurrently by someone else is used as is.
+func createNamespace(ctx context.Context, clientset kubernetes.Interface, name, fieldManager string) (*corev1.Namespace, error) {
+	createCtx, createCancel := context.WithTimeout(ctx, k8sSecretOpTimeout)
+	defer createCancel()
+
+	var created *corev1.Namespace
+	err := retryKubeCall(createCtx, "namespace create", func() (err error) {
+		created, err = clientset.CoreV1().Namespaces().Create(createCtx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	})
+	switch {
+	case err == nil:
+		log.Printf("Created missing target namespace '%s'.", name)
+		return created, nil
+	case apierrors.IsAlreadyExists(err):
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+	case apierrors.IsForbidden(err):
+		return nil, fmt.Errorf("cannot create missing namespace '%s'; grant the 'create' verb on 'namespaces' to the service account: %w", name, err)
+	default:
+		return nil, fmt.Errorf("failed to create namespace '%s': %w", name, err)
+	}
+}
+
+// filterNamespacesByName keeps the namespaces whose name matches re.
+func filterNamespacesByName(namespaces []corev1.Namespace, re *regexp.Regexp) []corev1.Namespace {
+	matched := make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if re.MatchString(ns.Name) {
+			matched = append(matched, ns)
+		}
+	}
+	log.Printf("NAMESPACE_NAME_REGEX '%s' matched %d of %d listed namespaces.", re, len(matched), len(namespaces))
+	return matched
+}
+
+// filterDisabledNamespaces drops namespaces that opted out via the
+// namespaceDisabledAnnotation.
+func filterDisabledNamespaces(namespaces []corev1.Namespace) []corev1.Namespace {
+	enabled := make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if disabled, _ := strconv.ParseBool(ns.Annotations[namespaceDisabledAnnotation]); disabled {
+			log.Printf("Namespace '%s' has annotation %s=true. Skipping.", ns.Name, namespaceDisabledAnnotation)
+			continue
+		}
+		enabled = append(enabled, ns)
+	}
+	return enabled
+}
+
+// splitConfigMapRef parses a "namespace/name" ConfigMap reference.
+func splitConfigMapRef(ref string) (namespace, name string, err error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("expected '<namespace>/<name>', got '%s'", ref)
+	}
+	return namespace, name, nil
+}
+
+func readNamespacesFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespaces file '%s': %w", path, err)
+	}
+	return parseNamespaceList(string(content)), nil
+}
+
+func readNamespacesConfigMap(ctx context.Context, clientset kubernetes.Interface, ref, key string) ([]string, error) {
+	namespace, name, err := splitConfigMapRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap '%s' in namespace '%s': %w", name, namespace, err)
+	}
+
+	value, ok := configMap.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("configmap '%s' in namespace '%s' has no key '%s'", name, namespace, key)
+	}
+	return parseNamespaceList(value), nil
+}
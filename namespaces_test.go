@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testNamespaceObjects(names ...string) []runtime.Object {
+	objects := make([]runtime.Object, len(names))
+	for i, name := range names {
+		objects[i] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	return objects
+}
+
+// listedNamespaces reports whether clientset was asked to list namespaces.
+func listedNamespaces(clientset *fake.Clientset) bool {
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "namespaces" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestResolveNamespacesFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "namespaces")
+	if err := os.WriteFile(path, []byte("team-a\nteam-b, team-c\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clientset := fake.NewSimpleClientset(testNamespaceObjects("team-a", "team-z")...)
+	src := namespaceSource{Discover: discoverFromFile, File: path}
+	if err := src.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	if got := namespaceNames(namespaces); !slices.Equal(got, []string{"team-a", "team-b", "team-c"}) {
+		t.Errorf("namespaces = %v", got)
+	}
+	if listedNamespaces(clientset) || src.listsCluster() {
+		t.Error("file discovery listed the cluster's namespaces")
+	}
+}
+
+// writeProjectedFile lays out content like a downward API volume: the file
+// is a symlink through ..data into a timestamped directory.
+func writeProjectedFile(t *testing.T, name, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	version := filepath.Join(dir, "..2026_03_01_12_00_00.000000001")
+	if err := os.Mkdir(version, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(version, name), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Base(version), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Symlink(filepath.Join("..data", name), path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveNamespacesFromTargetsFile(t *testing.T) {
+	captureLog(t)
+	// Annotation values are projected verbatim, without a trailing newline.
+	path := writeProjectedFile(t, "targets", " team-a, team-b\n\nteam-c ,")
+	clientset := fake.NewSimpleClientset()
+	src := namespaceSource{TargetsFile: path}
+	if err := src.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	if got := namespaceNames(namespaces); !slices.Equal(got, []string{"team-a", "team-b", "team-c"}) {
+		t.Errorf("namespaces = %v", got)
+	}
+	if listedNamespaces(clientset) || src.listsCluster() {
+		t.Error("TARGET_NAMESPACES_FILE listed the cluster's namespaces")
+	}
+
+	src.TargetsFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := resolveNamespaces(context.Background(), clientset, src); err == nil {
+		t.Error("resolveNamespaces() with a missing file = nil, want an error")
+	}
+}
+
+func TestTargetsFileRejectsOtherTargets(t *testing.T) {
+	for _, src := range []namespaceSource{
+		{Targets: "team-a", TargetsFile: "/etc/targets"},
+		{Single: "team-a", TargetsFile: "/etc/targets"},
+	} {
+		if err := src.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", src)
+		}
+	}
+	if err := (namespaceSource{TargetsFile: "/etc/targets", Discover: discoverFromList}).validate(); err != nil {
+		t.Errorf("validate() = %v, want TARGET_NAMESPACES_FILE to take precedence like TARGET_NAMESPACES", err)
+	}
+}
+
+func TestResolveNamespacesFromConfigMap(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "targets", Namespace: "ops"},
+		Data:       map[string]string{"namespaces": "team-a\nteam-b\n"},
+	})
+	src := namespaceSource{Discover: discoverFromConfigMap, ConfigMap: "ops/targets", ConfigMapKey: "namespaces"}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	if got := namespaceNames(namespaces); !slices.Equal(got, []string{"team-a", "team-b"}) {
+		t.Errorf("namespaces = %v", got)
+	}
+	if listedNamespaces(clientset) {
+		t.Error("configmap discovery listed the cluster's namespaces")
+	}
+}
+
+func TestResolveNamespacesFromList(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNamespaceObjects("team-a", "team-b")...)
+	src := namespaceSource{Discover: discoverFromList}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	if got := namespaceNames(namespaces); !slices.Equal(got, []string{"team-a", "team-b"}) {
+		t.Errorf("namespaces = %v", got)
+	}
+	if !listedNamespaces(clientset) || !src.listsCluster() {
+		t.Error("list discovery did not list the cluster's namespaces")
+	}
+}
+
+func TestNamespaceSourceRequiresExplicitDiscovery(t *testing.T) {
+	if err := (namespaceSource{}).validate(); err == nil {
+		t.Error("validate() without targets or DISCOVER_NAMESPACES = nil, want listing to be opt-in")
+	}
+	if err := (namespaceSource{Discover: discoverFromFile}).validate(); err == nil {
+		t.Error("validate() for file discovery without NAMESPACES_FILE = nil")
+	}
+}
+
+func TestSingleNamespaceWritesOneSecret(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNamespaceObjects("team-a", "team-b")...)
+	src := namespaceSource{Single: "team-b"}
+	if err := src.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	ctx := context.Background()
+	namespaces, err := resolveNamespaces(ctx, clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	names := namespaceNames(namespaces)
+	if _, err := processSecretsInNamespaces(ctx, clientset, names, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(names))); err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+
+	if listedNamespaces(clientset) {
+		t.Error("SINGLE_NAMESPACE listed the cluster's namespaces")
+	}
+	secrets, err := clientset.CoreV1().Secrets("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 1 || secrets.Items[0].Namespace != "team-b" || secrets.Items[0].Name != "oidc-token" {
+		t.Errorf("secrets = %v, want only oidc-token in team-b", secrets.Items)
+	}
+}
+
+func TestSingleNamespaceRejectsOtherSources(t *testing.T) {
+	for _, src := range []namespaceSource{
+		{Single: "team-a", Targets: "team-b"},
+		{Single: "team-a", Discover: discoverFromList},
+		{Single: "team-a,team-b"},
+	} {
+		if err := src.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", src)
+		}
+	}
+}
+
+func TestDisabledNamespaceIsSkipped(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Annotations: map[string]string{namespaceDisabledAnnotation: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-c", Annotations: map[string]string{namespaceDisabledAnnotation: "false"}}},
+	)
+	ctx := context.Background()
+	namespaces, err := resolveNamespaces(ctx, clientset, namespaceSource{Targets: "team-a,team-b,team-c"})
+	if err == nil {
+		namespaces, err = loadNamespaceMetadata(ctx, clientset, namespaces, namespaceLoadOptions{})
+	}
+	if err != nil {
+		t.Fatalf("resolving namespaces: %v", err)
+	}
+
+	got := namespaceNames(filterDisabledNamespaces(namespaces))
+	if !slices.Equal(got, []string{"team-a", "team-c"}) {
+		t.Errorf("namespaces = %v, want team-b skipped", got)
+	}
+}
+
+func TestResolveNamespacesEmptyList(t *testing.T) {
+	logs := captureLog(t)
+	namespaces, err := resolveNamespaces(context.Background(), fake.NewSimpleClientset(), namespaceSource{Discover: discoverFromList})
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v, want an empty list to be no error", err)
+	}
+	if len(namespaces) != 0 {
+		t.Errorf("namespaces = %v", namespaceNames(namespaces))
+	}
+	if got := logs.String(); !strings.Contains(got, "Listed namespaces successfully, but the API server returned none") || !strings.Contains(got, "RBAC") {
+		t.Errorf("log %q does not explain the empty list", got)
+	}
+}
+
+func TestResolveNamespacesListFailure(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "", errors.New("denied"))
+	})
+	if _, err := resolveNamespaces(context.Background(), clientset, namespaceSource{Discover: discoverFromList}); err == nil || !strings.Contains(err.Error(), "failed to list namespaces") {
+		t.Errorf("resolveNamespaces() = %v, want the list failure reported", err)
+	}
+}
+
+func TestResolveNamespacesWithLabelAndFieldSelector(t *testing.T) {
+	objects := testNamespaceObjects("team-a", "team-b", "project-x")
+	for _, object := range objects[:2] {
+		object.(*corev1.Namespace).Labels = map[string]string{"oidc-token": "enabled"}
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	src := namespaceSource{Discover: discoverFromList, LabelSelector: "oidc-token=enabled", FieldSelector: "metadata.name!=team-b"}
+	if err := src.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	// The fake clientset applies label selectors but not field selectors, so
+	// the field selector is checked on the request itself.
+	if got := namespaceNames(namespaces); slices.Contains(got, "project-x") {
+		t.Errorf("namespaces = %v, want the label selector applied", got)
+	}
+	for _, action := range clientset.Actions() {
+		list, ok := action.(k8stesting.ListAction)
+		if !ok || action.GetResource().Resource != "namespaces" {
+			continue
+		}
+		restrictions := list.GetListRestrictions()
+		if got := restrictions.Labels.String(); got != "oidc-token=enabled" {
+			t.Errorf("label selector = %q", got)
+		}
+		if got := restrictions.Fields.String(); got != "metadata.name!=team-b" {
+			t.Errorf("field selector = %q", got)
+		}
+		return
+	}
+	t.Fatal("namespaces were not listed")
+}
+
+func TestResolveNamespacesWithNameRegex(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset(testNamespaceObjects(
+		"team-payments-prod",
+		"team-search-prod",
+		"team-payments-staging",
+		"platform-prod",
+		"team-prod",
+		"my-team-x-prod",
+	)...)
+	src := namespaceSource{Discover: discoverFromList, NameRegex: regexp.MustCompile(`^team-.*-prod$`)}
+	if err := src.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	namespaces, err := resolveNamespaces(context.Background(), clientset, src)
+	if err != nil {
+		t.Fatalf("resolveNamespaces() = %v", err)
+	}
+	got := namespaceNames(namespaces)
+	slices.Sort(got)
+	if want := []string{"team-payments-prod", "team-search-prod"}; !slices.Equal(got, want) {
+		t.Errorf("namespaces = %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigNamespaceNameRegex(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("SINGLE_NAMESPACE", "")
+	t.Setenv("DISCOVER_NAMESPACES", discoverFromList)
+	t.Setenv("NAMESPACE_NAME_REGEX", `^team-(.*-prod$`)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "NAMESPACE_NAME_REGEX is invalid") {
+		t.Errorf("loadConfig() with an invalid regex = %v", err)
+	}
+
+	t.Setenv("NAMESPACE_NAME_REGEX", `^team-.*-prod$`)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.Namespaces.NameRegex == nil || !cfg.Namespaces.NameRegex.MatchString("team-a-prod") {
+		t.Errorf("NameRegex = %v", cfg.Namespaces.NameRegex)
+	}
+
+	t.Setenv("DISCOVER_NAMESPACES", "")
+	t.Setenv(TargetNamespacesEnvVar, "team-a")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "NAMESPACE_NAME_REGEX") {
+		t.Errorf("loadConfig() with TARGET_NAMESPACES = %v, want NAMESPACE_NAME_REGEX rejected", err)
+	}
+}
+
+func TestNamespaceSourceRejectsInvalidSelectors(t *testing.T) {
+	for name, src := range map[string]namespaceSource{
+		"label": {Discover: discoverFromList, LabelSelector: "team in (a"},
+		"field": {Discover: discoverFromList, FieldSelector: "metadata.name"},
+	} {
+		err := src.validate()
+		if err == nil {
+			t.Errorf("%s: validate() = nil, want the selector rejected", name)
+			continue
+		}
+		if want := "NAMESPACE_" + strings.ToUpper(name) + "_SELECTOR is invalid"; !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %q, want it to contain %q", name, err, want)
+		}
+	}
+	if err := (namespaceSource{Targets: "team-a", LabelSelector: "team=a"}).validate(); err == nil {
+		t.Error("validate() = nil, want selectors rejected without DISCOVER_NAMESPACES=list")
+	}
+}
+
+func TestSortedNamespacesProcessedInOrder(t *testing.T) {
+	namespaces := namespacesFromNames([]string{"team-c", "team-a", "kube-public", "team-b"})
+	sortNamespaces(namespaces)
+	want := []string{"kube-public", "team-a", "team-b", "team-c"}
+	if got := namespaceNames(namespaces); !slices.Equal(got, want) {
+		t.Fatalf("sorted namespaces = %v, want %v", got, want)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	names := namespaceNames(namespaces)
+	if _, err := processSecretsInNamespaces(context.Background(), clientset, names, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(names))); err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	var created []string
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "secrets" {
+			created = append(created, action.GetNamespace())
+		}
+	}
+	if !slices.Equal(created, want) {
+		t.Errorf("secrets created in %v, want sorted order %v", created, want)
+	}
+}
+
+func TestLoadConfigSortNamespaces(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if !cfg.SortNamespaces {
+		t.Error("SortNamespaces = false, want sorting on by default")
+	}
+	t.Setenv("SORT_NAMESPACES", "false")
+	if cfg, err = loadConfig(false, false); err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.SortNamespaces {
+		t.Error("SortNamespaces = true, want SORT_NAMESPACES=false to keep API order")
+	}
+}
+
+func TestPriorityNamespacesProcessedFirst(t *testing.T) {
+	logs := captureLog(t)
+	namespaces := namespacesFromNames([]string{"team-c", "team-a", "payments", "team-b", "search"})
+	priorities := map[string]string{"payments": "10", "search": "5", "team-b": "high"}
+	for i := range namespaces {
+		if priority, ok := priorities[namespaces[i].Name]; ok {
+			namespaces[i].Annotations = map[string]string{namespacePriorityAnnotation: priority}
+		}
+	}
+	sortNamespaces(namespaces)
+	prioritizeNamespaces(namespaces)
+	want := []string{"payments", "search", "team-a", "team-b", "team-c"}
+	if got := namespaceNames(namespaces); !slices.Equal(got, want) {
+		t.Fatalf("prioritized namespaces = %v, want %v", got, want)
+	}
+	if !strings.Contains(logs.String(), "'team-b' has an invalid "+namespacePriorityAnnotation) {
+		t.Errorf("log does not warn about the invalid priority:\n%s", logs)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	names := namespaceNames(namespaces)
+	if _, err := processSecretsInNamespaces(context.Background(), clientset, names, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(names))); err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	var created []string
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "secrets" {
+			created = append(created, action.GetNamespace())
+		}
+	}
+	if !slices.Equal(created, want) {
+		t.Errorf("secrets created in %v, want priority order %v", created, want)
+	}
+}
+
+func TestNamespaceSecretOpTimeouts(t *testing.T) {
+	captureLog(t)
+	annotated := func(name, timeout string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{namespaceSecretOpTimeoutAnnotation: timeout}}}
+	}
+	timeouts := namespaceSecretOpTimeouts([]corev1.Namespace{
+		annotated("webhooks", "90s"),
+		annotated("greedy", "1h"),
+		annotated("broken", "soon"),
+		annotated("negative", "-1s"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+	}, 10*time.Second)
+
+	for namespace, want := range map[string]time.Duration{
+		"webhooks": 90 * time.Second,
+		"greedy":   maxSecretOpTimeout,
+		"broken":   10 * time.Second,
+		"negative": 10 * time.Second,
+		"plain":    10 * time.Second,
+		"unknown":  10 * time.Second,
+	} {
+		if got := timeouts.forNamespace(namespace); got != want {
+			t.Errorf("timeout for %s = %v, want %v", namespace, got, want)
+		}
+	}
+}
+
+// deadlineRecorder wraps a clientset and records how long each secret get
+// was given until its context's deadline.
+type deadlineRecorder struct {
+	kubernetes.Interface
+	mu        sync.Mutex
+	remaining map[string]time.Duration
+}
+
+func (r *deadlineRecorder) CoreV1() typedcorev1.CoreV1Interface {
+	return deadlineCoreV1{CoreV1Interface: r.Interface.CoreV1(), recorder: r}
+}
+
+type deadlineCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	recorder *deadlineRecorder
+}
+
+func (c deadlineCoreV1) Secrets(namespace string) typedcorev1.SecretInterface {
+	return deadlineSecrets{SecretInterface: c.CoreV1Interface.Secrets(namespace), recorder: c.recorder, namespace: namespace}
+}
+
+type deadlineSecrets struct {
+	typedcorev1.SecretInterface
+	recorder  *deadlineRecorder
+	namespace string
+}
+
+func (s deadlineSecrets) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.recorder.mu.Lock()
+		s.recorder.remaining[s.namespace] = time.Until(deadline)
+		s.recorder.mu.Unlock()
+	}
+	return s.SecretInterface.Get(ctx, name, opts)
+}
+
+func TestAnnotatedNamespaceGetsLongerTimeout(t *testing.T) {
+	clientset := &deadlineRecorder{Interface: fake.NewSimpleClientset(), remaining: make(map[string]time.Duration)}
+	timeouts := namespaceSecretOpTimeouts([]corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{
+		Name:        "webhooks",
+		Annotations: map[string]string{namespaceSecretOpTimeoutAnnotation: "2m"},
+	}}}, 10*time.Second)
+
+	namespaces := []string{"webhooks", "plain"}
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, testSpec(), timeouts, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	if summary.Created != 2 {
+		t.Errorf("summary = %s, want both secrets created", summary)
+	}
+	if got := clientset.remaining["webhooks"]; got <= 10*time.Second || got > 2*time.Minute {
+		t.Errorf("annotated namespace had %v left, want the 2m annotation applied", got)
+	}
+	if got := clientset.remaining["plain"]; got <= 0 || got > 10*time.Second {
+		t.Errorf("plain namespace had %v left, want the 10s default", got)
+	}
+}
+
+func TestRequireNamespacesExist(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNamespaceObjects("team-a", "team-b")...)
+	targets := namespacesFromNames(parseNamespaceList("team-a,team-typo,team-b"))
+
+	_, err := loadNamespaceMetadata(context.Background(), clientset, targets, namespaceLoadOptions{RequireExist: true})
+	if err == nil || !strings.Contains(err.Error(), "1 target namespace(s) do not exist: team-typo") {
+		t.Fatalf("loadNamespaceMetadata() = %v, want the missing namespace listed", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource == "secrets" {
+			t.Errorf("unexpected %s of a secret before the check failed", action.GetVerb())
+		}
+	}
+
+	// Without the option the missing namespace is kept, with a warning.
+	logs := captureLog(t)
+	loaded, err := loadNamespaceMetadata(context.Background(), clientset, targets, namespaceLoadOptions{})
+	if err != nil {
+		t.Fatalf("loadNamespaceMetadata() = %v", err)
+	}
+	if got := namespaceNames(loaded); !slices.Equal(got, []string{"team-a", "team-typo", "team-b"}) {
+		t.Errorf("namespaces = %v", got)
+	}
+	if !strings.Contains(logs.String(), "cannot read namespace 'team-typo'") {
+		t.Errorf("log %q does not warn about the missing namespace", logs)
+	}
+}
+
+func TestCreateMissingNamespaceThenSecret(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset(testNamespaceObjects("team-a")...)
+	targets := namespacesFromNames([]string{"team-a", "team-new"})
+
+	loaded, err := loadNamespaceMetadata(context.Background(), clientset, targets, namespaceLoadOptions{CreateMissing: true, FieldManager: "oidc-jwt-fetcher"})
+	if err != nil {
+		t.Fatalf("loadNamespaceMetadata() = %v", err)
+	}
+	names := namespaceNames(loaded)
+	if _, err := processSecretsInNamespaces(context.Background(), clientset, names, testSpec(), secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(names))); err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+
+	var order []string
+	for _, action := range clientset.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok {
+			order = append(order, action.GetResource().Resource+"/"+action.GetNamespace())
+			if ns, ok := create.GetObject().(*corev1.Namespace); ok && ns.Name != "team-new" {
+				t.Errorf("created namespace %s, want only the missing one", ns.Name)
+			}
+		}
+	}
+	want := []string{"namespaces/", "secrets/team-a", "secrets/team-new"}
+	if !slices.Equal(order, want) {
+		t.Errorf("creates = %v, want %v", order, want)
+	}
+}
+
+func TestCreateMissingNamespacesOnlyForNamedTargets(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("CREATE_MISSING_NAMESPACES", "true")
+	if _, err := loadConfig(false, false); err != nil {
+		t.Errorf("loadConfig() with SINGLE_NAMESPACE = %v", err)
+	}
+	t.Setenv("SINGLE_NAMESPACE", "")
+	t.Setenv("DISCOVER_NAMESPACES", discoverFromList)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "CREATE_MISSING_NAMESPACES requires") {
+		t.Errorf("loadConfig() with DISCOVER_NAMESPACES=list = %v, want it rejected", err)
+	}
+}
+
+func TestNamespaceOptInAndOptOut(t *testing.T) {
+	logs := captureLog(t)
+	annotated := func(name string, annotations map[string]string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+	}
+	namespaces := []corev1.Namespace{
+		annotated("custom-key", map[string]string{namespaceSecretKeyAnnotation: "id-token"}),
+		annotated("default-key", map[string]string{namespaceSecretKeyAnnotation: ""}),
+		annotated("silent", nil),
+		annotated("opted-out", map[string]string{namespaceSecretKeyAnnotation: "id-token", namespaceDisabledAnnotation: "true"}),
+	}
+
+	kept := filterOptedInNamespaces(filterDisabledNamespaces(namespaces))
+	if got := namespaceNames(kept); !slices.Equal(got, []string{"custom-key", "default-key"}) {
+		t.Fatalf("namespaces = %v, want only those that opted in and not out", got)
+	}
+	for _, want := range []string{"Namespace 'silent' has no " + namespaceSecretKeyAnnotation, "Namespace 'opted-out' has annotation " + namespaceDisabledAnnotation} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log %q does not contain %q", logs, want)
+		}
+	}
+
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.TokenKeys = namespaceSecretKeys(kept, []string{"claims"})
+	names := namespaceNames(kept)
+	if _, err := processSecretsInNamespaces(context.Background(), clientset, names, spec, secretOpTimeouts{Default: time.Minute}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(names))); err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	for namespace, key := range map[string]string{"custom-key": "id-token", "default-key": "token"} {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(context.Background(), spec.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("secret in %s: %v", namespace, err)
+		}
+		if len(secret.Data) != 1 || string(secret.Data[key]) != "header.payload.signature" {
+			t.Errorf("secret in %s holds %v, want the token under %s only", namespace, secret.Data, key)
+		}
+	}
+}
+
+func TestNamespaceSecretKeysRejectsReservedAndInvalid(t *testing.T) {
+	captureLog(t)
+	keys := namespaceSecretKeys([]corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "reserved", Annotations: map[string]string{namespaceSecretKeyAnnotation: "claims"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "invalid", Annotations: map[string]string{namespaceSecretKeyAnnotation: "no/slashes"}}},
+	}, []string{"claims"})
+	if len(keys) != 0 {
+		t.Errorf("keys = %v, want reserved and invalid keys ignored", keys)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const redacted = "***"
+
+// configLines renders every exported config field as "Name: value", one per
+// line, for PRINT_CONFIG. Fields tagged `redact:"true"` are shown as *** when
+// set, and passwords embedded in URLs are masked, so the output is safe to
+// log. Nested structs and slices of structs are flattened with dotted and
+// indexed names.
+func configLines(cfg *config) []string {
+	var lines []string
+	appendConfigLines(&lines, "", reflect.ValueOf(*cfg))
+	return lines
+}
+
+func appendConfigLines(lines *[]string, prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := prefix + field.Name
+		value := v.Field(i)
+		if field.Tag.Get("redact") == "true" {
+			if value.IsZero() {
+				*lines = append(*lines, name+": ")
+			} else {
+				*lines = append(*lines, name+": "+redacted)
+			}
+			continue
+		}
+		appendConfigValue(lines, name, value)
+	}
+}
+
+func appendConfigValue(lines *[]string, name string, value reflect.Value) {
+	if stringer, ok := value.Interface().(fmt.Stringer); ok && !(value.Kind() == reflect.Pointer && value.IsNil()) {
+		*lines = append(*lines, name+": "+redactURLPassword(stringer.String()))
+		return
+	}
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			*lines = append(*lines, name+": <unset>")
+			return
+		}
+		appendConfigValue(lines, name, value.Elem())
+	case reflect.Struct:
+		appendConfigLines(lines, name+".", value)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < value.Len(); i++ {
+				appendConfigLines(lines, fmt.Sprintf("%s[%d].", name, i), value.Index(i))
+			}
+			return
+		}
+		items := make([]string, 0, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, redactURLPassword(fmt.Sprint(value.Index(i).Interface())))
+		}
+		*lines = append(*lines, name+": ["+strings.Join(items, ", ")+"]")
+	case reflect.Map:
+		keys := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			keys = append(keys, fmt.Sprint(key.Interface()))
+		}
+		sort.Strings(keys)
+		*lines = append(*lines, name+": keys ["+strings.Join(keys, ", ")+"]")
+	default:
+		*lines = append(*lines, name+": "+redactURLPassword(fmt.Sprint(value.Interface())))
+	}
+}
+
+// redactURLPassword masks the password of a URL with user info, leaving any
+// other value unchanged.
+func redactURLPassword(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil {
+		return value
+	}
+	if _, ok := parsed.User.Password(); !ok {
+		return value
+	}
+	return parsed.Redacted()
+}
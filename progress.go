@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+const defaultProgressLogInterval = 50
+
+// progressLogger logs aggregate progress every interval namespaces. It is
+// safe for concurrent use. An interval of 0 disables progress lines and
+// restores one log line per namespace.
+type progressLogger struct {
+	mu        sync.Mutex
+	interval  int
+	total     int
+	processed int
+	failed    int
+}
+
+func newProgressLogger(interval, total int) *progressLogger {
+	return &progressLogger{interval: interval, total: total}
+}
+
+// logsEachNamespace reports whether per-namespace success lines should be
+// logged instead of periodic progress lines.
+func (p *progressLogger) logsEachNamespace() bool {
+	return p.interval == 0
+}
+
+func (p *progressLogger) record(failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.processed++
+	if failed {
+		p.failed++
+	}
+	if p.interval > 0 && (p.processed%p.interval == 0 || p.processed == p.total) {
+		log.Printf("Progress: processed %d/%d namespaces, %d failed", p.processed, p.total, p.failed)
+	}
+}
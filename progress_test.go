@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProgressLoggerCadence(t *testing.T) {
+	logs := captureLog(t)
+	progress := newProgressLogger(3, 7)
+	for i := 0; i < 7; i++ {
+		progress.record(i == 1)
+	}
+
+	want := []string{
+		"Progress: processed 3/7 namespaces, 1 failed",
+		"Progress: processed 6/7 namespaces, 1 failed",
+		"Progress: processed 7/7 namespaces, 1 failed",
+	}
+	if got := strings.Split(strings.TrimSpace(logs.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("progress lines = %q, want %q", got, want)
+	}
+	if progress.logsEachNamespace() {
+		t.Error("logsEachNamespace() = true with an interval")
+	}
+}
+
+func TestProgressLoggerConcurrent(t *testing.T) {
+	logs := captureLog(t)
+	progress := newProgressLogger(10, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			progress.record(false)
+		}()
+	}
+	wg.Wait()
+	if got := strings.Count(logs.String(), "Progress:"); got != 10 {
+		t.Errorf("got %d progress lines, want 10", got)
+	}
+}
+
+func TestProgressLoggerDisabled(t *testing.T) {
+	logs := captureLog(t)
+	progress := newProgressLogger(0, 5)
+	for i := 0; i < 5; i++ {
+		progress.record(false)
+	}
+	if logs.Len() != 0 || !progress.logsEachNamespace() {
+		t.Errorf("interval 0 logged %q, want per-namespace logging instead", logs)
+	}
+}
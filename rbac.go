@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type accessCheck struct {
+	verb      string
+	resource  string
+	namespace string
+	name      string
+}
+
+func (c accessCheck) String() string {
+	target := c.resource
+	if c.name != "" {
+		target = fmt.Sprintf("%s '%s'", c.resource, c.name)
+	}
+	if c.namespace == "" {
+		return fmt.Sprintf("'%s' on %s (cluster-wide)", c.verb, target)
+	}
+	return fmt.Sprintf("'%s' on %s in namespace '%s'", c.verb, target, c.namespace)
+}
+
+func namespaceListChecks() []accessCheck {
+	return []accessCheck{{verb: "list", resource: "namespaces"}}
+}
+
+// secretAccessChecks mirrors the verbs createOrUpdateSecret uses. Create cannot
+// be scoped by resource name in RBAC, so it is checked without one.
+// secretNames maps namespaces to their own secret name, overriding secretName.
+// recreate adds the delete replaceImmutableSecret needs, for SECRET_IMMUTABLE
+// and ALLOW_IMMUTABLE_RECREATE.
+func secretAccessChecks(namespaces []string, secretName string, secretNames map[string]string, recreate bool) []accessCheck {
+	return targetAccessChecks("secrets", namespaces, secretName, secretNames, recreate)
+}
+
+// targetAccessChecks is secretAccessChecks for the resource the token is
+// written to: secrets, or configmaps with OUTPUT_MODE=configmap.
+func targetAccessChecks(resource string, namespaces []string, secretName string, secretNames map[string]string, recreate bool) []accessCheck {
+	checks := make([]accessCheck, 0, len(namespaces)*4)
+	for _, ns := range namespaces {
+		name := secretName
+		if override, ok := secretNames[ns]; ok {
+			name = override
+		}
+		checks = append(checks,
+			accessCheck{verb: "get", resource: resource, namespace: ns, name: name},
+			accessCheck{verb: "create", resource: resource, namespace: ns},
+			accessCheck{verb: "patch", resource: resource, namespace: ns, name: name},
+		)
+		if recreate {
+			checks = append(checks, accessCheck{verb: "delete", resource: resource, namespace: ns, name: name})
+		}
+	}
+	return checks
+}
+
+// preflightRBACCheck asks the API server, via SelfSubjectAccessReview, whether
+// the current identity may perform each check, and reports all denials at once.
+func preflightRBACCheck(ctx context.Context, clientset kubernetes.Interface, checks []accessCheck) error {
+	var denied []string
+	for _, check := range checks {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: check.namespace,
+					Verb:      check.verb,
+					Resource:  check.resource,
+					Name:      check.name,
+				},
+			},
+		}
+		result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to review access for %s: %w", check, err)
+		}
+		if !result.Status.Allowed {
+			denied = append(denied, check.String())
+		}
+	}
+
+	if len(denied) > 0 {
+		return fmt.Errorf("service account is missing %d permission(s): %s", len(denied), strings.Join(denied, "; "))
+	}
+	return nil
+}
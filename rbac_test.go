@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeAccessReviews makes SelfSubjectAccessReviews deny every verb in denied
+// and allow the rest.
+func fakeAccessReviews(denied ...string) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		allowed := true
+		for _, verb := range denied {
+			if review.Spec.ResourceAttributes.Verb == verb {
+				allowed = false
+			}
+		}
+		review.Status.Allowed = allowed
+		return true, review, nil
+	})
+	return clientset
+}
+
+func TestPreflightRBACCheckAllowed(t *testing.T) {
+	checks := secretAccessChecks([]string{"team-a", "team-b"}, "oidc-token", nil, false)
+	if err := preflightRBACCheck(context.Background(), fakeAccessReviews(), checks); err != nil {
+		t.Fatalf("preflightRBACCheck() = %v, want nil", err)
+	}
+}
+
+func TestPreflightRBACCheckDenied(t *testing.T) {
+	checks := secretAccessChecks([]string{"team-a", "team-b"}, "oidc-token", nil, false)
+	err := preflightRBACCheck(context.Background(), fakeAccessReviews("patch"), checks)
+	if err == nil {
+		t.Fatal("preflightRBACCheck() = nil, want an error")
+	}
+	for _, want := range []string{"2 permission(s)", "'patch' on secrets 'oidc-token' in namespace 'team-a'", "namespace 'team-b'"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestSecretAccessChecksDelete(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		checks := secretAccessChecks([]string{"team-a"}, "oidc-token", map[string]string{"team-a": "custom"}, recreate)
+		var verbs []string
+		for _, check := range checks {
+			verbs = append(verbs, check.verb)
+			if check.name != "" && check.name != "custom" {
+				t.Errorf("check %s uses name %q, want the per-namespace name", check, check.name)
+			}
+		}
+		got := strings.Join(verbs, ",")
+		want := "get,create,patch"
+		if recreate {
+			want += ",delete"
+		}
+		if got != want {
+			t.Errorf("recreate=%v: verbs = %s, want %s", recreate, got, want)
+		}
+	}
+
+	err := preflightRBACCheck(context.Background(), fakeAccessReviews("delete"), secretAccessChecks([]string{"team-a"}, "oidc-token", nil, true))
+	if err == nil || !strings.Contains(err.Error(), "'delete'") {
+		t.Errorf("preflightRBACCheck() = %v, want a missing delete permission", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Values accepted by DISTRIBUTION_MODE.
+const (
+	distributionCopy      = "copy"
+	distributionReference = "reference"
+)
+
+// Keys of the reference ConfigMap written into each target namespace in
+// reference mode.
+const (
+	referenceNamespaceKey = "secretNamespace"
+	referenceNameKey      = "secretName"
+	referenceKeyKey       = "secretKey"
+)
+
+// secretReference points target namespaces at the central secret holding the
+// token, instead of giving each its own copy.
+type secretReference struct {
+	// ConfigMapName is the ConfigMap written into each target namespace.
+	ConfigMapName string
+	Namespace     string
+	SecretName    string
+	SecretKey     string
+}
+
+func (r *secretReference) data() map[string]string {
+	return map[string]string{
+		referenceNamespaceKey: r.Namespace,
+		referenceNameKey:      r.SecretName,
+		referenceKeyKey:       r.SecretKey,
+	}
+}
+
+// createOrUpdateReference writes the reference ConfigMap, re-reading and
+// retrying it when it was modified concurrently, like createOrUpdateSecret.
+func createOrUpdateReference(ctx context.Context, clientset kubernetes.Interface, namespace string, ref *secretReference, fieldManager string) (secretOperation, error) {
+	var operation secretOperation
+	policy := secretConflictPolicy
+	policy.Name = fmt.Sprintf("write of configmap '%s' in namespace '%s'", ref.ConfigMapName, namespace)
+	err := retryWithBackoff(ctx, policy, func() (err error) {
+		operation, err = writeSecretReference(ctx, clientset, namespace, ref, fieldManager)
+		return err
+	})
+	return operation, err
+}
+
+// writeSecretReference creates or updates the reference ConfigMap in
+// namespace. Only the reference keys are written; other keys are kept.
+func writeSecretReference(ctx context.Context, clientset kubernetes.Interface, namespace string, ref *secretReference, fieldManager string) (secretOperation, error) {
+	configMapClient := clientset.CoreV1().ConfigMaps(namespace)
+	var existing *corev1.ConfigMap
+	err := retryKubeCall(ctx, "configmap get", func() (err error) {
+		existing, err = configMapClient.Get(ctx, ref.ConfigMapName, metav1.GetOptions{})
+		return err
+	})
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: ref.ConfigMapName, Namespace: namespace},
+			Data:       ref.data(),
+		}
+		err := retryKubeCall(ctx, "configmap create", func() error {
+			_, err := configMapClient.Create(ctx, configMap, metav1.CreateOptions{FieldManager: fieldManager})
+			return err
+		})
+		if err != nil {
+			return "", referenceWriteError("create", namespace, ref.ConfigMapName, err)
+		}
+		return secretCreated, nil
+	case err != nil:
+		return "", referenceWriteError("get", namespace, ref.ConfigMapName, err)
+	}
+
+	current := make(map[string]string, len(ref.data()))
+	for key := range ref.data() {
+		if value, ok := existing.Data[key]; ok {
+			current[key] = value
+		}
+	}
+	if maps.Equal(current, ref.data()) {
+		return secretUnchanged, nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": existing.ResourceVersion},
+		"data":     ref.data(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal patch payload for configmap '%s' in namespace '%s': %w", ref.ConfigMapName, namespace, err)
+	}
+	err = retryKubeCall(ctx, "configmap patch", func() error {
+		_, err := configMapClient.Patch(ctx, ref.ConfigMapName, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+	if err != nil {
+		return "", referenceWriteError("patch", namespace, ref.ConfigMapName, err)
+	}
+	return secretUpdated, nil
+}
+
+func referenceWriteError(verb, namespace, name string, err error) error {
+	if apierrors.IsForbidden(err) && !isQuotaExceeded(err) {
+		return fmt.Errorf("permission denied: cannot '%s' configmap '%s' in namespace '%s'; grant the '%s' verb on 'configmaps' in that namespace to the service account: %w", verb, name, namespace, verb, err)
+	}
+	return fmt.Errorf("failed to %s configmap '%s' in namespace '%s': %w", verb, name, namespace, err)
+}
+
+// referenceAccessChecks mirrors the verbs writeSecretReference uses.
+func referenceAccessChecks(namespaces []string, configMapName string) []accessCheck {
+	checks := make([]accessCheck, 0, len(namespaces)*3)
+	for _, ns := range namespaces {
+		checks = append(checks,
+			accessCheck{verb: "get", resource: "configmaps", namespace: ns, name: configMapName},
+			accessCheck{verb: "create", resource: "configmaps", namespace: ns},
+			accessCheck{verb: "patch", resource: "configmaps", namespace: ns, name: configMapName},
+		)
+	}
+	return checks
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testReference() *secretReference {
+	return &secretReference{
+		ConfigMapName: "oidc-token-ref",
+		Namespace:     "oidc-central",
+		SecretName:    "oidc-token",
+		SecretKey:     "token",
+	}
+}
+
+func TestWriteCentralSecret(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	cfg := &config{CentralSecretNamespace: "oidc-central", ReferenceConfigMapName: "oidc-token-ref"}
+
+	ref, err := writeCentralSecret(context.Background(), clientset, cfg, testSpec())
+	if err != nil {
+		t.Fatalf("writeCentralSecret() = %v", err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("oidc-central").Get(context.Background(), "oidc-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("central secret not written: %v", err)
+	}
+	if string(secret.Data["token"]) != "header.payload.signature" {
+		t.Errorf("central secret token = %q", secret.Data["token"])
+	}
+	if *ref != *testReference() {
+		t.Errorf("writeCentralSecret() = %+v, want %+v", *ref, *testReference())
+	}
+}
+
+func TestWriteCentralSecretFailure(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "oidc-token", errors.New("denied"))
+	})
+	cfg := &config{CentralSecretNamespace: "oidc-central", ReferenceConfigMapName: "oidc-token-ref"}
+
+	ref, err := writeCentralSecret(context.Background(), clientset, cfg, testSpec())
+	if err == nil || ref != nil {
+		t.Fatalf("writeCentralSecret() = %v, %v, want an error", ref, err)
+	}
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "namespace 'oidc-central'") {
+		t.Errorf("writeCentralSecret() error = %v, want the forbidden error naming the central namespace", err)
+	}
+}
+
+func TestProcessSecretsInNamespacesReferenceMode(t *testing.T) {
+	captureLog(t)
+	namespaces := testNamespaces(2)
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.Reference = testReference()
+
+	summary, err := processSecretsInNamespaces(context.Background(), clientset, namespaces, spec, secretOpTimeouts{Default: k8sSecretOpTimeout}, newNamespaceBatcher(0, 0), newProgressLogger(0, len(namespaces)))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	if summary.Created != len(namespaces) {
+		t.Errorf("Created = %d, want %d", summary.Created, len(namespaces))
+	}
+	for _, ns := range namespaces {
+		configMap, err := clientset.CoreV1().ConfigMaps(ns).Get(context.Background(), "oidc-token-ref", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("reference configmap missing in %s: %v", ns, err)
+		}
+		want := map[string]string{referenceNamespaceKey: "oidc-central", referenceNameKey: "oidc-token", referenceKeyKey: "token"}
+		for key, value := range want {
+			if configMap.Data[key] != value {
+				t.Errorf("%s: configmap %s = %q, want %q", ns, key, configMap.Data[key], value)
+			}
+		}
+		secrets, _ := clientset.CoreV1().Secrets(ns).List(context.Background(), metav1.ListOptions{})
+		if len(secrets.Items) != 0 {
+			t.Errorf("%s: reference mode copied %d secrets into the namespace", ns, len(secrets.Items))
+		}
+	}
+}
+
+func TestCreateOrUpdateReference(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token-ref", Namespace: "team-a"},
+		Data:       map[string]string{referenceNamespaceKey: "old-central", "owner": "platform"},
+	})
+	ref := testReference()
+
+	operation, err := createOrUpdateReference(ctx, clientset, "team-a", ref, "oidc-jwt-fetcher")
+	if err != nil || operation != secretUpdated {
+		t.Fatalf("createOrUpdateReference() = %q, %v, want %q", operation, err, secretUpdated)
+	}
+	configMap, _ := clientset.CoreV1().ConfigMaps("team-a").Get(ctx, "oidc-token-ref", metav1.GetOptions{})
+	if configMap.Data[referenceNamespaceKey] != "oidc-central" {
+		t.Errorf("%s = %q, want the patched value", referenceNamespaceKey, configMap.Data[referenceNamespaceKey])
+	}
+	if configMap.Data["owner"] != "platform" {
+		t.Errorf("unrelated key was dropped: %v", configMap.Data)
+	}
+
+	operation, err = createOrUpdateReference(ctx, clientset, "team-a", ref, "oidc-jwt-fetcher")
+	if err != nil || operation != secretUnchanged {
+		t.Errorf("second createOrUpdateReference() = %q, %v, want %q", operation, err, secretUnchanged)
+	}
+}
+
+func TestReferenceWriteErrorForbidden(t *testing.T) {
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "oidc-token-ref", errors.New("denied"))
+	err := referenceWriteError("create", "team-a", "oidc-token-ref", forbidden)
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "grant the 'create' verb on 'configmaps'") {
+		t.Errorf("referenceWriteError() = %v, want a hint naming the missing verb", err)
+	}
+}
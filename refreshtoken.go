@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultRefreshTokenSecretName = "oidc-jwt-fetcher-refresh-token"
+	refreshTokenKey               = "refresh_token"
+
+	// offlineAccessScope asks the IdP for a refresh token alongside the
+	// access token.
+	offlineAccessScope = "offline_access"
+)
+
+// requestsOfflineAccess reports whether scopes, as normalized by
+// normalizeScopes, include offlineAccessScope.
+func requestsOfflineAccess(scopes string) bool {
+	return slices.Contains(strings.Fields(scopes), offlineAccessScope)
+}
+
+// storeRefreshToken writes the refresh token returned with the access token
+// to the secret named by REFRESH_TOKEN_SECRET_NAMESPACE and
+// REFRESH_TOKEN_SECRET_NAME, for later use with the refresh_token grant. A
+// response without a refresh token leaves the secret as it is, since the IdP
+// may only issue one on some requests. The token itself is never logged.
+func storeRefreshToken(ctx context.Context, clientset kubernetes.Interface, namespace, secretName, fieldManager, refreshToken string) error {
+	if refreshToken == "" {
+		log.Printf("Token response holds no refresh token. Leaving secret '%s' in namespace '%s' unchanged.", secretName, namespace)
+		return nil
+	}
+	operation, err := createOrUpdateSecret(ctx, clientset, namespace, secretSpec{
+		Name:         secretName,
+		Type:         corev1.SecretTypeOpaque,
+		Data:         map[string][]byte{refreshTokenKey: []byte(refreshToken)},
+		FieldManager: fieldManager,
+		TokenKey:     refreshTokenKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token in secret '%s' in namespace '%s': %w", secretName, namespace, err)
+	}
+	log.Printf("Refresh token secret '%s' in namespace '%s' %s.", secretName, namespace, operation)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRefreshTokenStoredAndNotLogged(t *testing.T) {
+	logs := captureLog(t)
+	server := newFakeTokenServer(t, `{"access_token":"header.payload.signature","expires_in":3600,"refresh_token":"very-secret-refresh"}`)
+	req := testTokenRequest(server.URL)
+	req.Scopes = "openid offline_access"
+
+	response, err := fetchOIDCToken(context.Background(), http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+	if response.RefreshToken != "very-secret-refresh" {
+		t.Fatalf("RefreshToken = %q, want the one from the response", response.RefreshToken)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	if err := storeRefreshToken(context.Background(), clientset, "oidc-central", defaultRefreshTokenSecretName, "oidc-jwt-fetcher", response.RefreshToken); err != nil {
+		t.Fatalf("storeRefreshToken() = %v", err)
+	}
+	secret, err := clientset.CoreV1().Secrets("oidc-central").Get(context.Background(), defaultRefreshTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("refresh token secret not written: %v", err)
+	}
+	if got := string(secret.Data[refreshTokenKey]); got != "very-secret-refresh" {
+		t.Errorf("secret %s = %q, want the refresh token", refreshTokenKey, got)
+	}
+	if strings.Contains(logs.String(), "very-secret-refresh") {
+		t.Errorf("refresh token was logged:\n%s", logs)
+	}
+}
+
+func TestMissingRefreshTokenLeavesSecretUnchanged(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	if err := storeRefreshToken(context.Background(), clientset, "oidc-central", defaultRefreshTokenSecretName, "oidc-jwt-fetcher", ""); err != nil {
+		t.Fatalf("storeRefreshToken() = %v", err)
+	}
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Errorf("storeRefreshToken() without a refresh token made %d API calls", len(actions))
+	}
+}
+
+func TestLoadConfigRefreshTokenRequiresOfflineAccess(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("REFRESH_TOKEN_SECRET_NAMESPACE", "oidc-central")
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "requires the offline_access scope") {
+		t.Errorf("loadConfig() = %v, want offline_access required", err)
+	}
+
+	t.Setenv("OIDC_SCOPES", "openid offline_access")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.RefreshTokenSecretName != defaultRefreshTokenSecretName {
+		t.Errorf("RefreshTokenSecretName = %q, want the default", cfg.RefreshTokenSecretName)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// restartedAtAnnotation is the pod template annotation `kubectl rollout
+// restart` sets; changing it rolls the Deployment's pods.
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// restartConsumers triggers a rolling restart of every Deployment in
+// namespace whose pod template references secretName, for RESTART_CONSUMERS,
+// so pods that read the token from their environment pick up the new one.
+// The restart stamps checksum into the pod template's checksumAnnotation, and
+// Deployments already stamped with it are left alone, so a token is rolled
+// out at most once. Failures are logged and do not fail the namespace: the
+// secret itself was written.
+func restartConsumers(ctx context.Context, clientset kubernetes.Interface, namespace, secretName, checksum, fieldManager string, now time.Time) {
+	var deployments *appsv1.DeploymentList
+	err := retryKubeCall(ctx, "deployment list", func() (err error) {
+		deployments, err = clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{ResourceVersion: "0"})
+		return err
+	})
+	if err != nil {
+		log.Printf("Warning: could not list deployments in namespace '%s' to restart consumers of secret '%s': %v", namespace, secretName, err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						restartedAtAnnotation: now.UTC().Format(time.RFC3339),
+						checksumAnnotation:    checksum,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: failed to marshal restart patch: %v", err)
+		return
+	}
+	for _, deployment := range deployments.Items {
+		if !podSpecReferencesSecret(deployment.Spec.Template.Spec, secretName) {
+			continue
+		}
+		if deployment.Spec.Template.Annotations[checksumAnnotation] == checksum {
+			log.Printf("Deployment '%s' in namespace '%s' already runs the current token. Not restarting it.", deployment.Name, namespace)
+			continue
+		}
+		if err := restartDeployment(ctx, clientset, namespace, deployment.Name, patch, fieldManager); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		log.Printf("Restarted deployment '%s' in namespace '%s' to pick up the new token.", deployment.Name, namespace)
+	}
+}
+
+func restartDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, name string, patch []byte, fieldManager string) error {
+	err := retryKubeCall(ctx, "deployment patch", func() error {
+		_, err := clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restart deployment '%s' in namespace '%s': %w", name, namespace, err)
+	}
+	return nil
+}
+
+// restartChecksum identifies the token restartConsumers rolls out: the
+// secret's checksum annotation when CHECKSUM_ANNOTATION is set, otherwise a
+// hash of the data under the token key.
+func (s secretSpec) restartChecksum() string {
+	if s.Checksum != "" {
+		return s.Checksum
+	}
+	return tokenChecksum(string(s.Data[s.TokenKey]))
+}
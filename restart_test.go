@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRestartConsumersOnlyWhenTokenChanged(t *testing.T) {
+	newChecksum := tokenChecksum("header.payload.signature")
+	tests := map[string]struct {
+		secretToken       string
+		templateChecksum  string
+		wantRestartedWith string
+	}{
+		"token changed":                       {"old", "", newChecksum},
+		"token unchanged":                     {"header.payload.signature", "", ""},
+		"consumer already runs the new token": {"old", newChecksum, ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			captureLog(t)
+			consumer := testDeployment("team-a", "api", secretVolumePodSpec("oidc-token"))
+			if tt.templateChecksum != "" {
+				consumer.Spec.Template.Annotations = map[string]string{checksumAnnotation: tt.templateChecksum}
+			}
+			bystander := testDeployment("team-a", "web", secretVolumePodSpec("other-secret"))
+			clientset := fake.NewSimpleClientset(consumer, bystander, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a"},
+				Data:       map[string][]byte{"token": []byte(tt.secretToken)},
+			})
+			spec := testSpec()
+			spec.RestartConsumers = true
+
+			_, err := processSecretsInNamespaces(context.Background(), clientset, []string{"team-a"}, spec, secretOpTimeouts{Default: k8sSecretOpTimeout}, newNamespaceBatcher(0, 0), newProgressLogger(0, 1))
+			if err != nil {
+				t.Fatalf("processSecretsInNamespaces() = %v", err)
+			}
+
+			api, _ := clientset.AppsV1().Deployments("team-a").Get(context.Background(), "api", metav1.GetOptions{})
+			restartedAt := api.Spec.Template.Annotations[restartedAtAnnotation]
+			if tt.wantRestartedWith == "" {
+				if restartedAt != "" {
+					t.Errorf("consumer restarted at %s, want no restart", restartedAt)
+				}
+			} else {
+				if _, err := time.Parse(time.RFC3339, restartedAt); err != nil {
+					t.Errorf("%s = %q, want a restart timestamp", restartedAtAnnotation, restartedAt)
+				}
+				if got := api.Spec.Template.Annotations[checksumAnnotation]; got != tt.wantRestartedWith {
+					t.Errorf("%s = %q, want %q", checksumAnnotation, got, tt.wantRestartedWith)
+				}
+			}
+			web, _ := clientset.AppsV1().Deployments("team-a").Get(context.Background(), "web", metav1.GetOptions{})
+			if _, ok := web.Spec.Template.Annotations[restartedAtAnnotation]; ok {
+				t.Error("deployment not referencing the secret was restarted")
+			}
+		})
+	}
+}
+
+func TestRestartChecksum(t *testing.T) {
+	spec := testSpec()
+	if got, want := spec.restartChecksum(), tokenChecksum("header.payload.signature"); got != want {
+		t.Errorf("restartChecksum() = %q, want the hash of the token key %q", got, want)
+	}
+	spec.Checksum = "secret-checksum"
+	if got := spec.restartChecksum(); got != "secret-checksum" {
+		t.Errorf("restartChecksum() = %q, want the secret's checksum annotation", got)
+	}
+}
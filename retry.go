@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// retryPolicy describes how an operation is retried by retryWithBackoff.
+type retryPolicy struct {
+	// Name identifies the operation in retry log lines.
+	Name string
+	// Attempts is the maximum number of calls including the first; zero
+	// means retrying until the context is done.
+	Attempts int
+	// BaseDelay is the delay ceiling before the second attempt. It doubles
+	// with every attempt, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable reports whether an error is worth another attempt.
+	Retryable func(error) bool
+	// ServerDelay optionally returns a delay requested by the server (e.g.
+	// Retry-After), which takes precedence over the computed backoff.
+	ServerDelay func(error) (time.Duration, bool)
+}
+
+// backoff returns the delay after the given failed attempt: a random
+// duration between zero and the exponential ceiling ("full jitter"), which
+// spreads out retries from many clients failing at the same time.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		if exp := p.BaseDelay << shift; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// retryWithBackoff calls fn until it succeeds, returns an error the policy
+// does not consider retryable, runs out of attempts, or ctx is done. The last
+// error is returned in every failure case.
+func retryWithBackoff(ctx context.Context, policy retryPolicy, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !policy.Retryable(err) || (policy.Attempts > 0 && attempt >= policy.Attempts) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		if policy.ServerDelay != nil {
+			if serverDelay, ok := policy.ServerDelay(err); ok {
+				delay = serverDelay
+			}
+		}
+		if policy.Attempts > 0 {
+			log.Printf("Transient error during %s (attempt %d/%d), retrying in %v: %v", policy.Name, attempt, policy.Attempts, delay.Round(time.Millisecond), err)
+		} else {
+			log.Printf("Transient error during %s (attempt %d), retrying in %v: %v", policy.Name, attempt, delay.Round(time.Millisecond), err)
+		}
+
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for d, returning ctx's error early if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// kubeRetryPolicy bounds retries of transient API server errors.
+var kubeRetryPolicy = retryPolicy{
+	Attempts:    5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Retryable:   isRetryableKubeError,
+	ServerDelay: kubeServerDelay,
+}
+
+func isRetryableKubeError(err error) bool {
+	return apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) || apierrors.IsInternalError(err)
+}
+
+func kubeServerDelay(err error) (time.Duration, bool) {
+	seconds, ok := apierrors.SuggestsClientDelay(err)
+	return time.Duration(seconds) * time.Second, ok
+}
+
+// secretConflictPolicy re-reads and rewrites a secret that was modified
+// concurrently (or created between Get and Create).
+var secretConflictPolicy = retryPolicy{
+	Attempts:  5,
+	BaseDelay: 10 * time.Millisecond,
+	MaxDelay:  1 * time.Second,
+	Retryable: isSecretWriteConflict,
+}
+
+// tokenRetryPolicy bounds retries of a single token endpoint before failing
+// over to the next one.
+var tokenRetryPolicy = retryPolicy{
+	Attempts:    3,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    10 * time.Second,
+	Retryable:   isRetryableTokenError,
+	ServerDelay: tokenServerDelay,
+}
+
+// maxTokenRetryAfter caps a token endpoint's Retry-After, so a misbehaving
+// server cannot stall the run.
+const maxTokenRetryAfter = 2 * time.Minute
+
+// isRetryableTokenError treats connection failures, rate limiting and server
+// errors as transient. Other responses, such as rejected credentials, are not
+// retried.
+func isRetryableTokenError(err error) bool {
+	var fetchErr *TokenFetchError
+	if !errors.As(err, &fetchErr) || errors.Is(err, errInvalidClient) {
+		return false
+	}
+	if fetchErr.StatusCode == 0 {
+		var urlErr *url.Error
+		return errors.As(err, &urlErr)
+	}
+	return fetchErr.StatusCode == http.StatusTooManyRequests || fetchErr.StatusCode >= http.StatusInternalServerError
+}
+
+// tokenServerDelay honours the Retry-After header of a token endpoint
+// response.
+func tokenServerDelay(err error) (time.Duration, bool) {
+	var fetchErr *TokenFetchError
+	if !errors.As(err, &fetchErr) || fetchErr.RetryAfter <= 0 {
+		return 0, false
+	}
+	return min(fetchErr.RetryAfter, maxTokenRetryAfter), true
+}
+
+// parseRetryAfter reads a Retry-After header given either as delay seconds
+// or as an HTTP-date. Dates in the past yield a zero delay.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
+
+// retryKubeCall runs fn under kubeRetryPolicy, naming operation in logs.
+func retryKubeCall(ctx context.Context, operation string, fn func() error) error {
+	policy := kubeRetryPolicy
+	policy.Name = operation
+	return retryWithBackoff(ctx, policy, fn)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestTokenServerDelayCapped(t *testing.T) {
+	delay, ok := tokenServerDelay(&TokenFetchError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour})
+	if !ok || delay != maxTokenRetryAfter {
+		t.Errorf("tokenServerDelay() = %v, %v, want %v, true", delay, ok, maxTokenRetryAfter)
+	}
+}
+
+// throttleOnce answers the first matching call with a 429 asking the client
+// to retry after a second, and lets later calls through.
+func throttleOnce(clientset *fake.Clientset, verb, resource string) *int {
+	calls := 0
+	clientset.PrependReactor(verb, resource, func(k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls == 1 {
+			return true, nil, apierrors.NewTooManyRequests("slow down", 1)
+		}
+		return false, nil, nil
+	})
+	return &calls
+}
+
+func TestListNamespacesRetriesTooManyRequests(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+	calls := throttleOnce(clientset, "list", "namespaces")
+
+	start := time.Now()
+	namespaces, err := listNamespaces(context.Background(), clientset, metav1.ListOptions{}, false)
+	if err != nil {
+		t.Fatalf("listNamespaces() = %v", err)
+	}
+	if len(namespaces) != 1 || *calls != 2 {
+		t.Errorf("got %d namespaces after %d calls, want 1 after 2", len(namespaces), *calls)
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("retried after %v, want the server's Retry-After of 1s", waited)
+	}
+}
+
+func TestCreateOrUpdateSecretRetriesTooManyRequests(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a"},
+		Data:       map[string][]byte{"token": []byte("old")},
+	})
+	gets := throttleOnce(clientset, "get", "secrets")
+	patches := throttleOnce(clientset, "patch", "secrets")
+
+	operation, err := createOrUpdateSecret(context.Background(), clientset, "team-a", testSpec())
+	if err != nil {
+		t.Fatalf("createOrUpdateSecret() = %v", err)
+	}
+	if operation != secretUpdated || *gets != 2 || *patches != 2 {
+		t.Errorf("operation %s after %d gets and %d patches, want updated after 2 of each", operation, *gets, *patches)
+	}
+}
+
+func TestRetryKubeCallGivesUpOnOtherErrors(t *testing.T) {
+	calls := 0
+	err := retryKubeCall(context.Background(), "secret get", func() error {
+		calls++
+		return apierrors.NewBadRequest("invalid")
+	})
+	if !apierrors.IsBadRequest(err) || calls != 1 {
+		t.Errorf("retryKubeCall() = %v after %d calls, want the error after one call", err, calls)
+	}
+}
+
+var errTransient = errors.New("transient")
+
+func TestRetryPolicyBackoffBounds(t *testing.T) {
+	policy := retryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, ceiling := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		64: time.Second,
+	} {
+		seen := make(map[time.Duration]bool)
+		for range 200 {
+			delay := policy.backoff(attempt)
+			if delay < 0 || delay >= ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v)", attempt, delay, ceiling)
+			}
+			seen[delay] = true
+		}
+		// Full jitter: the delays are spread out rather than fixed.
+		if len(seen) < 10 {
+			t.Errorf("backoff(%d) gave only %d distinct delays in 200 calls", attempt, len(seen))
+		}
+	}
+	if delay := (retryPolicy{}).backoff(1); delay != 0 {
+		t.Errorf("backoff() without delays = %v, want 0", delay)
+	}
+}
+
+func TestRetryWithBackoffAttempts(t *testing.T) {
+	logs := captureLog(t)
+	policy := retryPolicy{
+		Name:      "test call",
+		Attempts:  3,
+		BaseDelay: time.Millisecond,
+		MaxDelay:  time.Millisecond,
+		Retryable: func(err error) bool { return errors.Is(err, errTransient) },
+	}
+
+	calls := 0
+	err := retryWithBackoff(context.Background(), policy, func() error {
+		calls++
+		return errTransient
+	})
+	if !errors.Is(err, errTransient) || calls != 3 {
+		t.Errorf("retryWithBackoff() = %v after %d calls, want the last error after 3", err, calls)
+	}
+	if !strings.Contains(logs.String(), "test call (attempt 2/3)") {
+		t.Errorf("log %q does not name the operation and attempt", logs)
+	}
+
+	calls = 0
+	permanent := errors.New("permanent")
+	err = retryWithBackoff(context.Background(), policy, func() error {
+		calls++
+		if calls == 1 {
+			return errTransient
+		}
+		return permanent
+	})
+	if err != permanent || calls != 2 {
+		t.Errorf("retryWithBackoff() = %v after %d calls, want the non-retryable error after 2", err, calls)
+	}
+}
+
+func TestRetryWithBackoffServerDelay(t *testing.T) {
+	captureLog(t)
+	policy := retryPolicy{
+		Attempts:    2,
+		BaseDelay:   time.Hour,
+		MaxDelay:    time.Hour,
+		Retryable:   func(error) bool { return true },
+		ServerDelay: func(error) (time.Duration, bool) { return 20 * time.Millisecond, true },
+	}
+	start := time.Now()
+	_ = retryWithBackoff(context.Background(), policy, func() error { return errTransient })
+	if waited := time.Since(start); waited < 20*time.Millisecond || waited > time.Minute {
+		t.Errorf("waited %v, want the server's delay of 20ms instead of the backoff", waited)
+	}
+}
+
+func TestRetryWithBackoffStopsOnCancel(t *testing.T) {
+	captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := retryPolicy{
+		BaseDelay: time.Hour,
+		MaxDelay:  time.Hour,
+		Retryable: func(error) bool { return true },
+	}
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- retryWithBackoff(ctx, policy, func() error {
+			calls++
+			return errTransient
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTransient) || calls != 1 {
+			t.Errorf("retryWithBackoff() = %v after %d calls, want the last error after 1", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retryWithBackoff() did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// Annotations recording where and when a secret was last rotated, written
+// when ROTATION_METADATA_ANNOTATIONS is enabled. None of them carries a
+// credential.
+const (
+	rotatedAtAnnotation = "oidc.token/rotated-at"
+	runIDAnnotation     = "oidc.token/run-id"
+	issuerAnnotation    = "oidc.token/issuer"
+)
+
+// rotationMetadata describes the run that wrote a secret.
+type rotationMetadata struct {
+	RunID     string
+	Issuer    string
+	RotatedAt time.Time
+}
+
+// newRotationMetadata derives the issuer from the token's iss claim, falling
+// back to the token endpoint that issued it, stripped of credentials and
+// query parameters.
+func newRotationMetadata(runID string, token *parsedToken, tokenURL string, now time.Time) *rotationMetadata {
+	issuer := token.Issuer()
+	if issuer == "" {
+		if parsed, err := url.Parse(tokenURL); err == nil {
+			issuer = (&url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: parsed.Path}).String()
+		}
+	}
+	return &rotationMetadata{RunID: runID, Issuer: issuer, RotatedAt: now}
+}
+
+// annotations returns the rotation annotations, or nil values to remove
+// them when m is nil.
+func (m *rotationMetadata) annotations() map[string]*string {
+	if m == nil {
+		return map[string]*string{rotatedAtAnnotation: nil, runIDAnnotation: nil, issuerAnnotation: nil}
+	}
+	rotatedAt := m.RotatedAt.UTC().Format(time.RFC3339)
+	runID, issuer := m.RunID, m.Issuer
+	annotations := map[string]*string{
+		rotatedAtAnnotation: &rotatedAt,
+		runIDAnnotation:     &runID,
+		issuerAnnotation:    &issuer,
+	}
+	if issuer == "" {
+		annotations[issuerAnnotation] = nil
+	}
+	return annotations
+}
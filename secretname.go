@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Placeholders accepted by K8S_SECRET_NAME_TEMPLATE, besides {label:KEY}.
+const (
+	secretNamePlaceholderNamespace = "namespace"
+	secretNamePlaceholderSecret    = "secret"
+	secretNameLabelPrefix          = "label:"
+)
+
+var secretNamePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// secretNameTemplate computes the target secret name of each namespace from
+// K8S_SECRET_NAME_TEMPLATE, e.g. "oidc-token-{namespace}". {namespace} is the
+// namespace name, {secret} is K8S_SECRET_NAME and {label:KEY} is the value of
+// the namespace's KEY label.
+type secretNameTemplate struct {
+	template   string
+	secretName string
+}
+
+// parseSecretNameTemplate rejects unknown placeholders and templates that
+// cannot produce a valid secret name even for a short, valid namespace.
+func parseSecretNameTemplate(template, secretName string) (*secretNameTemplate, error) {
+	t := &secretNameTemplate{template: template, secretName: secretName}
+	var problems []string
+	sample := corev1.Namespace{}
+	sample.Name = "ns"
+	sample.Labels = map[string]string{}
+	for _, match := range secretNamePlaceholder.FindAllStringSubmatch(template, -1) {
+		name := match[1]
+		switch {
+		case name == secretNamePlaceholderNamespace, name == secretNamePlaceholderSecret:
+		case strings.HasPrefix(name, secretNameLabelPrefix):
+			key := strings.TrimPrefix(name, secretNameLabelPrefix)
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				problems = append(problems, fmt.Sprintf("invalid label key in '%s': %s", match[0], strings.Join(errs, "; ")))
+			}
+			sample.Labels[key] = "x"
+		default:
+			problems = append(problems, fmt.Sprintf("unknown placeholder '%s'", match[0]))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	if _, err := t.render(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *secretNameTemplate) String() string {
+	return t.template
+}
+
+// render returns the secret name for namespace. It fails when a referenced
+// label is missing or the result is not a valid secret name.
+func (t *secretNameTemplate) render(namespace corev1.Namespace) (string, error) {
+	var renderErr error
+	name := secretNamePlaceholder.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		switch key := placeholder[1 : len(placeholder)-1]; {
+		case key == secretNamePlaceholderNamespace:
+			return namespace.Name
+		case key == secretNamePlaceholderSecret:
+			return t.secretName
+		default:
+			label := strings.TrimPrefix(key, secretNameLabelPrefix)
+			value, ok := namespace.Labels[label]
+			if !ok && renderErr == nil {
+				renderErr = fmt.Errorf("namespace has no '%s' label for %s", label, placeholder)
+			}
+			return value
+		}
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("secret name '%s' rendered from '%s' is invalid: %s", name, t.template, strings.Join(errs, "; "))
+	}
+	return name, nil
+}
+
+// namespaceSecretNames renders t for every namespace. Namespaces whose secret
+// name cannot be rendered are left out of valid and reported in failures, so
+// the rest can still be processed.
+func namespaceSecretNames(namespaces []corev1.Namespace, t *secretNameTemplate) (names map[string]string, valid []corev1.Namespace, failures []error) {
+	names = make(map[string]string, len(namespaces))
+	valid = make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		name, err := t.render(ns)
+		if err != nil {
+			failures = append(failures, &DistributionError{Namespace: ns.Name, Err: err})
+			continue
+		}
+		names[ns.Name] = name
+		valid = append(valid, ns)
+	}
+	return names, valid, failures
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretNameTemplateRender(t *testing.T) {
+	ns := testNamespace("payments", map[string]string{"env": "prod"})
+	tests := map[string]string{
+		"oidc-token-{namespace}":     "oidc-token-payments",
+		"{secret}-{label:env}":       "oidc-token-prod",
+		"{namespace}.{secret}":       "payments.oidc-token",
+		"fixed-name":                 "fixed-name",
+		"{label:env}-{namespace}-v1": "prod-payments-v1",
+	}
+	for template, want := range tests {
+		parsed, err := parseSecretNameTemplate(template, "oidc-token")
+		if err != nil {
+			t.Errorf("parseSecretNameTemplate(%q) = %v", template, err)
+			continue
+		}
+		got, err := parsed.render(ns)
+		if err != nil || got != want {
+			t.Errorf("render(%q) = %q, %v, want %q", template, got, err, want)
+		}
+	}
+}
+
+func TestParseSecretNameTemplateRejected(t *testing.T) {
+	tests := map[string]string{
+		"oidc-{environment}":        "unknown placeholder",
+		"oidc-{label:bad key!}":     "invalid label key",
+		"OIDC-{namespace}":          "is invalid",
+		"oidc_token_{namespace}":    "is invalid",
+		strings.Repeat("a", 260):    "is invalid",
+		"{namespace}-{secret}-{tld": "is invalid",
+	}
+	for template, want := range tests {
+		_, err := parseSecretNameTemplate(template, "oidc-token")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseSecretNameTemplate(%q) = %v, want an error containing %q", template, err, want)
+		}
+	}
+}
+
+func TestNamespaceSecretNamesInvalidRender(t *testing.T) {
+	template, err := parseSecretNameTemplate("oidc-{label:team}", "oidc-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaces := []corev1.Namespace{
+		testNamespace("payments", map[string]string{"team": "pay"}),
+		testNamespace("search", nil),
+		testNamespace("billing", map[string]string{"team": "Billing_Team"}),
+	}
+
+	names, valid, failures := namespaceSecretNames(namespaces, template)
+	if len(valid) != 1 || valid[0].Name != "payments" || names["payments"] != "oidc-pay" {
+		t.Errorf("valid = %v, names = %v, want only payments as oidc-pay", namespaceNames(valid), names)
+	}
+	failed := map[string]bool{}
+	for _, failure := range failures {
+		var distErr *DistributionError
+		if errors.As(failure, &distErr) {
+			failed[distErr.Namespace] = true
+		}
+	}
+	if !failed["search"] || !failed["billing"] || len(failures) != 2 {
+		t.Errorf("failures = %v, want search (missing label) and billing (invalid name)", failures)
+	}
+}
+
+func TestProcessSecretsInNamespacesSecretNames(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset()
+	spec := testSpec()
+	spec.Names = map[string]string{"team-0": "oidc-token-team-0", "team-1": "oidc-token-team-1"}
+
+	_, err := processSecretsInNamespaces(context.Background(), clientset, testNamespaces(2), spec, secretOpTimeouts{Default: k8sSecretOpTimeout}, newNamespaceBatcher(0, 0), newProgressLogger(0, 2))
+	if err != nil {
+		t.Fatalf("processSecretsInNamespaces() = %v", err)
+	}
+	for ns, name := range spec.Names {
+		if _, err := clientset.CoreV1().Secrets(ns).Get(context.Background(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("secret %s/%s not written: %v", ns, name, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// checkSecretSize returns a *SecretTooLargeError if data, the full data the
+// secret would hold after a write, exceeds corev1.MaxSecretSize. Like the API
+// server, it counts only the values.
+func checkSecretSize(namespace, name string, data map[string][]byte) error {
+	total := 0
+	keys := make([]secretKeySize, 0, len(data))
+	for key, value := range data {
+		total += len(value)
+		keys = append(keys, secretKeySize{Key: key, Size: len(value)})
+	}
+	if total <= corev1.MaxSecretSize {
+		return nil
+	}
+	slices.SortFunc(keys, func(a, b secretKeySize) int {
+		if c := cmp.Compare(b.Size, a.Size); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return &SecretTooLargeError{Namespace: namespace, Name: name, Size: total, Limit: corev1.MaxSecretSize, Keys: keys}
+}
+
+// mergedSecretData returns the data existing would hold after spec is
+// written: its own keys are kept, CleanupKeys removed and spec.Data applied.
+func mergedSecretData(existing map[string][]byte, spec secretSpec) map[string][]byte {
+	data := make(map[string][]byte, len(existing)+len(spec.Data))
+	for key, value := range existing {
+		data[key] = value
+	}
+	for _, key := range spec.CleanupKeys {
+		delete(data, key)
+	}
+	for key, value := range spec.Data {
+		data[key] = value
+	}
+	return data
+}
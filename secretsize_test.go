@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckSecretSize(t *testing.T) {
+	if err := checkSecretSize("team-a", "oidc-token", map[string][]byte{"token": make([]byte, corev1.MaxSecretSize)}); err != nil {
+		t.Errorf("checkSecretSize() at the limit = %v, want nil", err)
+	}
+
+	err := checkSecretSize("team-a", "oidc-token", map[string][]byte{
+		"token":  make([]byte, 1024),
+		"claims": make([]byte, corev1.MaxSecretSize),
+	})
+	var tooLarge *SecretTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("checkSecretSize() = %v, want a *SecretTooLargeError", err)
+	}
+	if tooLarge.Size != corev1.MaxSecretSize+1024 || tooLarge.Limit != corev1.MaxSecretSize {
+		t.Errorf("Size, Limit = %d, %d", tooLarge.Size, tooLarge.Limit)
+	}
+	want := []secretKeySize{{Key: "claims", Size: corev1.MaxSecretSize}, {Key: "token", Size: 1024}}
+	if len(tooLarge.Keys) != 2 || tooLarge.Keys[0] != want[0] || tooLarge.Keys[1] != want[1] {
+		t.Errorf("Keys = %v, want %v", tooLarge.Keys, want)
+	}
+	for _, part := range []string{"secret 'oidc-token' in namespace 'team-a'", "claims=1048576, token=1024", "CLAIMS_ALLOWLIST"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error = %q, want it to contain %q", err, part)
+		}
+	}
+}
+
+func TestSecretSizeCountsKeptKeys(t *testing.T) {
+	captureLog(t)
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oidc-token", Namespace: "team-a"},
+		Data: map[string][]byte{
+			"token":     []byte("old"),
+			"ca.crt":    make([]byte, corev1.MaxSecretSize-100),
+			"stale-key": make([]byte, 512),
+		},
+	})
+	spec := testSpec()
+
+	_, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec)
+	var tooLarge *SecretTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Keys[0].Key != "ca.crt" {
+		t.Fatalf("createOrUpdateSecret() = %v, want the kept ca.crt key counted", err)
+	}
+
+	spec.CleanupKeys = []string{"stale-key"}
+	if _, err := createOrUpdateSecret(context.Background(), clientset, "team-a", spec); err != nil {
+		t.Errorf("createOrUpdateSecret() with CLEANUP_KEYS = %v, want the removed key not counted", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const sinkWriteTimeout = 30 * time.Second
+
+// Outputs accepted by OUTPUT_MODE.
+const (
+	outputKubernetes        = "kubernetes"
+	outputAWSSecretsManager = "aws-secrets-manager"
+	outputFile              = "file"
+	outputStdout            = "stdout"
+	// outputConfigMap writes the token to a ConfigMap in each target
+	// namespace instead of a secret.
+	outputConfigMap = "configmap"
+
+	// outputSecret is accepted as an alias of outputKubernetes.
+	outputSecret = "secret"
+)
+
+// tokenSink is an output outside the cluster that receives the token. The
+// Kubernetes secrets in the target namespaces are written separately.
+type tokenSink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	Write(ctx context.Context, accessToken string) error
+}
+
+// writeToSinks writes the token to every sink, each with its own timeout.
+// A failing sink does not stop the others; the failures are returned joined.
+func writeToSinks(ctx context.Context, sinks []tokenSink, accessToken string) error {
+	var errs []error
+	for _, sink := range sinks {
+		sinkCtx, sinkCancel := context.WithTimeout(ctx, sinkWriteTimeout)
+		err := sink.Write(sinkCtx, accessToken)
+		sinkCancel()
+		if err != nil {
+			log.Printf("Error writing token to %s: %v. Continuing with remaining outputs.", sink.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+			continue
+		}
+		log.Printf("Token written to %s.", sink.Name())
+	}
+	return errors.Join(errs...)
+}
+
+// parseOutputModes splits the comma-separated OUTPUT_MODE value, dropping
+// duplicates.
+func parseOutputModes(value string) ([]string, error) {
+	var modes []string
+	for _, mode := range strings.Split(value, ",") {
+		mode = strings.TrimSpace(mode)
+		switch mode {
+		case "":
+			continue
+		case outputSecret:
+			mode = outputKubernetes
+		case outputKubernetes, outputConfigMap, outputAWSSecretsManager, outputFile, outputStdout:
+		default:
+			return nil, fmt.Errorf("unknown output '%s', expected %s, %s, %s, %s or %s", mode, outputKubernetes, outputConfigMap, outputAWSSecretsManager, outputFile, outputStdout)
+		}
+		if !slices.Contains(modes, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	if len(modes) == 0 {
+		return nil, fmt.Errorf("at least one output is required")
+	}
+	return modes, nil
+}
+
+// clusterResource returns the resource the token is written to in each target
+// namespace, or "" when modes include no output in the cluster.
+func clusterResource(modes []string) string {
+	switch {
+	case slices.Contains(modes, outputKubernetes):
+		return "secrets"
+	case slices.Contains(modes, outputConfigMap):
+		return "configmaps"
+	}
+	return ""
+}
+
+// stdoutSink prints the token on its own line, for demos and tests without a
+// cluster. Logs go to stderr, so the token is all that stdout carries.
+type stdoutSink struct {
+	w io.Writer
+}
+
+func (s *stdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *stdoutSink) Write(ctx context.Context, accessToken string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(s.w, accessToken)
+	return err
+}
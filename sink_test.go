@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// failingSink is an output that always fails.
+type failingSink struct{}
+
+func (failingSink) Name() string {
+	return "broken output"
+}
+
+func (failingSink) Write(ctx context.Context, accessToken string) error {
+	return errors.New("unreachable")
+}
+
+func TestWriteToSinksIsolatesFailures(t *testing.T) {
+	captureLog(t)
+	path := filepath.Join(t.TempDir(), "token")
+	var stdout bytes.Buffer
+	sinks := []tokenSink{failingSink{}, &fileSink{path: path}, &stdoutSink{w: &stdout}}
+
+	err := writeToSinks(context.Background(), sinks, "header.payload.signature")
+	if err == nil || !strings.Contains(err.Error(), "broken output: unreachable") {
+		t.Errorf("writeToSinks() = %v, want the failing output reported", err)
+	}
+	content, readErr := os.ReadFile(path)
+	if readErr != nil || string(content) != "header.payload.signature" {
+		t.Errorf("file holds %q (%v), want the token despite the earlier failure", content, readErr)
+	}
+	if got := stdout.String(); got != "header.payload.signature\n" {
+		t.Errorf("stdout = %q, want the token", got)
+	}
+}
+
+func TestParseOutputModesMultiple(t *testing.T) {
+	modes, err := parseOutputModes("secret, file,kubernetes")
+	if err != nil {
+		t.Fatalf("parseOutputModes() = %v", err)
+	}
+	if !slices.Equal(modes, []string{outputKubernetes, outputFile}) {
+		t.Errorf("modes = %v, want kubernetes and file once each", modes)
+	}
+	if clusterResource(modes) != "secrets" {
+		t.Errorf("clusterResource() = %q, want secrets written alongside the file", clusterResource(modes))
+	}
+	if _, err := parseOutputModes("secret,vault"); err == nil {
+		t.Error("parseOutputModes() = nil, want an unknown output rejected")
+	}
+}
+
+func TestFileSinkReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	sink := &fileSink{path: path}
+	for _, token := range []string{"first", "second"} {
+		if err := sink.Write(context.Background(), token); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "second" {
+		t.Errorf("file holds %q (%v), want the latest token", content, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want no temporary files left", len(entries))
+	}
+}
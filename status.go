@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultStatusSecretName = "oidc-jwt-fetcher-status"
+	lastSuccessAnnotation   = "oidc.token/last-success"
+)
+
+// recordLastSuccess stamps the status secret with the time of the last fully
+// successful run, creating the secret if it does not exist yet.
+func recordLastSuccess(ctx context.Context, clientset kubernetes.Interface, namespace, secretName, fieldManager string, now time.Time) error {
+	timestamp := now.UTC().Format(time.RFC3339)
+	secretClient := clientset.CoreV1().Secrets(namespace)
+
+	patchBytes, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				lastSuccessAnnotation: timestamp,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal status patch: %w", err)
+	}
+
+	_, err = secretClient.Patch(ctx, secretName, types.MergePatchType, patchBytes, metav1.PatchOptions{FieldManager: fieldManager})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to patch status secret '%s' in namespace '%s': %w", secretName, namespace, err)
+	}
+
+	statusSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Annotations: map[string]string{lastSuccessAnnotation: timestamp},
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+	if _, err := secretClient.Create(ctx, statusSecret, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("failed to create status secret '%s' in namespace '%s': %w", secretName, namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func lastSuccess(t *testing.T, clientset *fake.Clientset) string {
+	t.Helper()
+	secret, err := clientset.CoreV1().Secrets("ops").Get(context.Background(), defaultStatusSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("status secret: %v", err)
+	}
+	return secret.Annotations[lastSuccessAnnotation]
+}
+
+func TestRecordLastSuccess(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	first := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := recordLastSuccess(ctx, clientset, "ops", defaultStatusSecretName, "oidc-jwt-fetcher", first); err != nil {
+		t.Fatalf("recordLastSuccess() creating the secret = %v", err)
+	}
+	if got := lastSuccess(t, clientset); got != "2026-03-01T12:00:00Z" {
+		t.Errorf("last-success = %q after the first run", got)
+	}
+
+	if err := recordLastSuccess(ctx, clientset, "ops", defaultStatusSecretName, "oidc-jwt-fetcher", first.Add(time.Hour)); err != nil {
+		t.Fatalf("recordLastSuccess() updating the secret = %v", err)
+	}
+	if got := lastSuccess(t, clientset); got != "2026-03-01T13:00:00Z" {
+		t.Errorf("last-success = %q, want it updated by the second run", got)
+	}
+
+	// A failed write is reported and leaves the previous timestamp.
+	clientset.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, defaultStatusSecretName, errors.New("denied"))
+	})
+	if err := recordLastSuccess(ctx, clientset, "ops", defaultStatusSecretName, "oidc-jwt-fetcher", first.Add(2*time.Hour)); err == nil {
+		t.Error("recordLastSuccess() = nil, want the failed patch reported")
+	}
+	if got := lastSuccess(t, clientset); got != "2026-03-01T13:00:00Z" {
+		t.Errorf("last-success = %q, want it unchanged after a failure", got)
+	}
+}
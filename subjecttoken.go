@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Subject token sources accepted by OIDC_SUBJECT_TOKEN_SOURCE.
+const subjectTokenSourceGitHubActions = "github-actions"
+
+// Token exchange (RFC 8693) parameters.
+const (
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT               = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// githubActionsIDToken requests a GitHub Actions OIDC id-token, using the
+// request URL and bearer token the runner exposes to jobs granted the
+// id-token: write permission.
+type githubActionsIDToken struct {
+	RequestURL   string
+	RequestToken string `redact:"true"`
+	// Audience is sent as the audience query parameter; empty keeps the
+	// runner's default audience.
+	Audience string
+}
+
+// fetch returns a freshly issued id-token. The runner's tokens are
+// short-lived, so one is requested for every token exchange attempt.
+func (g *githubActionsIDToken) fetch(ctx context.Context, client *http.Client, maxResponseBytes int) (idToken string, err error) {
+	requestURL, err := url.Parse(g.RequestURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid ACTIONS_ID_TOKEN_REQUEST_URL: %w", err)
+	}
+	if g.Audience != "" {
+		query := requestURL.Query()
+		query.Set("audience", g.Audience)
+		requestURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create id-token request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+g.RequestToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request GitHub Actions id-token: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close id-token response body: %w", closeErr)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request GitHub Actions id-token, status code: %d", resp.StatusCode)
+	}
+	rawResponse, err := readLimited(resp.Body, maxResponseBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to read id-token response: %w", err)
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(rawResponse, &body); err != nil {
+		return "", fmt.Errorf("failed to decode id-token response: %w", err)
+	}
+	if strings.TrimSpace(body.Value) == "" {
+		return "", fmt.Errorf("id-token response has no value")
+	}
+	return body.Value, nil
+}
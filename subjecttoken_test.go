@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeActionsRunner answers id-token requests like a GitHub Actions runner,
+// recording the audience of each.
+func fakeActionsRunner(t *testing.T, requestToken string, audiences *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+requestToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		*audiences = append(*audiences, r.URL.Query().Get("audience"))
+		fmt.Fprint(w, `{"count":1,"value":"gha-id-token"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchOIDCTokenExchangesActionsIDToken(t *testing.T) {
+	var audiences []string
+	runner := fakeActionsRunner(t, "runner-token", &audiences)
+	idp := newFakeTokenServer(t, testTokenBody)
+
+	tokenReq := testTokenRequest(idp.URL)
+	tokenReq.ClientSecret = ""
+	tokenReq.SubjectToken = &githubActionsIDToken{RequestURL: runner.URL + "?api-version=2.0", RequestToken: "runner-token", Audience: "sts.example.com"}
+	if _, err := fetchOIDCToken(context.Background(), http.DefaultClient, tokenReq); err != nil {
+		t.Fatalf("fetchOIDCToken() = %v", err)
+	}
+
+	if len(audiences) != 1 || audiences[0] != "sts.example.com" {
+		t.Errorf("id-token audiences = %v, want one request for sts.example.com", audiences)
+	}
+	form := idp.requests()[0].Form
+	for key, want := range map[string]string{
+		"grant_type":         grantTypeTokenExchange,
+		"subject_token":      "gha-id-token",
+		"subject_token_type": tokenTypeJWT,
+		"client_id":          "client",
+	} {
+		if got := form.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if form.Has("client_secret") {
+		t.Error("client_secret sent for a public client")
+	}
+}
+
+func TestGitHubActionsIDTokenRejected(t *testing.T) {
+	var audiences []string
+	runner := fakeActionsRunner(t, "runner-token", &audiences)
+	idToken := &githubActionsIDToken{RequestURL: runner.URL, RequestToken: "expired"}
+
+	_, err := idToken.fetch(context.Background(), http.DefaultClient, 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "status code: 401") {
+		t.Errorf("fetch() = %v, want the runner's 401 reported", err)
+	}
+}
+
+func TestLoadConfigGitHubActionsSubjectToken(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OIDC_CLIENT_SECRET", "")
+	t.Setenv("OIDC_SUBJECT_TOKEN_SOURCE", subjectTokenSourceGitHubActions)
+	if _, err := loadConfig(false, false); err == nil || !strings.Contains(err.Error(), "ACTIONS_ID_TOKEN_REQUEST_URL") {
+		t.Errorf("loadConfig() = %v, want the runner variables required", err)
+	}
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "https://runner.example.com/token")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "runner-token")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.SubjectToken == nil || cfg.SubjectToken.RequestToken != "runner-token" {
+		t.Errorf("SubjectToken = %+v", cfg.SubjectToken)
+	}
+}
+
+func TestGitHubActionsIDTokenOversizedResponse(t *testing.T) {
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"value":"%s"}`, strings.Repeat("x", 4096))
+	}))
+	defer runner.Close()
+	idToken := &githubActionsIDToken{RequestURL: runner.URL, RequestToken: "runner-token"}
+	if _, err := idToken.fetch(context.Background(), http.DefaultClient, 1024); err == nil || !strings.Contains(err.Error(), "exceeds 1024 bytes") {
+		t.Errorf("fetch() = %v, want the size limit applied to the id-token response", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+)
+
+// Overall results recorded in SUMMARY_FILE_PATH.
+const (
+	runSucceeded   = "succeeded"
+	runFailed      = "failed"
+	runInterrupted = "interrupted"
+)
+
+// Per-namespace statuses recorded in SUMMARY_FILE_PATH.
+const (
+	namespaceSucceeded    = "succeeded"
+	namespaceFailed       = "failed"
+	namespaceOverQuota    = "skipped-over-quota"
+	namespaceNotProcessed = "not-processed"
+)
+
+// runReport is the machine-readable outcome of a run written to
+// SUMMARY_FILE_PATH for CI and other automation. A nil *runReport records
+// nothing, so callers need not check whether the file is enabled.
+type runReport struct {
+	path string
+
+	RunID      string            `json:"runId"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Tokens     []tokenReport     `json:"tokens"`
+	Namespaces []namespaceReport `json:"namespaces"`
+}
+
+type tokenReport struct {
+	Group     string     `json:"group,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type namespaceReport struct {
+	Namespace string `json:"namespace"`
+	Group     string `json:"group,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newRunReport(path, runID string) *runReport {
+	if path == "" {
+		return nil
+	}
+	return &runReport{
+		path:       path,
+		RunID:      runID,
+		StartedAt:  time.Now().UTC(),
+		Tokens:     []tokenReport{},
+		Namespaces: []namespaceReport{},
+	}
+}
+
+// recordToken records the outcome of a group's token fetch. group is empty
+// without NAMESPACE_GROUPS.
+func (r *runReport) recordToken(group string, expiresAt time.Time, err error) {
+	if r == nil {
+		return
+	}
+	token := tokenReport{Group: group}
+	if err != nil {
+		token.Error = err.Error()
+	} else if !expiresAt.IsZero() {
+		expiresAt := expiresAt.UTC()
+		token.ExpiresAt = &expiresAt
+	}
+	r.Tokens = append(r.Tokens, token)
+}
+
+// recordNamespaces records the status of every namespace, in group order.
+// Namespaces that failed before being assigned to a group, such as those
+// without a valid secret name, follow without a group. grouped reports
+// whether NAMESPACE_GROUPS is in use.
+func (r *runReport) recordNamespaces(groups []namespaceGroup, assignments map[string][]string, grouped bool, summary processSummary, processErr error, tokenErrByGroup map[string]error) {
+	if r == nil {
+		return
+	}
+	namespaceErrs := distributionErrors(processErr)
+	seen := make(map[string]bool)
+	add := func(namespace, group string) {
+		seen[namespace] = true
+		entry := namespaceReport{Namespace: namespace, Status: namespaceNotProcessed}
+		if grouped {
+			entry.Group = group
+		}
+		switch {
+		case slices.Contains(summary.Succeeded, namespace):
+			entry.Status = namespaceSucceeded
+		case slices.Contains(summary.OverQuota, namespace):
+			entry.Status = namespaceOverQuota
+		case slices.Contains(summary.Failed, namespace):
+			entry.Status = namespaceFailed
+			if err, ok := namespaceErrs[namespace]; ok {
+				entry.Error = err.Error()
+			} else if err := tokenErrByGroup[group]; err != nil {
+				entry.Error = err.Error()
+			}
+		}
+		r.Namespaces = append(r.Namespaces, entry)
+	}
+	for _, group := range groups {
+		for _, namespace := range assignments[group.Name] {
+			add(namespace, group.Name)
+		}
+	}
+	for _, namespace := range summary.Failed {
+		if !seen[namespace] {
+			add(namespace, "")
+		}
+	}
+}
+
+// finish records the overall result and writes the file. A failure to write
+// it is logged but does not change the outcome of the run.
+func (r *runReport) finish(result, message string) {
+	if r == nil {
+		return
+	}
+	r.Result = result
+	r.Error = message
+	r.FinishedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		sink := &fileSink{path: r.path}
+		err = sink.Write(context.Background(), string(data)+"\n")
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write run summary to '%s': %v", r.path, err)
+		return
+	}
+	log.Printf("Run summary written to '%s'.", r.path)
+}
+
+// distributionErrors collects the *DistributionError of each namespace from
+// an error tree built with errors.Join.
+func distributionErrors(err error) map[string]error {
+	errs := make(map[string]error)
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case *DistributionError:
+			errs[e.Namespace] = e.Err
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return errs
+}
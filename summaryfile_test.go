@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestRunReportMatchesOutcome(t *testing.T) {
+	captureLog(t)
+	path := filepath.Join(t.TempDir(), "summary.json")
+	report := newRunReport(path, "run-1")
+	groups := []namespaceGroup{{Name: defaultGroupName, selector: labels.Everything()}}
+	assignments := map[string][]string{defaultGroupName: {"team-a", "team-b", "team-c", "team-d"}}
+	summary := processSummary{
+		Total:     4,
+		Succeeded: []string{"team-a"},
+		Failed:    []string{"team-b"},
+		OverQuota: []string{"team-c"},
+	}
+	processErr := errors.Join(&DistributionError{Namespace: "team-b", Err: errors.New("forbidden")})
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	report.recordToken("", expiresAt, nil)
+	report.recordNamespaces(groups, assignments, false, summary, processErr, nil)
+	report.finish(runFailed, "Processing namespaces finished with errors")
+
+	written := readRunReport(t, path)
+	if written.RunID != "run-1" || written.Result != runFailed || written.Error == "" {
+		t.Errorf("runId = %q, result = %q, error = %q", written.RunID, written.Result, written.Error)
+	}
+	if len(written.Tokens) != 1 || written.Tokens[0].ExpiresAt == nil || !written.Tokens[0].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("tokens = %+v, want one token expiring at %v", written.Tokens, expiresAt)
+	}
+	want := []namespaceReport{
+		{Namespace: "team-a", Status: namespaceSucceeded},
+		{Namespace: "team-b", Status: namespaceFailed, Error: "forbidden"},
+		{Namespace: "team-c", Status: namespaceOverQuota},
+		{Namespace: "team-d", Status: namespaceNotProcessed},
+	}
+	if len(written.Namespaces) != len(want) {
+		t.Fatalf("namespaces = %+v, want %+v", written.Namespaces, want)
+	}
+	for i := range want {
+		if written.Namespaces[i] != want[i] {
+			t.Errorf("namespaces[%d] = %+v, want %+v", i, written.Namespaces[i], want[i])
+		}
+	}
+}
+
+func TestRunReportDisabled(t *testing.T) {
+	report := newRunReport("", "run-1")
+	if report != nil {
+		t.Fatalf("newRunReport(\"\") = %+v, want nil", report)
+	}
+	// A nil report ignores every call.
+	report.recordToken("", time.Time{}, nil)
+	report.recordNamespaces(nil, nil, false, processSummary{}, nil, nil)
+	report.finish(runSucceeded, "")
+}
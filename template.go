@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Values accepted by SECRET_ENCODING.
+const (
+	secretEncodingRaw    = "raw"
+	secretEncodingBase64 = "base64"
+)
+
+// Values accepted by SECRET_TEMPLATE.
+const (
+	secretTemplateOpaque    = "opaque"
+	secretTemplateBasicAuth = "basic-auth"
+)
+
+// secretTemplate decides the type of the target secret and the keys the token
+// is written under.
+type secretTemplate struct {
+	Type     corev1.SecretType
+	TokenKey string
+	// Extra holds keys written alongside the token, such as the basic-auth username.
+	Extra map[string][]byte
+}
+
+// parseSecretTemplate resolves a SECRET_TEMPLATE value. secretKey is only used
+// by the opaque template; customSecretKey reports whether it was set
+// explicitly, which is rejected for templates with canonical keys.
+func parseSecretTemplate(name, secretKey string, customSecretKey bool, username string) (secretTemplate, error) {
+	switch corev1.SecretType(name) {
+	case secretTemplateOpaque, corev1.SecretTypeOpaque:
+		return secretTemplate{Type: corev1.SecretTypeOpaque, TokenKey: secretKey}, nil
+	case secretTemplateBasicAuth, corev1.SecretTypeBasicAuth:
+		if customSecretKey {
+			return secretTemplate{}, fmt.Errorf("K8S_SECRET_KEY cannot be used with the %s template, the token is always written under '%s'", secretTemplateBasicAuth, corev1.BasicAuthPasswordKey)
+		}
+		template := secretTemplate{Type: corev1.SecretTypeBasicAuth, TokenKey: corev1.BasicAuthPasswordKey}
+		if username != "" {
+			template.Extra = map[string][]byte{corev1.BasicAuthUsernameKey: []byte(username)}
+		}
+		return template, nil
+	case "tls", corev1.SecretTypeTLS:
+		return secretTemplate{}, fmt.Errorf("%s secrets require '%s' and '%s', which an access token cannot provide", corev1.SecretTypeTLS, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	default:
+		return secretTemplate{}, fmt.Errorf("unknown template '%s', expected %s or %s", name, secretTemplateOpaque, secretTemplateBasicAuth)
+	}
+}
+
+// keys lists every key the template writes.
+func (t secretTemplate) keys() []string {
+	keys := []string{t.TokenKey}
+	for key := range t.Extra {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// data lays out accessToken according to the template.
+func (t secretTemplate) data(accessToken string) map[string][]byte {
+	data := make(map[string][]byte, len(t.Extra)+1)
+	for key, value := range t.Extra {
+		data[key] = value
+	}
+	data[t.TokenKey] = []byte(accessToken)
+	return data
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSecretTemplateOpaque(t *testing.T) {
+	template, err := parseSecretTemplate(secretTemplateOpaque, "jwt", true, "")
+	if err != nil {
+		t.Fatalf("parseSecretTemplate() = %v", err)
+	}
+	data := template.data("tok")
+	if template.Type != corev1.SecretTypeOpaque || len(data) != 1 || string(data["jwt"]) != "tok" {
+		t.Errorf("opaque template = %s with %q, want the token under jwt", template.Type, data)
+	}
+}
+
+func TestSecretTemplateBasicAuth(t *testing.T) {
+	template, err := parseSecretTemplate(secretTemplateBasicAuth, "token", false, "svc-deployer")
+	if err != nil {
+		t.Fatalf("parseSecretTemplate() = %v", err)
+	}
+	data := template.data("tok")
+	if template.Type != corev1.SecretTypeBasicAuth {
+		t.Errorf("Type = %s", template.Type)
+	}
+	if string(data[corev1.BasicAuthPasswordKey]) != "tok" || string(data[corev1.BasicAuthUsernameKey]) != "svc-deployer" || len(data) != 2 {
+		t.Errorf("data = %q, want the token as password and the username", data)
+	}
+
+	// The secret type name is accepted as well.
+	if _, err := parseSecretTemplate(string(corev1.SecretTypeBasicAuth), "token", false, ""); err != nil {
+		t.Errorf("parseSecretTemplate(%q) = %v", corev1.SecretTypeBasicAuth, err)
+	}
+}
+
+func TestSecretTemplateRejected(t *testing.T) {
+	tests := []struct {
+		name            string
+		customSecretKey bool
+	}{
+		{secretTemplateBasicAuth, true},
+		{"tls", false},
+		{"docker", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseSecretTemplate(tt.name, "jwt", tt.customSecretKey, ""); err == nil {
+			t.Errorf("parseSecretTemplate(%q, customSecretKey=%v) = nil, want an error", tt.name, tt.customSecretKey)
+		}
+	}
+}
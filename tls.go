@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+const defaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSMinVersion(value string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimSpace(value)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version '%s' (expected one of 1.0, 1.1, 1.2, 1.3)", value)
+	}
+	return version, nil
+}
+
+// parseCipherSuites resolves a comma-separated list of cipher suite names
+// (as reported by crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Suites Go considers insecure are rejected.
+func parseCipherSuites(value string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	var unknown []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown or insecure cipher suite(s): %s", strings.Join(unknown, ", "))
+	}
+	return ids, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSMinVersion(t *testing.T) {
+	for value, want := range map[string]uint16{"1.2": tls.VersionTLS12, " 1.3 ": tls.VersionTLS13} {
+		got, err := parseTLSMinVersion(value)
+		if err != nil || got != want {
+			t.Errorf("parseTLSMinVersion(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := parseTLSMinVersion("TLS1.2"); err == nil {
+		t.Error("parseTLSMinVersion(\"TLS1.2\") = nil error, want it rejected")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatalf("parseCipherSuites() = %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseCipherSuites() = %v, want %v", got, want)
+	}
+
+	// RC4 is only in tls.InsecureCipherSuites.
+	_, err = parseCipherSuites("TLS_ECDHE_RSA_WITH_RC4_128_SHA,TLS_BOGUS")
+	if err == nil || !strings.Contains(err.Error(), "TLS_ECDHE_RSA_WITH_RC4_128_SHA, TLS_BOGUS") {
+		t.Errorf("parseCipherSuites() error = %v, want both suites rejected", err)
+	}
+}
+
+func TestTokenClientTLSConfig(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("OIDC_TLS_MIN_VERSION", "1.3")
+	t.Setenv("OIDC_TLS_CIPHER_SUITES", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+
+	client := newTokenHTTPClient(&tls.Config{MinVersion: cfg.TLSMinVersion, CipherSuites: cfg.TLSCipherSuites}, tokenTransportOptions{})
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want TLS 1.3", tlsConfig.MinVersion)
+	}
+	if !slices.Equal(tlsConfig.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("CipherSuites = %v", tlsConfig.CipherSuites)
+	}
+}
+
+func TestLoadConfigTLSDefaults(t *testing.T) {
+	setBaseEnv(t)
+	cfg, err := loadConfig(false, false)
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if cfg.TLSMinVersion != tls.VersionTLS12 || cfg.TLSCipherSuites != nil {
+		t.Errorf("TLS defaults = %x, %v, want TLS 1.2 and Go's cipher suites", cfg.TLSMinVersion, cfg.TLSCipherSuites)
+	}
+
+	t.Setenv("OIDC_TLS_MIN_VERSION", "1.4")
+	t.Setenv("OIDC_TLS_CIPHER_SUITES", "TLS_BOGUS")
+	_, err = loadConfig(false, false)
+	if err == nil || !strings.Contains(err.Error(), "OIDC_TLS_MIN_VERSION") || !strings.Contains(err.Error(), "OIDC_TLS_CIPHER_SUITES") {
+		t.Errorf("loadConfig() = %v, want both TLS settings rejected", err)
+	}
+}
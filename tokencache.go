@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tokenCacheKey identifies a token request by the parameters that decide
+// which token the IdP issues.
+type tokenCacheKey struct {
+	urls       string
+	clientID   string
+	authMethod string
+	scopes     string
+	audience   string
+}
+
+func newTokenCacheKey(req tokenRequest) tokenCacheKey {
+	return tokenCacheKey{
+		urls:       strings.Join(req.URLs, "\n"),
+		clientID:   req.ClientID,
+		authMethod: req.AuthMethod,
+		scopes:     req.Scopes,
+		audience:   req.Audience,
+	}
+}
+
+// tokenCache remembers the outcome of each distinct token request for one
+// run, so namespace groups that differ only in their selectors share a
+// single request to the IdP. Concurrent identical requests wait for the
+// first one instead of racing it. Failures are cached too: the request has
+// already been retried, and repeating it would only fail the same way.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[tokenCacheKey]*tokenCacheEntry
+}
+
+type tokenCacheEntry struct {
+	once     sync.Once
+	response *OIDCTokenResponse
+	err      error
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{entries: make(map[tokenCacheKey]*tokenCacheEntry)}
+}
+
+// fetch returns the token for req, calling fetchOIDCToken only for the first
+// request with its parameters. reused reports whether the outcome came from
+// the cache. Each caller gets its own copy of the response, since callers
+// fill in a missing expiry.
+func (c *tokenCache) fetch(ctx context.Context, client *http.Client, req tokenRequest) (response *OIDCTokenResponse, reused bool, err error) {
+	key := newTokenCacheKey(req)
+	c.mu.Lock()
+	entry, reused := c.entries[key]
+	if !reused {
+		entry = &tokenCacheEntry{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.response, entry.err = fetchOIDCToken(ctx, client, req)
+	})
+	if entry.err != nil {
+		return nil, reused, entry.err
+	}
+	copied := *entry.response
+	return &copied, reused, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTokenCacheSharesIdenticalRequests(t *testing.T) {
+	server := newFakeTokenServer(t, testTokenBody)
+	cache := newTokenCache()
+	req := testTokenRequest(server.URL)
+
+	first, reused, err := cache.fetch(context.Background(), http.DefaultClient, req)
+	if err != nil || reused {
+		t.Fatalf("first fetch() = %v, reused %v, want a fresh token", err, reused)
+	}
+	second, reused, err := cache.fetch(context.Background(), http.DefaultClient, req)
+	if err != nil || !reused {
+		t.Fatalf("second fetch() = %v, reused %v, want the cached token", err, reused)
+	}
+	if first == second || first.AccessToken != second.AccessToken {
+		t.Errorf("fetch() returned %p and %p, want separate copies of one token", first, second)
+	}
+	if got := len(server.requests()); got != 1 {
+		t.Errorf("IdP got %d requests, want 1", got)
+	}
+
+	req.Scopes = "openid profile"
+	if _, reused, _ := cache.fetch(context.Background(), http.DefaultClient, req); reused {
+		t.Error("a request with different scopes was served from the cache")
+	}
+	if got := len(server.requests()); got != 2 {
+		t.Errorf("IdP got %d requests, want 2 after a different scope", got)
+	}
+}
+
+func TestTokenCacheRemembersFailures(t *testing.T) {
+	var calls atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	cache := newTokenCache()
+	req := testTokenRequest(failing.URL)
+
+	if _, _, err := cache.fetch(context.Background(), http.DefaultClient, req); err == nil {
+		t.Fatal("first fetch() succeeded against a failing IdP")
+	}
+	attempts := calls.Load()
+	_, reused, err := cache.fetch(context.Background(), http.DefaultClient, req)
+	if err == nil || !reused {
+		t.Errorf("second fetch() = %v, reused %v, want the cached failure", err, reused)
+	}
+	if calls.Load() != attempts {
+		t.Errorf("IdP got %d more requests for a cached failure", calls.Load()-attempts)
+	}
+}
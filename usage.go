@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// runningPodsSelector leaves out Pods that have finished.
+const runningPodsSelector = "status.phase!=Succeeded,status.phase!=Failed"
+
+// filterUsedNamespaces keeps only namespaces with a Deployment or Pod that
+// references its target secret, for ONLY_USED_NAMESPACES. secretNames maps
+// namespaces to their own secret name, overriding secretName. A namespace
+// whose workloads cannot be listed is kept with a warning, so a missing
+// permission never withholds a token from a consumer.
+func filterUsedNamespaces(ctx context.Context, clientset kubernetes.Interface, namespaces []corev1.Namespace, secretName string, secretNames map[string]string) []corev1.Namespace {
+	used := make([]corev1.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		name := secretName
+		if override, ok := secretNames[ns.Name]; ok {
+			name = override
+		}
+		inUse, err := namespaceUsesSecret(ctx, clientset, ns.Name, name)
+		if err != nil {
+			log.Printf("Warning: could not check whether namespace '%s' uses secret '%s': %v. Processing it anyway.", ns.Name, name, err)
+			used = append(used, ns)
+			continue
+		}
+		if !inUse {
+			log.Printf("No workload in namespace '%s' references secret '%s' and ONLY_USED_NAMESPACES is set. Skipping.", ns.Name, name)
+			continue
+		}
+		used = append(used, ns)
+	}
+	return used
+}
+
+// namespaceUsesSecret reports whether a Deployment's pod template or a Pod in
+// namespace references secretName. Deployments are checked first, as there
+// are usually far fewer of them; Pods cover every other kind of workload, so
+// Pods created by the listed Deployments are skipped. Lists are served from
+// the API server's cache (resourceVersion 0), since a slightly stale view is
+// good enough here.
+//
+// Neither list can be narrowed by secret name: secret references are not
+// labels, and the API server only supports field selectors on a few fixed
+// Pod fields. Finished Pods are left out with a status.phase field selector,
+// as they no longer consume the secret.
+func namespaceUsesSecret(ctx context.Context, clientset kubernetes.Interface, namespace, secretName string) (bool, error) {
+	var deployments []appsv1.Deployment
+	err := retryKubeCall(ctx, "deployment list", func() error {
+		list, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{ResourceVersion: "0"})
+		if err != nil {
+			return err
+		}
+		deployments = list.Items
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list deployments: %w", err)
+	}
+	for _, deployment := range deployments {
+		if podSpecReferencesSecret(deployment.Spec.Template.Spec, secretName) {
+			return true, nil
+		}
+	}
+
+	var pods *corev1.PodList
+	err = retryKubeCall(ctx, "pod list", func() (err error) {
+		pods, err = clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			ResourceVersion: "0",
+			FieldSelector:   runningPodsSelector,
+		})
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if ownedByDeployment(pod, deployments) {
+			continue
+		}
+		if podSpecReferencesSecret(pod.Spec, secretName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownedByDeployment reports whether pod belongs to a ReplicaSet of one of
+// deployments. A Deployment names its ReplicaSets after itself and the
+// pod-template-hash label it puts on their Pods, so the ReplicaSets need not
+// be listed.
+func ownedByDeployment(pod corev1.Pod, deployments []appsv1.Deployment) bool {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return false
+	}
+	hash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if !ok {
+		return false
+	}
+	for _, deployment := range deployments {
+		if owner.Name == deployment.Name+"-"+hash {
+			return true
+		}
+	}
+	return false
+}
+
+// podSpecReferencesSecret reports whether spec mounts secretName as a volume
+// (directly or projected) or reads it into a container's environment.
+func podSpecReferencesSecret(spec corev1.PodSpec, secretName string) bool {
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == secretName {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(container.EphemeralContainerCommon))
+	}
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// secretVolumePodSpec mounts secretName as a volume.
+func secretVolumePodSpec(secretName string) corev1.PodSpec {
+	return corev1.PodSpec{
+		Volumes: []corev1.Volume{{
+			Name:         "token",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
+		}},
+		Containers: []corev1.Container{{Name: "app"}},
+	}
+}
+
+func testDeployment(namespace, name string, spec corev1.PodSpec) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+	}
+}
+
+func TestFilterUsedNamespaces(t *testing.T) {
+	logs := captureLog(t)
+	clientset := fake.NewSimpleClientset(
+		testDeployment("consumer", "api", secretVolumePodSpec("oidc-token")),
+		testDeployment("bystander", "web", secretVolumePodSpec("other-secret")),
+	)
+	namespaces := []corev1.Namespace{testNamespace("consumer", nil), testNamespace("bystander", nil)}
+
+	used := filterUsedNamespaces(context.Background(), clientset, namespaces, "oidc-token", nil)
+	if got := namespaceNames(used); len(got) != 1 || got[0] != "consumer" {
+		t.Errorf("filterUsedNamespaces() = %v, want only consumer", got)
+	}
+	if !bytes.Contains(logs.Bytes(), []byte("No workload in namespace 'bystander'")) {
+		t.Errorf("skipped namespace not logged:\n%s", logs)
+	}
+}
+
+func TestNamespaceUsesSecretPods(t *testing.T) {
+	isController := true
+	replicaSetPod := func(name, replicaSet, hash string, spec corev1.PodSpec) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       "team-a",
+				Labels:          map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: hash},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: replicaSet, Controller: &isController}},
+			},
+			Spec: spec,
+		}
+	}
+	envFromSpec := corev1.PodSpec{Containers: []corev1.Container{{
+		Name:    "job",
+		EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "oidc-token"}}}},
+	}}}
+
+	tests := map[string]struct {
+		objects []runtime.Object
+		want    bool
+	}{
+		"standalone pod": {
+			objects: []runtime.Object{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "team-a"}, Spec: envFromSpec}},
+			want:    true,
+		},
+		"pod of a listed deployment": {
+			// The Deployment was checked already; its leftover Pod from an
+			// older revision is not checked again.
+			objects: []runtime.Object{
+				testDeployment("team-a", "web", secretVolumePodSpec("other-secret")),
+				replicaSetPod("web-5d8f-x2", "web-5d8f", "5d8f", envFromSpec),
+			},
+			want: false,
+		},
+		"pod of another replicaset": {
+			objects: []runtime.Object{
+				testDeployment("team-a", "web", secretVolumePodSpec("other-secret")),
+				replicaSetPod("batch-77c1-x2", "batch-77c1", "77c1", envFromSpec),
+			},
+			want: true,
+		},
+		"no consumers": {
+			objects: []runtime.Object{testDeployment("team-a", "web", secretVolumePodSpec("other-secret"))},
+			want:    false,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.objects...)
+			got, err := namespaceUsesSecret(context.Background(), clientset, "team-a", "oidc-token")
+			if err != nil {
+				t.Fatalf("namespaceUsesSecret() = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("namespaceUsesSecret() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceUsesSecretListOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if _, err := namespaceUsesSecret(context.Background(), clientset, "team-a", "oidc-token"); err != nil {
+		t.Fatalf("namespaceUsesSecret() = %v", err)
+	}
+	listed := map[string]bool{}
+	for _, action := range clientset.Actions() {
+		list, ok := action.(k8stesting.ListActionImpl)
+		if !ok {
+			continue
+		}
+		listed[list.GetResource().Resource] = true
+		if list.ListOptions.ResourceVersion != "0" {
+			t.Errorf("%s list ResourceVersion = %q, want it served from the cache", list.GetResource().Resource, list.ListOptions.ResourceVersion)
+		}
+		if list.GetResource().Resource == "pods" && list.ListOptions.FieldSelector != runningPodsSelector {
+			t.Errorf("pod list FieldSelector = %q, want %q", list.ListOptions.FieldSelector, runningPodsSelector)
+		}
+	}
+	if !listed["deployments"] || !listed["pods"] {
+		t.Errorf("listed %v, want deployments and pods", listed)
+	}
+}
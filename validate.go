@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Run modes selected via MODE or the --validate flag.
+const (
+	modeRun      = "run"
+	modeValidate = "validate"
+)
+
+type validationResult struct {
+	check   string
+	err     error
+	skipped bool
+}
+
+// validationReport collects the outcome of each validation check.
+type validationReport struct {
+	results []validationResult
+}
+
+func (r *validationReport) record(check string, err error) {
+	r.results = append(r.results, validationResult{check: check, err: err})
+}
+
+func (r *validationReport) skip(check string) {
+	r.results = append(r.results, validationResult{check: check, skipped: true})
+}
+
+// passed logs the report and returns whether every check passed.
+func (r *validationReport) passed() bool {
+	passed := true
+	log.Println("Validation report:")
+	for _, result := range r.results {
+		switch {
+		case result.skipped:
+			log.Printf("  [SKIP] %s", result.check)
+		case result.err != nil:
+			passed = false
+			log.Printf("  [FAIL] %s: %v", result.check, result.err)
+		default:
+			log.Printf("  [PASS] %s", result.check)
+		}
+	}
+	if passed {
+		log.Println("Validation succeeded.")
+	} else {
+		log.Println("Validation failed.")
+	}
+	return passed
+}
+
+// runValidation performs a dry health check: a token fetch for every
+// namespace group, Kubernetes client setup, namespace discovery and an RBAC
+// preflight. It never writes secrets. It logs a report and returns whether
+// every check passed. When Kubernetes is not an output, only the tokens are
+// checked.
+func runValidation(ctx context.Context, tokenClient *http.Client, tokenReq tokenRequest, cfg *config) bool {
+	report := &validationReport{}
+	log.Println("Validating configuration (no secrets will be written)...")
+
+	validateTokens(ctx, tokenClient, tokenReq, cfg, report)
+
+	if clusterResource(cfg.OutputModes) == "" {
+		log.Println("Kubernetes is not an output: skipping the Kubernetes checks.")
+		for _, check := range []string{"kubernetes client", "kubernetes server version", "namespace discovery", "rbac permissions"} {
+			report.skip(check)
+		}
+		return report.passed()
+	}
+
+	kubeClient, err := getKubeClient(cfg.Kube)
+	report.record("kubernetes client", err)
+	if err != nil {
+		for _, check := range []string{"kubernetes server version", "namespace discovery", "rbac permissions"} {
+			report.skip(check)
+		}
+		return report.passed()
+	}
+	validateCluster(ctx, kubeClient, cfg, report)
+	return report.passed()
+}
+
+// validateTokens fetches one token per namespace group, as a run would, and
+// records whether each endpoint was reachable and accepted the credentials.
+func validateTokens(ctx context.Context, tokenClient *http.Client, tokenReq tokenRequest, cfg *config, report *validationReport) {
+	groups := cfg.NamespaceGroups
+	if len(groups) == 0 {
+		groups = []namespaceGroup{{Name: defaultGroupName}}
+	}
+	tokens := fetchGroupTokens(ctx, tokenClient, tokenReq, groups, cfg.TokenFetchConcurrency)
+	for _, group := range groups {
+		suffix := ""
+		if len(cfg.NamespaceGroups) > 0 {
+			suffix = fmt.Sprintf(" (namespace group '%s')", group.Name)
+		}
+		err := tokens[group.Name].err
+		var urlErr *url.Error
+		switch {
+		case err == nil:
+			report.record("token endpoint reachable"+suffix, nil)
+			report.record("client credentials accepted"+suffix, nil)
+		case errors.As(err, &urlErr):
+			report.record("token endpoint reachable"+suffix, err)
+			report.skip("client credentials accepted" + suffix)
+		default:
+			report.record("token endpoint reachable"+suffix, nil)
+			report.record("client credentials accepted"+suffix, err)
+		}
+	}
+}
+
+// validateCluster checks the API server version, resolves the target
+// namespaces and reviews the permissions a run needs. In reference mode those
+// are the central secret and the reference ConfigMaps in the targets.
+func validateCluster(ctx context.Context, kubeClient kubernetes.Interface, cfg *config, report *validationReport) {
+	_, err := checkServerVersion(ctx, kubeClient)
+	report.record("kubernetes server version", err)
+	if err != nil {
+		report.skip("namespace discovery")
+		report.skip("rbac permissions")
+		return
+	}
+
+	var checks []accessCheck
+	if cfg.Namespaces.listsCluster() {
+		checks = namespaceListChecks()
+	}
+	namespaces, err := resolveNamespaces(ctx, kubeClient, cfg.Namespaces)
+	report.record("namespace discovery", err)
+	if err == nil {
+		var secretNames map[string]string
+		if cfg.SecretNameTemplate != nil {
+			var failures []error
+			secretNames, namespaces, failures = namespaceSecretNames(namespaces, cfg.SecretNameTemplate)
+			report.record("secret names", errors.Join(failures...))
+		}
+		if cfg.DistributionMode == distributionReference {
+			checks = append(checks, secretAccessChecks([]string{cfg.CentralSecretNamespace}, cfg.SecretName, nil, cfg.recreatesSecrets())...)
+			checks = append(checks, referenceAccessChecks(namespaceNames(namespaces), cfg.ReferenceConfigMapName)...)
+		} else {
+			checks = append(checks, targetAccessChecks(clusterResource(cfg.OutputModes), namespaceNames(namespaces), cfg.SecretName, secretNames, cfg.recreatesSecrets())...)
+		}
+	}
+	preflightCtx, preflightCancel := context.WithTimeout(ctx, k8sPreflightTimeout)
+	report.record("rbac permissions", preflightRBACCheck(preflightCtx, kubeClient, checks))
+	preflightCancel()
+}
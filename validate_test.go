@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// outcome summarizes a check in the report as PASS, FAIL, SKIP or "" when
+// the check was not run.
+func outcome(report *validationReport, check string) string {
+	for _, result := range report.results {
+		if result.check != check {
+			continue
+		}
+		switch {
+		case result.skipped:
+			return "SKIP"
+		case result.err != nil:
+			return "FAIL"
+		}
+		return "PASS"
+	}
+	return ""
+}
+
+func testValidationConfig() *config {
+	return &config{
+		SecretName:            "oidc-token",
+		OutputModes:           []string{outputKubernetes},
+		TokenFetchConcurrency: 1,
+		Namespaces:            namespaceSource{Targets: "team-a,team-b"},
+	}
+}
+
+// fakeCluster is a cluster running gitVersion whose access reviews deny the
+// given verbs.
+func fakeCluster(gitVersion string, denied ...string) *fake.Clientset {
+	clientset := fakeAccessReviews(denied...)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &kubeversion.Info{GitVersion: gitVersion}
+	return clientset
+}
+
+func TestValidateTokens(t *testing.T) {
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	ok := newFakeTokenServer(t, testTokenBody)
+
+	tests := []struct {
+		name                string
+		tokenURL            string
+		reachable, accepted string
+	}{
+		{"success", ok.URL, "PASS", "PASS"},
+		{"unreachable", unreachable.URL, "FAIL", "SKIP"},
+		{"invalid credentials", unauthorized.URL, "PASS", "FAIL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &validationReport{}
+			validateTokens(context.Background(), http.DefaultClient, testTokenRequest(tt.tokenURL), testValidationConfig(), report)
+			if got := outcome(report, "token endpoint reachable"); got != tt.reachable {
+				t.Errorf("token endpoint reachable = %s, want %s", got, tt.reachable)
+			}
+			if got := outcome(report, "client credentials accepted"); got != tt.accepted {
+				t.Errorf("client credentials accepted = %s, want %s", got, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestValidateTokensPerGroup(t *testing.T) {
+	ok := newFakeTokenServer(t, testTokenBody)
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+
+	cfg := testValidationConfig()
+	cfg.NamespaceGroups = []namespaceGroup{
+		{Name: "payments", TokenURL: unauthorized.URL},
+		{Name: "search"},
+	}
+	report := &validationReport{}
+	validateTokens(context.Background(), http.DefaultClient, testTokenRequest(ok.URL), cfg, report)
+
+	if got := outcome(report, "client credentials accepted (namespace group 'payments')"); got != "FAIL" {
+		t.Errorf("payments credentials = %s, want FAIL", got)
+	}
+	if got := outcome(report, "client credentials accepted (namespace group 'search')"); got != "PASS" {
+		t.Errorf("search credentials = %s, want PASS", got)
+	}
+	if report.passed() {
+		t.Error("passed() = true with a failing group")
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	tests := []struct {
+		name                     string
+		clientset                *fake.Clientset
+		namespaces               namespaceSource
+		version, discovery, rbac string
+	}{
+		{"success", fakeCluster("v1.30.2"), namespaceSource{Targets: "team-a"}, "PASS", "PASS", "PASS"},
+		{"old server", fakeCluster("v1.18.0"), namespaceSource{Targets: "team-a"}, "FAIL", "SKIP", "SKIP"},
+		{"namespace discovery", fakeCluster("v1.30.2"), namespaceSource{Discover: discoverFromConfigMap, ConfigMap: "ops/missing", ConfigMapKey: "namespaces"}, "PASS", "FAIL", "PASS"},
+		{"rbac denied", fakeCluster("v1.30.2", "patch"), namespaceSource{Targets: "team-a"}, "PASS", "PASS", "FAIL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testValidationConfig()
+			cfg.Namespaces = tt.namespaces
+			report := &validationReport{}
+			validateCluster(context.Background(), tt.clientset, cfg, report)
+			for check, want := range map[string]string{"kubernetes server version": tt.version, "namespace discovery": tt.discovery, "rbac permissions": tt.rbac} {
+				if got := outcome(report, check); got != want {
+					t.Errorf("%s = %s, want %s", check, got, want)
+				}
+			}
+			for _, action := range tt.clientset.Actions() {
+				if verb := action.GetVerb(); verb != "get" && verb != "list" && !(verb == "create" && action.GetResource().Resource == "selfsubjectaccessreviews") {
+					t.Errorf("validation made a %s call on %s", verb, action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateClusterReferenceMode(t *testing.T) {
+	clientset := fakeCluster("v1.30.2")
+	var reviewed []string
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attrs := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).Spec.ResourceAttributes
+		reviewed = append(reviewed, attrs.Verb+" "+attrs.Resource+" "+attrs.Namespace)
+		return false, nil, nil
+	})
+	cfg := testValidationConfig()
+	cfg.Namespaces = namespaceSource{Targets: "team-a"}
+	cfg.DistributionMode = distributionReference
+	cfg.CentralSecretNamespace = "oidc-system"
+	cfg.ReferenceConfigMapName = "oidc-token-ref"
+
+	report := &validationReport{}
+	validateCluster(context.Background(), clientset, cfg, report)
+	if !report.passed() {
+		t.Fatalf("validation failed: %+v", report.results)
+	}
+	want := []string{
+		"get secrets oidc-system", "create secrets oidc-system", "patch secrets oidc-system",
+		"get configmaps team-a", "create configmaps team-a", "patch configmaps team-a",
+	}
+	if len(reviewed) != len(want) {
+		t.Fatalf("reviewed %v, want %v", reviewed, want)
+	}
+	for i := range want {
+		if reviewed[i] != want[i] {
+			t.Errorf("review %d = %q, want %q", i, reviewed[i], want[i])
+		}
+	}
+}